@@ -16,6 +16,44 @@ const (
 
 )
 
+const (
+	SourceRegexp = "regexp"
+	SourceConst  = "const"
+	SourceExpr   = "expr"
+	SourceMeta   = "meta"
+	// SourceSD - RFC5424 structured data param
+	SourceSD = "sd"
+	// SourceCorrelate - field of the opening row, see Correlation
+	SourceCorrelate = "correlate"
+	// SourceSubscriber - subscriber of the address field at receive time, see RADIUS accounting
+	SourceSubscriber = "subscriber"
+	// SourceDedup - hash of dedup key fields of the row, the same on every instance, see Deduplication
+	SourceDedup = "dedup"
+
+	MetaReceived  = "received"
+	MetaTimestamp = "timestamp"
+	MetaHostname  = "hostname"
+	MetaClient    = "client"
+	MetaTag       = "tag"
+	MetaFacility  = "facility"
+	MetaSeverity  = "severity"
+	MetaPriority  = "priority"
+	MetaRule      = "rule"
+)
+
+// MetaKeys - syslog metadata available for fields with `source: meta`
+var MetaKeys = map[string]bool{
+	MetaReceived:  true,
+	MetaTimestamp: true,
+	MetaHostname:  true,
+	MetaClient:    true,
+	MetaTag:       true,
+	MetaFacility:  true,
+	MetaSeverity:  true,
+	MetaPriority:  true,
+	MetaRule:      true,
+}
+
 
 var SqlFields = map[string]string{
 	TypeNumber8:    "UInt8",
@@ -11,7 +11,12 @@ import (
 
 func (f *TimestampModelField) Convert(value string) (interface{}, error) {
 
-	t, err := time.Parse(f.Layout, value)
+	location := f.Location
+	if location == nil {
+		location = time.UTC
+	}
+
+	t, err := time.ParseInLocation(f.Layout, value, location)
 	if err != nil {
 		return nil, err
 	}
@@ -38,6 +43,10 @@ func (s *StringModelField) Convert(value string) (interface{}, error) {
 
 func (s *IpToIntModelField) Convert(value string) (interface{}, error) {
 	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, errors.Newf("cannot parse ip address %q", value)
+	}
+
 	if len(ip) == net.IPv6len {
 		return binary.BigEndian.Uint32(ip[12:16]), nil
 	}
@@ -60,3 +69,28 @@ func (s *UInt16ModelField) Convert(value string) (interface{}, error) {
 		return uint16(v), nil
 	}
 }
+
+func (s *UInt32ModelField) Convert(value string) (interface{}, error) {
+	if v, err := strconv.ParseUint(value, 10, 32); err != nil {
+		return nil, err
+	} else {
+		return uint32(v), nil
+	}
+}
+
+func (s *UInt64ModelField) Convert(value string) (interface{}, error) {
+	if v, err := strconv.ParseUint(value, 10, 64); err != nil {
+		return nil, err
+	} else {
+		return v, nil
+	}
+}
+
+func (s *IpModelField) Convert(value string) (interface{}, error) {
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, errors.Newf("cannot parse ip address %q", value)
+	}
+
+	return ip.To16(), nil
+}
@@ -0,0 +1,321 @@
+package common
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+type (
+	// Expression is a compiled field expression, evaluated against already extracted row values
+	Expression interface {
+		Eval(row FlowMessagePayload) (string, error)
+	}
+
+	exprLiteral struct {
+		value string
+	}
+
+	exprField struct {
+		name string
+	}
+
+	exprBinary struct {
+		op          rune
+		left, right Expression
+	}
+
+	exprCall struct {
+		name string
+		args []Expression
+	}
+
+	exprParser struct {
+		src string
+		pos int
+	}
+)
+
+var exprFunctions = map[string]func(args []string) (string, error){
+	"concat": func(args []string) (string, error) {
+		return strings.Join(args, ""), nil
+	},
+	"lower": func(args []string) (string, error) {
+		if len(args) != 1 {
+			return "", errors.New("lower() takes exactly one argument")
+		}
+		return strings.ToLower(args[0]), nil
+	},
+	"upper": func(args []string) (string, error) {
+		if len(args) != 1 {
+			return "", errors.New("upper() takes exactly one argument")
+		}
+		return strings.ToUpper(args[0]), nil
+	},
+	"coalesce": func(args []string) (string, error) {
+		for _, a := range args {
+			if a != "" {
+				return a, nil
+			}
+		}
+		return "", nil
+	},
+}
+
+// ParseExpression compiles expression source like `end_port - start_port + 1` or `concat(src_ip, ":", start_port)`.
+// Identifiers refer to row fields, arithmetic operators work on integers, strings are double-quoted.
+func ParseExpression(src string) (Expression, error) {
+	p := &exprParser{src: src}
+
+	e, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+
+	p.skipSpaces()
+	if p.pos != len(p.src) {
+		return nil, errors.Newf("unexpected %q at position %d", p.src[p.pos:], p.pos)
+	}
+
+	return e, nil
+}
+
+// ExpressionFields returns names of row fields the expression refers to, in order of appearance
+func ExpressionFields(e Expression) []string {
+	switch n := e.(type) {
+	case *exprField:
+		return []string{n.name}
+	case *exprBinary:
+		return append(ExpressionFields(n.left), ExpressionFields(n.right)...)
+	case *exprCall:
+		var names []string
+		for _, a := range n.args {
+			names = append(names, ExpressionFields(a)...)
+		}
+		return names
+	}
+	return nil
+}
+
+func (e *exprLiteral) Eval(FlowMessagePayload) (string, error) {
+	return e.value, nil
+}
+
+func (e *exprField) Eval(row FlowMessagePayload) (string, error) {
+	v, ok := row[e.name]
+	if !ok {
+		return "", errors.Newf("unknown field %q", e.name)
+	}
+	return v, nil
+}
+
+func (e *exprBinary) Eval(row FlowMessagePayload) (string, error) {
+	l, err := e.left.Eval(row)
+	if err != nil {
+		return "", err
+	}
+
+	r, err := e.right.Eval(row)
+	if err != nil {
+		return "", err
+	}
+
+	a, err := strconv.ParseInt(l, 10, 64)
+	if err != nil {
+		return "", errors.Newf("left operand of %q is not an integer: %q", e.op, l)
+	}
+
+	b, err := strconv.ParseInt(r, 10, 64)
+	if err != nil {
+		return "", errors.Newf("right operand of %q is not an integer: %q", e.op, r)
+	}
+
+	switch e.op {
+	case '+':
+		a += b
+	case '-':
+		a -= b
+	case '*':
+		a *= b
+	case '/', '%':
+		if b == 0 {
+			return "", errors.New("division by zero")
+		}
+		if e.op == '/' {
+			a /= b
+		} else {
+			a %= b
+		}
+	}
+
+	return strconv.FormatInt(a, 10), nil
+}
+
+func (e *exprCall) Eval(row FlowMessagePayload) (string, error) {
+	args := make([]string, 0, len(e.args))
+	for _, a := range e.args {
+		v, err := a.Eval(row)
+		if err != nil {
+			return "", err
+		}
+		args = append(args, v)
+	}
+
+	return exprFunctions[e.name](args)
+}
+
+func (p *exprParser) skipSpaces() {
+	for p.pos < len(p.src) && unicode.IsSpace(rune(p.src[p.pos])) {
+		p.pos++
+	}
+}
+
+func (p *exprParser) peek() byte {
+	p.skipSpaces()
+	if p.pos >= len(p.src) {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+func (p *exprParser) parseSum() (Expression, error) {
+	left, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		op := p.peek()
+		if op != '+' && op != '-' {
+			return left, nil
+		}
+		p.pos++
+
+		right, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		left = &exprBinary{op: rune(op), left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseProduct() (Expression, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		op := p.peek()
+		if op != '*' && op != '/' && op != '%' {
+			return left, nil
+		}
+		p.pos++
+
+		right, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		left = &exprBinary{op: rune(op), left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseOperand() (Expression, error) {
+	c := p.peek()
+	switch {
+	case c == 0:
+		return nil, errors.New("unexpected end of expression")
+	case c == '(':
+		p.pos++
+		e, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, errors.Newf("missing ')' at position %d", p.pos)
+		}
+		p.pos++
+		return e, nil
+	case c == '"':
+		return p.parseString()
+	case c == '-' || (c >= '0' && c <= '9'):
+		start := p.pos
+		p.pos++
+		for p.pos < len(p.src) && p.src[p.pos] >= '0' && p.src[p.pos] <= '9' {
+			p.pos++
+		}
+		if _, err := strconv.ParseInt(p.src[start:p.pos], 10, 64); err != nil {
+			return nil, errors.Newf("bad number %q at position %d", p.src[start:p.pos], start)
+		}
+		return &exprLiteral{value: p.src[start:p.pos]}, nil
+	case c == '_' || unicode.IsLetter(rune(c)):
+		start := p.pos
+		for p.pos < len(p.src) && (p.src[p.pos] == '_' || unicode.IsLetter(rune(p.src[p.pos])) || unicode.IsDigit(rune(p.src[p.pos]))) {
+			p.pos++
+		}
+		name := p.src[start:p.pos]
+		if p.peek() != '(' {
+			return &exprField{name: name}, nil
+		}
+		return p.parseCall(name)
+	}
+
+	return nil, errors.Newf("unexpected %q at position %d", c, p.pos)
+}
+
+func (p *exprParser) parseCall(name string) (Expression, error) {
+	if _, ok := exprFunctions[name]; !ok {
+		return nil, errors.Newf("unknown function %q", name)
+	}
+	p.pos++ // '('
+
+	call := &exprCall{name: name}
+	if p.peek() == ')' {
+		p.pos++
+		return call, nil
+	}
+
+	for {
+		arg, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		call.args = append(call.args, arg)
+
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case ')':
+			p.pos++
+			return call, nil
+		default:
+			return nil, errors.Newf("expected ',' or ')' at position %d", p.pos)
+		}
+	}
+}
+
+func (p *exprParser) parseString() (Expression, error) {
+	start := p.pos
+	p.pos++ // opening quote
+
+	var buf strings.Builder
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		p.pos++
+		switch c {
+		case '"':
+			return &exprLiteral{value: buf.String()}, nil
+		case '\\':
+			if p.pos < len(p.src) {
+				buf.WriteByte(p.src[p.pos])
+				p.pos++
+			}
+		default:
+			buf.WriteByte(c)
+		}
+	}
+
+	return nil, errors.Newf("unterminated string at position %d", start)
+}
@@ -0,0 +1,106 @@
+package common
+
+import (
+	"reflect"
+	"testing"
+)
+
+var exprRow = FlowMessagePayload{
+	"start_port": "1024",
+	"end_port":   "2047",
+	"dst_ip":     "198.51.100.20",
+	"user":       "Alice",
+	"empty":      "",
+}
+
+func TestExpressionEval(t *testing.T) {
+	for _, c := range []struct {
+		src    string
+		expect string
+	}{
+		{`end_port - start_port + 1`, "1024"},
+		{`1 + 2 * 3`, "7"},
+		{`(1 + 2) * 3`, "9"},
+		{`10 - 4 - 3`, "3"},
+		{`100 / 10 / 5`, "2"},
+		{`7 + 10 % 4 * 2`, "11"},
+		{`-3 * 2`, "-6"},
+		{`start_port/ 4 `, "256"},
+		{`"a \"quoted\" \\ string"`, `a "quoted" \ string`},
+		{`concat(dst_ip, ":", start_port, "-", end_port)`, "198.51.100.20:1024-2047"},
+		{`concat()`, ""},
+		{`concat(end_port - start_port, "/", 2 * (1 + 1))`, "1023/4"},
+		{`lower(user)`, "alice"},
+		{`upper(concat(user, "-", lower("X")))`, "ALICE-X"},
+		{`coalesce(empty, "", user)`, "Alice"},
+		{`coalesce(empty)`, ""},
+	} {
+		e, err := ParseExpression(c.src)
+		if err != nil {
+			t.Errorf("%s: %v", c.src, err)
+			continue
+		}
+
+		v, err := e.Eval(exprRow)
+		if err != nil {
+			t.Errorf("%s: %v", c.src, err)
+			continue
+		}
+
+		if v != c.expect {
+			t.Errorf("%s = %q, expected %q", c.src, v, c.expect)
+		}
+	}
+}
+
+func TestExpressionEvalErrors(t *testing.T) {
+	for _, src := range []string{
+		`user + 1`,
+		`1 - concat("x")`,
+		`start_port / 0`,
+		`start_port % (end_port - end_port)`,
+		`missing`,
+		`lower(user, user)`,
+		`upper()`,
+	} {
+		e, err := ParseExpression(src)
+		if err != nil {
+			t.Errorf("%s: %v", src, err)
+			continue
+		}
+
+		if v, err := e.Eval(exprRow); err == nil {
+			t.Errorf("%s = %q, expected error", src, v)
+		}
+	}
+}
+
+func TestParseExpressionErrors(t *testing.T) {
+	for _, src := range []string{
+		``,
+		`1 +`,
+		`(1 + 2`,
+		`1 2`,
+		`"unterminated`,
+		`unknown(1)`,
+		`concat(1,`,
+		`concat(1 2)`,
+		`99999999999999999999`,
+		`start_port $ 1`,
+	} {
+		if _, err := ParseExpression(src); err == nil {
+			t.Errorf("%q is parsed", src)
+		}
+	}
+}
+
+func TestExpressionFields(t *testing.T) {
+	e, err := ParseExpression(`concat(dst_ip, ":", end_port - start_port * 2, lower(user)) `)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if names := ExpressionFields(e); !reflect.DeepEqual(names, []string{"dst_ip", "end_port", "start_port", "user"}) {
+		t.Errorf("fields %q", names)
+	}
+}
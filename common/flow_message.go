@@ -11,8 +11,11 @@ type (
 	FlowMessagePayload map[string]string
 
 	PoolItem struct {
-		Size int
-		Last time.Time
+		// Size - rows of the batch, Bytes - estimated size of their fields
+		Size  int
+		Bytes int
+		// Since - time the first row of the batch was added
+		Since time.Time
 		Items []FlowMessagePayload
 	}
 
@@ -0,0 +1,127 @@
+package common
+
+import (
+	"bufio"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+type (
+	// PatternLibrary holds grok-style named sub-patterns used by rule `pattern`
+	PatternLibrary struct {
+		patterns map[string]string
+	}
+)
+
+// maxPatternDepth limits nesting of patterns referring to other patterns, protects from reference cycles
+const maxPatternDepth = 32
+
+// BuiltinPatterns - patterns available without any configuration
+var BuiltinPatterns = map[string]string{
+	"INT":         `[+-]?\d+`,
+	"NUMBER":      `[+-]?\d+(?:\.\d+)?`,
+	"WORD":        `\w+`,
+	"NOTSPACE":    `\S+`,
+	"SPACE":       `\s*`,
+	"DATA":        `.*?`,
+	"GREEDYDATA":  `.*`,
+	"IPV4":        `(?:\d{1,3}\.){3}\d{1,3}`,
+	"IPV6":        `[0-9A-Fa-f:]*:[0-9A-Fa-f:.]+`,
+	"IP":          `(?:%{IPV4}|%{IPV6})`,
+	"PORT":        `\d{1,5}`,
+	"HOSTNAME":    `[0-9A-Za-z][0-9A-Za-z\-_.]*`,
+	"JUNOS_TS":    `\d{4}-\d{2}-\d{2}\s\d{2}:\d{2}:\d{2}`,
+	"JUNOS_EVENT": `[A-Z][A-Z0-9_]+`,
+	"JUNOS_POOL":  `[^\s:{}]+`,
+	"JUNOS_ID":    `\{[^}]*\}`,
+	"JUNOS_SVC":   `\[[^\]]*\]`,
+}
+
+var patternReference = regexp.MustCompile(`%\{(\w+)(?::(\w+))?\}`)
+
+// NewPatternLibrary returns library containing built-in patterns
+func NewPatternLibrary() *PatternLibrary {
+	l := &PatternLibrary{patterns: make(map[string]string, len(BuiltinPatterns))}
+	for name, p := range BuiltinPatterns {
+		l.patterns[name] = p
+	}
+	return l
+}
+
+// Add defines or overrides pattern
+func (l *PatternLibrary) Add(name, pattern string) {
+	l.patterns[name] = pattern
+}
+
+// Load reads patterns file in grok format: `NAME regexp` per line, empty lines and lines starting with # are ignored
+func (l *PatternLibrary) Load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(text, " ", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+			return errors.Newf("%s:%d: expected `NAME pattern`", path, line)
+		}
+
+		l.patterns[parts[0]] = strings.TrimSpace(parts[1])
+	}
+
+	return scanner.Err()
+}
+
+// Compile expands `%{NAME}` and `%{NAME:field}` references, the latter become named capture groups
+func (l *PatternLibrary) Compile(pattern string) (*regexp.Regexp, error) {
+	expanded, err := l.expand(pattern, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return regexp.Compile(expanded)
+}
+
+func (l *PatternLibrary) expand(pattern string, depth int) (string, error) {
+	if depth > maxPatternDepth {
+		return "", errors.New("patterns nested too deep, possible reference cycle")
+	}
+
+	var err error
+	result := patternReference.ReplaceAllStringFunc(pattern, func(ref string) string {
+		if err != nil {
+			return ""
+		}
+
+		m := patternReference.FindStringSubmatch(ref)
+		p, ok := l.patterns[m[1]]
+		if !ok {
+			err = errors.Newf("unknown pattern %q", m[1])
+			return ""
+		}
+
+		var sub string
+		if sub, err = l.expand(p, depth+1); err != nil {
+			return ""
+		}
+
+		if m[2] != "" {
+			return "(?P<" + m[2] + ">" + sub + ")"
+		}
+		return "(?:" + sub + ")"
+	})
+
+	return result, err
+}
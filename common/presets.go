@@ -0,0 +1,406 @@
+package common
+
+type (
+	// Preset is a built-in, tested rule for a well known Juniper message, enabled by `preset: <name>` in syslog.rules
+	Preset struct {
+		Name        string
+		Description string
+		Table       string
+		Contains    []string
+		Pattern     string
+		Fields      []map[string]interface{}
+		DDL         string
+		Correlate   *Correlation
+		Samples     []PresetSample
+	}
+
+	// PresetSample is a real message the preset must parse, Expect holds captured values before conversion.
+	// RFC5424 samples have MsgID and StructuredData set, Line is the message part then.
+	PresetSample struct {
+		Line           string
+		MsgID          string
+		StructuredData string
+		Expect         FlowMessagePayload
+	}
+)
+
+var (
+	presetTimestamp = map[string]interface{}{"name": "timestamp", "type": "timestamp", "source": SourceMeta, "key": MetaTimestamp}
+	presetHostname  = map[string]interface{}{"name": "hostname", "type": "string", "source": SourceMeta, "key": MetaHostname}
+
+	presetPortBlockFields = func(prefix, interim string) []map[string]interface{} {
+		return []map[string]interface{}{
+			presetTimestamp,
+			presetHostname,
+			{"name": "event", "type": "list", "default": -1, "values": map[interface{}]interface{}{
+				prefix + "RELEASE": 0,
+				prefix + "ALLOC":   1,
+				prefix + interim:   2,
+			}},
+			{"name": "src_ip", "type": "ip2int"},
+			{"name": "dst_ip", "type": "ip2int"},
+			{"name": "start_port", "type": "uint16"},
+			{"name": "end_port", "type": "uint16"},
+		}
+	}
+
+	presetPortBlockDDL = `CREATE TABLE IF NOT EXISTS {{.Table}} (
+	timestamp  DateTime,
+	hostname   LowCardinality(String),
+	event      Int8,
+	src_ip     UInt32,
+	dst_ip     UInt32,
+	start_port UInt16,
+	end_port   UInt16
+) ENGINE = MergeTree()
+PARTITION BY toYYYYMMDD(timestamp)
+ORDER BY (dst_ip, start_port, timestamp)`
+
+	presetSessionFields = func(extra ...map[string]interface{}) []map[string]interface{} {
+		return append([]map[string]interface{}{
+			presetTimestamp,
+			presetHostname,
+			{"name": "src_ip", "type": "ip"},
+			{"name": "src_port", "type": "uint16"},
+			{"name": "dst_ip", "type": "ip"},
+			{"name": "dst_port", "type": "uint16"},
+			{"name": "service", "type": "string"},
+			{"name": "nat_src_ip", "type": "ip"},
+			{"name": "nat_src_port", "type": "uint16"},
+			{"name": "nat_dst_ip", "type": "ip"},
+			{"name": "nat_dst_port", "type": "uint16"},
+			{"name": "src_nat_rule", "type": "string"},
+			{"name": "dst_nat_rule", "type": "string"},
+			{"name": "protocol", "type": "uint16"},
+			{"name": "policy", "type": "string"},
+			{"name": "src_zone", "type": "string"},
+			{"name": "dst_zone", "type": "string"},
+			{"name": "session_id", "type": "uint64"},
+		}, extra...)
+	}
+
+	presetSessionColumns = `
+	timestamp    DateTime,
+	hostname     LowCardinality(String),
+	src_ip       IPv6,
+	src_port     UInt16,
+	dst_ip       IPv6,
+	dst_port     UInt16,
+	service      LowCardinality(String),
+	nat_src_ip   IPv6,
+	nat_src_port UInt16,
+	nat_dst_ip   IPv6,
+	nat_dst_port UInt16,
+	src_nat_rule LowCardinality(String),
+	dst_nat_rule LowCardinality(String),
+	protocol     UInt16,
+	policy       LowCardinality(String),
+	src_zone     LowCardinality(String),
+	dst_zone     LowCardinality(String),
+	session_id   UInt64`
+
+	presetSessionTuple = `%{IP:src_ip}/%{PORT:src_port}->%{IP:dst_ip}/%{PORT:dst_port} (?:0x\w+ )?%{NOTSPACE:service} ` +
+		`%{IP:nat_src_ip}/%{PORT:nat_src_port}->%{IP:nat_dst_ip}/%{PORT:nat_dst_port} (?:0x\w+ )?` +
+		`(?:\w+ rule|N/A) %{NOTSPACE:src_nat_rule} (?:\w+ rule|N/A) %{NOTSPACE:dst_nat_rule} ` +
+		`%{INT:protocol} %{NOTSPACE:policy} %{NOTSPACE:src_zone} %{NOTSPACE:dst_zone} %{INT:session_id}`
+)
+
+// Presets - catalog of built-in rules by name
+var Presets = map[string]*Preset{
+	"mx-port-block": {
+		Name:        "mx-port-block",
+		Description: "MX services PIC/MS-MPC port block allocation, release and interim (JSERVICES_NAT_PORT_BLOCK_*)",
+		Table:       "jnat_log",
+		Contains:    []string{"JSERVICES_NAT_PORT_BLOCK_"},
+		Pattern:     `(?P<event>JSERVICES_NAT_PORT_BLOCK_(?:ALLOC|RELEASE|ACTIVE)):\s+%{IPV4:src_ip}\s+->\s+%{IPV4:dst_ip}:%{PORT:start_port}-%{PORT:end_port}`,
+		Fields:      presetPortBlockFields("JSERVICES_NAT_PORT_BLOCK_", "ACTIVE"),
+		DDL:         presetPortBlockDDL,
+		Samples: []PresetSample{
+			{
+				Line:   `2020-10-05 11:23:04: mx-1{sp-0/0/0}[FWNAT]: JSERVICES_NAT_PORT_BLOCK_ALLOC: 100.64.12.7 -> 198.51.100.20:2048-2303 0x5f7b0c48`,
+				Expect: FlowMessagePayload{"event": "JSERVICES_NAT_PORT_BLOCK_ALLOC", "src_ip": "100.64.12.7", "dst_ip": "198.51.100.20", "start_port": "2048", "end_port": "2303"},
+			},
+			{
+				Line:   `{ms-1/0/0}[jservices-nat]: JSERVICES_NAT_PORT_BLOCK_RELEASE: 100.64.12.7 -> 198.51.100.20:2048-2303 0x5f7b0c48`,
+				Expect: FlowMessagePayload{"event": "JSERVICES_NAT_PORT_BLOCK_RELEASE", "src_ip": "100.64.12.7", "dst_ip": "198.51.100.20", "start_port": "2048", "end_port": "2303"},
+			},
+			{
+				Line:   `{ms-1/0/0}[jservices-nat]: JSERVICES_NAT_PORT_BLOCK_ACTIVE: 10.20.0.3 -> 203.0.113.9:60416-60671 0x5f7b0c48`,
+				Expect: FlowMessagePayload{"event": "JSERVICES_NAT_PORT_BLOCK_ACTIVE", "src_ip": "10.20.0.3", "dst_ip": "203.0.113.9", "start_port": "60416", "end_port": "60671"},
+			},
+		},
+	},
+
+	"mx-rule-match": {
+		Name:        "mx-rule-match",
+		Description: "MX services NAT rule match with original flow tuple (JSERVICES_NAT_RULE_MATCH)",
+		Table:       "jnat_rule_match",
+		Contains:    []string{"JSERVICES_NAT_RULE_MATCH"},
+		Pattern: `JSERVICES_NAT_RULE_MATCH:\s+proto %{INT:protocol} \(%{WORD}\) application: %{DATA:application}, ` +
+			`%{NOTSPACE:interface}:%{IPV4:src_ip}:%{PORT:src_port} -> %{IPV4:dst_ip}:%{PORT:dst_port}, ` +
+			`Match NAT rule-set: %{DATA:rule_set}, rule: %{DATA:nat_rule}, term: %{NOTSPACE:term}`,
+		Fields: []map[string]interface{}{
+			presetTimestamp,
+			presetHostname,
+			{"name": "protocol", "type": "uint16"},
+			{"name": "application", "type": "string"},
+			{"name": "interface", "type": "string"},
+			{"name": "src_ip", "type": "ip2int"},
+			{"name": "src_port", "type": "uint16"},
+			{"name": "dst_ip", "type": "ip2int"},
+			{"name": "dst_port", "type": "uint16"},
+			{"name": "rule_set", "type": "string"},
+			{"name": "nat_rule", "type": "string"},
+			{"name": "term", "type": "string"},
+		},
+		DDL: `CREATE TABLE IF NOT EXISTS {{.Table}} (
+	timestamp   DateTime,
+	hostname    LowCardinality(String),
+	protocol    UInt16,
+	application LowCardinality(String),
+	interface   LowCardinality(String),
+	src_ip      UInt32,
+	src_port    UInt16,
+	dst_ip      UInt32,
+	dst_port    UInt16,
+	rule_set    LowCardinality(String),
+	nat_rule    LowCardinality(String),
+	term        LowCardinality(String)
+) ENGINE = MergeTree()
+PARTITION BY toYYYYMMDD(timestamp)
+ORDER BY (src_ip, timestamp)`,
+		Samples: []PresetSample{
+			{
+				Line: `{sp-0/0/0}[FWNAT]: JSERVICES_NAT_RULE_MATCH: proto 6 (TCP) application: any, xe-0/0/0.100:100.64.1.2:53012 -> 93.184.216.34:443, Match NAT rule-set: (null), rule: cgnat, term: t1`,
+				Expect: FlowMessagePayload{"protocol": "6", "application": "any", "interface": "xe-0/0/0.100", "src_ip": "100.64.1.2", "src_port": "53012",
+					"dst_ip": "93.184.216.34", "dst_port": "443", "rule_set": "(null)", "nat_rule": "cgnat", "term": "t1"},
+			},
+		},
+	},
+
+	"srx-port-block": {
+		Name:        "srx-port-block",
+		Description: "SRX source NAT port block allocation, release and interim (RT_SRC_NAT_PBA_*), shares table layout with mx-port-block",
+		Table:       "jnat_log",
+		Contains:    []string{"RT_SRC_NAT_PBA_"},
+		Pattern: `(?P<event>RT_SRC_NAT_PBA_(?:ALLOC|RELEASE|INTERIM)):\s+Subscriber %{IPV4:src_ip} used/maximum blocks %{INT}/%{INT}, ` +
+			`\w+ port block \[%{PORT:start_port}-%{PORT:end_port}\] from %{IPV4:dst_ip}`,
+		Fields: presetPortBlockFields("RT_SRC_NAT_PBA_", "INTERIM"),
+		DDL:    presetPortBlockDDL,
+		Samples: []PresetSample{
+			{
+				Line:   `RT_SRC_NAT_PBA_ALLOC: Subscriber 192.168.10.5 used/maximum blocks 1/8, allocates port block [10240-10367] from 203.0.113.1 in source pool cgn-pool lsys_id: 0`,
+				Expect: FlowMessagePayload{"event": "RT_SRC_NAT_PBA_ALLOC", "src_ip": "192.168.10.5", "dst_ip": "203.0.113.1", "start_port": "10240", "end_port": "10367"},
+			},
+			{
+				Line:   `RT_SRC_NAT_PBA_RELEASE: Subscriber 192.168.10.5 used/maximum blocks 0/8, releases port block [10240-10367] from 203.0.113.1 in source pool cgn-pool lsys_id: 0`,
+				Expect: FlowMessagePayload{"event": "RT_SRC_NAT_PBA_RELEASE", "src_ip": "192.168.10.5", "dst_ip": "203.0.113.1", "start_port": "10240", "end_port": "10367"},
+			},
+		},
+	},
+
+	"srx-session-create": {
+		Name:        "srx-session-create",
+		Description: "SRX flow session creation with NAT translation (RT_FLOW_SESSION_CREATE)",
+		Table:       "srx_session_create",
+		Contains:    []string{"RT_FLOW_SESSION_CREATE"},
+		Pattern:     `RT_FLOW_SESSION_CREATE(?:_LS)?:\s+session created ` + presetSessionTuple,
+		Fields:      presetSessionFields(),
+		DDL: `CREATE TABLE IF NOT EXISTS {{.Table}} (` + presetSessionColumns + `
+) ENGINE = MergeTree()
+PARTITION BY toYYYYMMDD(timestamp)
+ORDER BY (nat_src_ip, nat_src_port, timestamp)`,
+		Samples: []PresetSample{
+			{
+				Line: `RT_FLOW_SESSION_CREATE: session created 10.0.0.2/50001->93.184.216.34/443 0x0 junos-https 203.0.113.1/20001->93.184.216.34/443 0x0 source rule snat-1 N/A N/A 6 trust-to-untrust trust untrust 84210 N/A(N/A) ge-0/0/1.0 UNKNOWN UNKNOWN UNKNOWN N/A N/A -1 N/A N/A N/A`,
+				Expect: FlowMessagePayload{"src_ip": "10.0.0.2", "src_port": "50001", "dst_ip": "93.184.216.34", "dst_port": "443", "service": "junos-https",
+					"nat_src_ip": "203.0.113.1", "nat_src_port": "20001", "src_nat_rule": "snat-1", "dst_nat_rule": "N/A", "protocol": "6",
+					"policy": "trust-to-untrust", "src_zone": "trust", "dst_zone": "untrust", "session_id": "84210"},
+			},
+			{
+				Line: `RT_FLOW_SESSION_CREATE: session created 192.168.1.20/61000->198.51.100.53/53 junos-dns-udp 192.168.1.20/61000->198.51.100.53/53 N/A N/A N/A N/A 17 allow-dns trust untrust 512`,
+				Expect: FlowMessagePayload{"src_ip": "192.168.1.20", "dst_port": "53", "service": "junos-dns-udp", "src_nat_rule": "N/A", "protocol": "17",
+					"policy": "allow-dns", "session_id": "512"},
+			},
+		},
+	},
+
+	"srx-session-close": {
+		Name:        "srx-session-close",
+		Description: "SRX flow session close with NAT translation, close reason and counters (RT_FLOW_SESSION_CLOSE)",
+		Table:       "srx_session_close",
+		Contains:    []string{"RT_FLOW_SESSION_CLOSE"},
+		Pattern:     presetSessionClosePattern,
+		Fields:      presetSessionFields(presetSessionCloseFields...),
+		DDL: `CREATE TABLE IF NOT EXISTS {{.Table}} (` + presetSessionColumns + `,` + presetSessionCloseColumns + `
+) ENGINE = MergeTree()
+PARTITION BY toYYYYMMDD(timestamp)
+ORDER BY (nat_src_ip, nat_src_port, timestamp)`,
+		Samples: []PresetSample{presetSessionCloseSample,
+			{
+				Line: `RT_FLOW_SESSION_CLOSE: session closed idle Timeout: 2001:db8::10/5353->2001:db8:1::53/53 junos-dns-udp 2001:db8::10/5353->2001:db8:1::53/53 N/A N/A N/A N/A 17 allow-dns trust untrust 4410 1(72) 1(130) 60`,
+				Expect: FlowMessagePayload{"reason": "idle Timeout", "src_ip": "2001:db8::10", "src_port": "5353", "dst_ip": "2001:db8:1::53", "session_id": "4410",
+					"bytes_from_server": "130", "elapsed": "60"},
+			},
+		},
+	},
+
+	"srx-session": {
+		Name:        "srx-session",
+		Description: "SRX flow session as one row: RT_FLOW_SESSION_CLOSE joined with srx-session-create rule by hostname and session id",
+		Table:       "srx_session",
+		Contains:    []string{"RT_FLOW_SESSION_CLOSE"},
+		Pattern:     presetSessionClosePattern,
+		Fields:      presetSessionFields(append(presetSessionCloseFields, presetSessionStart)...),
+		DDL:         presetSessionDDL,
+		Correlate:   &Correlation{Open: "srx-session-create", Key: []string{"hostname", "session_id"}},
+		Samples:     []PresetSample{presetSessionCloseSample},
+	},
+
+	"srx-session-create-sd": {
+		Name:        "srx-session-create-sd",
+		Description: "SRX flow session creation in structured-data format (RT_FLOW_SESSION_CREATE)",
+		Table:       "srx_session_create",
+		Contains:    []string{"RT_FLOW_SESSION_CREATE"},
+		Pattern:     `RT_FLOW_SESSION_CREATE(?:_LS)? \[junos@`,
+		Fields:      presetStructured(presetSessionFields()),
+		DDL: `CREATE TABLE IF NOT EXISTS {{.Table}} (` + presetSessionColumns + `
+) ENGINE = MergeTree()
+PARTITION BY toYYYYMMDD(timestamp)
+ORDER BY (nat_src_ip, nat_src_port, timestamp)`,
+		Samples: []PresetSample{
+			{
+				MsgID: "RT_FLOW_SESSION_CREATE",
+				StructuredData: `[junos@2636.1.1.1.2.26 source-address="10.0.0.2" source-port="50001" destination-address="93.184.216.34" destination-port="443" ` +
+					`connection-tag="0" service-name="junos-https" nat-source-address="203.0.113.1" nat-source-port="20001" nat-destination-address="93.184.216.34" ` +
+					`nat-destination-port="443" nat-connection-tag="0" src-nat-rule-type="source rule" src-nat-rule-name="snat-1" dst-nat-rule-type="N/A" ` +
+					`dst-nat-rule-name="N/A" protocol-id="6" policy-name="trust-to-untrust" source-zone-name="trust" destination-zone-name="untrust" ` +
+					`session-id-32="84210" username="N/A" roles="N/A" packet-incoming-interface="ge-0/0/1.0" application="UNKNOWN" nested-application="UNKNOWN" encrypted="UNKNOWN"]`,
+				Expect: FlowMessagePayload{"src_ip": "10.0.0.2", "src_port": "50001", "service": "junos-https", "nat_src_ip": "203.0.113.1", "nat_src_port": "20001",
+					"src_nat_rule": "snat-1", "protocol": "6", "policy": "trust-to-untrust", "session_id": "84210"},
+			},
+		},
+	},
+
+	"srx-session-close-sd": {
+		Name:        "srx-session-close-sd",
+		Description: "SRX flow session close in structured-data format (RT_FLOW_SESSION_CLOSE)",
+		Table:       "srx_session_close",
+		Contains:    []string{"RT_FLOW_SESSION_CLOSE"},
+		Pattern:     `RT_FLOW_SESSION_CLOSE(?:_LS)? \[junos@`,
+		Fields:      presetStructured(presetSessionFields(presetSessionCloseFields...)),
+		DDL: `CREATE TABLE IF NOT EXISTS {{.Table}} (` + presetSessionColumns + `,` + presetSessionCloseColumns + `
+) ENGINE = MergeTree()
+PARTITION BY toYYYYMMDD(timestamp)
+ORDER BY (nat_src_ip, nat_src_port, timestamp)`,
+		Samples: []PresetSample{presetSessionCloseSDSample},
+	},
+
+	"srx-session-sd": {
+		Name:        "srx-session-sd",
+		Description: "SRX flow session as one row in structured-data format, joined with srx-session-create-sd rule",
+		Table:       "srx_session",
+		Contains:    []string{"RT_FLOW_SESSION_CLOSE"},
+		Pattern:     `RT_FLOW_SESSION_CLOSE(?:_LS)? \[junos@`,
+		Fields:      append(presetStructured(presetSessionFields(presetSessionCloseFields...)), presetSessionStart),
+		DDL:         presetSessionDDL,
+		Correlate:   &Correlation{Open: "srx-session-create-sd", Key: []string{"hostname", "session_id"}},
+		Samples:     []PresetSample{presetSessionCloseSDSample},
+	},
+}
+
+var (
+	presetSessionClosePattern = `RT_FLOW_SESSION_CLOSE(?:_LS)?:\s+session closed %{DATA:reason}: ` + presetSessionTuple +
+		` %{INT:packets_from_client}\(%{INT:bytes_from_client}\) %{INT:packets_from_server}\(%{INT:bytes_from_server}\) %{INT:elapsed}`
+
+	presetSessionCloseFields = []map[string]interface{}{
+		{"name": "reason", "type": "string"},
+		{"name": "packets_from_client", "type": "uint64"},
+		{"name": "bytes_from_client", "type": "uint64"},
+		{"name": "packets_from_server", "type": "uint64"},
+		{"name": "bytes_from_server", "type": "uint64"},
+		{"name": "elapsed", "type": "uint32"},
+	}
+
+	presetSessionCloseColumns = `
+	reason              LowCardinality(String),
+	packets_from_client UInt64,
+	bytes_from_client   UInt64,
+	packets_from_server UInt64,
+	bytes_from_server   UInt64,
+	elapsed             UInt32`
+
+	// presetSessionStart - session creation time, close time when creation was not seen
+	presetSessionStart = map[string]interface{}{"name": "start_time", "type": "timestamp", "source": SourceCorrelate, "key": "timestamp", "fallback": "timestamp"}
+
+	presetSessionDDL = `CREATE TABLE IF NOT EXISTS {{.Table}} (` + presetSessionColumns + `,` + presetSessionCloseColumns + `,
+	start_time          DateTime
+) ENGINE = MergeTree()
+PARTITION BY toYYYYMMDD(timestamp)
+ORDER BY (nat_src_ip, nat_src_port, start_time)`
+
+	presetSessionCloseSample = PresetSample{
+		Line: `RT_FLOW_SESSION_CLOSE: session closed TCP FIN: 10.0.0.2/50001->93.184.216.34/443 0x0 junos-https 203.0.113.1/20001->93.184.216.34/443 0x0 source rule snat-1 N/A N/A 6 trust-to-untrust trust untrust 84210 12(1840) 10(9211) 31 UNKNOWN UNKNOWN N/A(N/A) ge-0/0/1.0 UNKNOWN N/A N/A -1 N/A NA 0 0.0.0.0/0->0.0.0.0/0 NA NA N/A N/A Off root N/A N/A`,
+		Expect: FlowMessagePayload{"reason": "TCP FIN", "src_ip": "10.0.0.2", "nat_src_ip": "203.0.113.1", "nat_src_port": "20001", "session_id": "84210",
+			"packets_from_client": "12", "bytes_from_client": "1840", "packets_from_server": "10", "bytes_from_server": "9211", "elapsed": "31"},
+	}
+
+	presetSessionCloseSDSample = PresetSample{
+		MsgID: "RT_FLOW_SESSION_CLOSE",
+		StructuredData: `[junos@2636.1.1.1.2.26 reason="TCP RST" source-address="10.0.0.2" source-port="50002" destination-address="93.184.216.34" destination-port="443" ` +
+			`connection-tag="0" service-name="junos-https" nat-source-address="203.0.113.1" nat-source-port="20002" nat-destination-address="93.184.216.34" ` +
+			`nat-destination-port="443" nat-connection-tag="0" src-nat-rule-type="source rule" src-nat-rule-name="snat-1" dst-nat-rule-type="N/A" ` +
+			`dst-nat-rule-name="N/A" protocol-id="6" policy-name="trust-to-untrust" source-zone-name="trust" destination-zone-name="untrust" ` +
+			`session-id-32="84211" packets-from-client="5" bytes-from-client="412" packets-from-server="4" bytes-from-server="1733" elapsed-time="2" ` +
+			`application="UNKNOWN" nested-application="UNKNOWN" username="N/A" roles="N/A" packet-incoming-interface="ge-0/0/1.0" encrypted="UNKNOWN"]`,
+		Expect: FlowMessagePayload{"reason": "TCP RST", "src_port": "50002", "nat_src_port": "20002", "session_id": "84211",
+			"packets_from_client": "5", "bytes_from_client": "412", "packets_from_server": "4", "bytes_from_server": "1733", "elapsed": "2"},
+	}
+
+	// presetSDParams - Junos structured data param names of the session fields
+	presetSDParams = map[string]string{
+		"src_ip":              "source-address",
+		"src_port":            "source-port",
+		"dst_ip":              "destination-address",
+		"dst_port":            "destination-port",
+		"service":             "service-name",
+		"nat_src_ip":          "nat-source-address",
+		"nat_src_port":        "nat-source-port",
+		"nat_dst_ip":          "nat-destination-address",
+		"nat_dst_port":        "nat-destination-port",
+		"src_nat_rule":        "src-nat-rule-name",
+		"dst_nat_rule":        "dst-nat-rule-name",
+		"protocol":            "protocol-id",
+		"policy":              "policy-name",
+		"src_zone":            "source-zone-name",
+		"dst_zone":            "destination-zone-name",
+		"session_id":          "session-id-32",
+		"reason":              "reason",
+		"packets_from_client": "packets-from-client",
+		"bytes_from_client":   "bytes-from-client",
+		"packets_from_server": "packets-from-server",
+		"bytes_from_server":   "bytes-from-server",
+		"elapsed":             "elapsed-time",
+	}
+)
+
+// presetStructured turns regexp captured fields into structured data params
+func presetStructured(fields []map[string]interface{}) []map[string]interface{} {
+	result := make([]map[string]interface{}, 0, len(fields))
+	for _, f := range fields {
+		param, ok := presetSDParams[f["name"].(string)]
+		if _, hasSource := f["source"]; hasSource || !ok {
+			result = append(result, f)
+			continue
+		}
+
+		sd := make(map[string]interface{}, len(f)+2)
+		for k, v := range f {
+			sd[k] = v
+		}
+		sd["source"] = SourceSD
+		sd["key"] = param
+		result = append(result, sd)
+	}
+	return result
+}
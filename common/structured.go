@@ -0,0 +1,49 @@
+package common
+
+import "strings"
+
+// ParseStructuredData parses RFC5424 structured data like `[junos@2636.1.1.1.2.26 source-address="10.0.0.1" ...]`
+// into flat param map, SD-IDs are dropped and later elements win on duplicate names
+func ParseStructuredData(sd string) map[string]string {
+	params := make(map[string]string)
+
+	for i := 0; i < len(sd); {
+		if sd[i] != '[' {
+			i++
+			continue
+		}
+
+		// skip SD-ID
+		for i < len(sd) && sd[i] != ' ' && sd[i] != ']' {
+			i++
+		}
+
+		for i < len(sd) && sd[i] != ']' {
+			for i < len(sd) && sd[i] == ' ' {
+				i++
+			}
+
+			eq := strings.IndexByte(sd[i:], '=')
+			if eq < 0 || i+eq+1 >= len(sd) || sd[i+eq+1] != '"' {
+				return params
+			}
+
+			name := sd[i : i+eq]
+			i += eq + 2
+
+			var value strings.Builder
+			for i < len(sd) && sd[i] != '"' {
+				if sd[i] == '\\' && i+1 < len(sd) {
+					i++
+				}
+				value.WriteByte(sd[i])
+				i++
+			}
+			i++ // closing quote
+
+			params[name] = value.String()
+		}
+	}
+
+	return params
+}
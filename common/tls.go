@@ -0,0 +1,52 @@
+package common
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+// TLSSettings - CA to verify server with, client certificate and key, all optional
+type TLSSettings struct {
+	CA                 string
+	Cert               string
+	Key                string
+	ServerName         string `mapstructure:"server_name"`
+	InsecureSkipVerify bool   `mapstructure:"insecure_skip_verify"`
+}
+
+// Config builds client TLS config, server name defaults to the given one
+func (s TLSSettings) Config(serverName string) (*tls.Config, error) {
+	result := &tls.Config{
+		ServerName:         s.ServerName,
+		InsecureSkipVerify: s.InsecureSkipVerify,
+	}
+
+	if result.ServerName == "" {
+		result.ServerName = serverName
+	}
+
+	if s.CA != "" {
+		pem, err := os.ReadFile(s.CA)
+		if err != nil {
+			return nil, err
+		}
+
+		result.RootCAs = x509.NewCertPool()
+		if !result.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.Newf("no certificates in %q", s.CA)
+		}
+	}
+
+	if s.Cert != "" || s.Key != "" {
+		cert, err := tls.LoadX509KeyPair(s.Cert, s.Key)
+		if err != nil {
+			return nil, err
+		}
+		result.Certificates = []tls.Certificate{cert}
+	}
+
+	return result, nil
+}
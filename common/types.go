@@ -1,6 +1,12 @@
 package common
 
-import "regexp"
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/errgo.v2/fmt/errors"
+)
 
 type (
 	Rules []Rule
@@ -8,7 +14,66 @@ type (
 		Name   string
 		Table  string
 		Regexp regexp.Regexp
-		Fields []map[string]interface{}
+		// Pattern - grok-style alternative to Regexp, see PatternLibrary
+		Pattern string
+		Fields  []map[string]interface{}
+
+		// Contains - literal prefilter, regexp runs only if message contains any of these strings
+		Contains []string
+		// Priority - rules with higher priority are matched first, equal priorities keep config order
+		Priority int
+		// Stop - do not try other rules after this one has matched
+		Stop bool
+		// Preset - name of the built-in rule, see Presets
+		Preset string
+		// DDL - optional `CREATE TABLE` template for the rule table
+		DDL string
+		// Correlate - join rows of the opening rule (e.g. session create) into rows of this one (e.g. session close)
+		Correlate *Correlation
+		// Dedup - drop rows with key fields seen within the window, e.g. sent twice by the router or redundant paths
+		Dedup *Deduplication
+		// NoInsert - rows are only used for correlation and never inserted
+		NoInsert bool `mapstructure:"no_insert"`
+		// Sinks - names of sinks to write rows to, all sinks if empty
+		Sinks []string
+		// Tenant - rows are written to the tenant database and sinks, and queried by the tenant only
+		Tenant string
+
+		// Sources are compiled from Fields on model registration
+		Sources  []FieldSource `mapstructure:"-"`
+		Captures int           `mapstructure:"-"`
+		// Named - regexp fields are mapped to named capture groups instead of positions
+		Named bool `mapstructure:"-"`
+	}
+
+	// FieldSource describes where the field value comes from: regexp capture, constant, syslog metadata or expression
+	FieldSource struct {
+		Name   string
+		Source string
+		Value  string
+		Layout string
+		Expr   Expression
+		// Group - regexp capture group index for SourceRegexp
+		Group int
+		// Fallback - value of SourceCorrelate field when there is no opening row
+		Fallback Expression
+	}
+
+	// Correlation - opening rule and fields identifying the same entity in both rules, MaxEntries bounds open rows
+	// of the opening rule, the oldest are dropped first
+	Correlation struct {
+		Open       string
+		Key        []string
+		Timeout    time.Duration
+		MaxEntries int `mapstructure:"max_entries"`
+	}
+
+	// Deduplication - fields identifying the same row and how long it is remembered, MaxEntries bounds
+	// remembered keys of the rule, the oldest are forgotten first
+	Deduplication struct {
+		Key        []string
+		Window     time.Duration
+		MaxEntries int `mapstructure:"max_entries"`
 	}
 
 	Field struct {
@@ -24,7 +89,9 @@ type (
 	Model struct {
 		Table     string
 		Statement string
-		Fields    []ConvertableField
+		// DDL - optional `CREATE TABLE` template, {{.Table}} is replaced with the table name
+		DDL    string
+		Fields []ConvertableField
 	}
 
 	ConvertableField interface {
@@ -38,6 +105,8 @@ type (
 
 	TimestampModelField struct {
 		Layout string
+		// Location of values without zone, UTC when nil
+		Location *time.Location
 		ModelField
 	}
 
@@ -58,8 +127,49 @@ type (
 	UInt16ModelField struct {
 		ModelField
 	}
+
+	UInt32ModelField struct {
+		ModelField
+	}
+
+	UInt64ModelField struct {
+		ModelField
+	}
+
+	// IpModelField - IPv4 or IPv6 address for IPv6 column
+	IpModelField struct {
+		ModelField
+	}
 )
 
+// Prefilter reports whether the regexp of the rule should be run against the content
+func (r *Rule) Prefilter(content string) bool {
+	if len(r.Contains) == 0 {
+		return true
+	}
+
+	for _, c := range r.Contains {
+		if strings.Contains(content, c) {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (f *ModelField) GetName() string {
 	return f.Name
 }
+
+// Convert row values in model fields order
+func (m *Model) Convert(row FlowMessagePayload) ([]interface{}, error) {
+	values := make([]interface{}, 0, len(m.Fields))
+	for _, field := range m.Fields {
+		val, err := field.Convert(row[field.GetName()])
+		if err != nil {
+			return nil, errors.Notef(err, nil, "field %q", field.GetName())
+		}
+		values = append(values, val)
+	}
+	return values, nil
+}
@@ -0,0 +1,159 @@
+package api
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/archaron/juniper-natlog/modules/sink"
+	"github.com/archaron/juniper-natlog/modules/tenant"
+	"github.com/labstack/echo/v4"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+// attributionSettings - `attribution` config section, rules with port block rows to look subscribers up in
+type attributionSettings struct {
+	Sink     string
+	Rules    []string
+	Lookback time.Duration
+	Fields   sink.AttributionFields
+	// Event - field with allocation or release event, rows with Release value mean the block was free
+	Event   string
+	Release string
+}
+
+func newAttributionSettings(v *viper.Viper) (*attributionSettings, error) {
+	v.SetDefault("attribution.lookback", 7*24*time.Hour)
+	v.SetDefault("attribution.fields.ip", "dst_ip")
+	v.SetDefault("attribution.fields.start_port", "start_port")
+	v.SetDefault("attribution.fields.end_port", "end_port")
+	v.SetDefault("attribution.fields.time", "timestamp")
+
+	cfg := &attributionSettings{
+		Sink:     v.GetString("attribution.sink"),
+		Rules:    v.GetStringSlice("attribution.rules"),
+		Lookback: v.GetDuration("attribution.lookback"),
+		Event:    v.GetString("attribution.event"),
+		Release:  v.GetString("attribution.release"),
+	}
+
+	if err := v.UnmarshalKey("attribution.fields", &cfg.Fields); err != nil {
+		return nil, errors.Notef(err, nil, "attribution.fields")
+	}
+
+	return cfg, nil
+}
+
+// attribution answers who used public address and port at the moment:
+// GET /attribution/?ip=203.0.113.1&port=1024&time=2020-01-02T15:04:05Z, time defaults to now.
+// Rows of devices routed apart from their rules are searched too, tenants search their own rows only.
+func attribution(cfg *attributionSettings, sinks *sink.Registry, tenants *tenant.Registry, log *zap.Logger) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		q := &sink.AttributionQuery{
+			IP:     ctx.QueryParam("ip"),
+			Port:   ctx.QueryParam("port"),
+			Time:   time.Now(),
+			Fields: cfg.Fields,
+		}
+
+		if net.ParseIP(q.IP) == nil {
+			return ctx.JSON(http.StatusBadRequest, map[string]interface{}{"status": "fail", "reason": "valid ip is required"})
+		}
+
+		if _, err := strconv.ParseUint(q.Port, 10, 16); err != nil {
+			return ctx.JSON(http.StatusBadRequest, map[string]interface{}{"status": "fail", "reason": "valid port is required"})
+		}
+
+		if t := ctx.QueryParam("time"); t != "" {
+			var err error
+			if q.Time, err = time.Parse(time.RFC3339, t); err != nil {
+				return ctx.JSON(http.StatusBadRequest, map[string]interface{}{"status": "fail", "reason": err.Error()})
+			}
+		}
+		q.From = q.Time.Add(-cfg.Lookback)
+
+		scope, _ := ctx.Get(tenantKey).(*tenant.Tenant)
+
+		// the latest row of all rules wins
+		var (
+			found  string
+			result map[string]interface{}
+		)
+		for _, rule := range cfg.Rules {
+			routes := tenants.Routes(rule)
+			if len(routes) == 0 {
+				routes = []tenant.Route{{Name: rule}}
+			}
+
+			for _, route := range routes {
+				if scope != nil && route.Tenant != scope.Name {
+					continue
+				}
+
+				querier, err := routeQuerier(sinks, cfg.Sink, route)
+				if err != nil {
+					return ctx.JSON(http.StatusInternalServerError, map[string]interface{}{"status": "fail", "reason": err.Error()})
+				}
+
+				if querier == nil {
+					continue
+				}
+
+				row, err := querier.Attribute(ctx.Request().Context(), route.Name, q)
+				if err != nil {
+					log.Error("attribution query failed", zap.String("rule", route.Name), zap.Error(err))
+					return ctx.JSON(http.StatusInternalServerError, map[string]interface{}{"status": "fail", "reason": err.Error()})
+				}
+
+				if row == nil {
+					continue
+				}
+
+				if result != nil {
+					last, _ := result[cfg.Fields.Time].(time.Time)
+					if t, _ := row[cfg.Fields.Time].(time.Time); !t.After(last) {
+						continue
+					}
+				}
+
+				found, result = route.Name, row
+			}
+		}
+
+		if result == nil {
+			return ctx.JSON(http.StatusNotFound, map[string]interface{}{"status": "not found"})
+		}
+
+		if cfg.Event != "" && fmt.Sprint(result[cfg.Event]) == cfg.Release {
+			return ctx.JSON(http.StatusNotFound, map[string]interface{}{"status": "not found", "reason": "port block released", "rule": found, "row": result})
+		}
+
+		return ctx.JSON(http.StatusOK, map[string]interface{}{"status": "ok", "rule": found, "row": result})
+	}
+}
+
+// routeQuerier - the attribution sink when route rows are written to it, otherwise the first sink of the route
+// answering queries, nil when there is none
+func routeQuerier(sinks *sink.Registry, name string, route tenant.Route) (sink.Querier, error) {
+	if len(route.Sinks) == 0 {
+		return sinks.Querier(name)
+	}
+
+	for _, s := range route.Sinks {
+		if name == "" || s == name {
+			if q, err := sinks.Querier(s); err == nil {
+				return q, nil
+			}
+		}
+	}
+
+	if name == "" {
+		return nil, nil
+	}
+
+	return routeQuerier(sinks, "", route)
+}
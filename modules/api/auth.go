@@ -0,0 +1,41 @@
+package api
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/archaron/juniper-natlog/modules/tenant"
+	"github.com/labstack/echo/v4"
+)
+
+// tenantKey - context key of the tenant of the request, nil for operator requests
+const tenantKey = "tenant"
+
+// authorize requests by bearer token when operator `api.tokens` or tenants are configured: operator tokens
+// query rows of all tenants, tenant tokens rows of their tenant only
+func authorize(operators []string, tenants *tenant.Registry) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			if len(operators) == 0 && !tenants.Enabled() {
+				return next(ctx)
+			}
+
+			token := strings.TrimPrefix(ctx.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+			if token != "" {
+				for _, known := range operators {
+					if subtle.ConstantTimeCompare([]byte(known), []byte(token)) == 1 {
+						return next(ctx)
+					}
+				}
+
+				if t, ok := tenants.Authenticate(token); ok {
+					ctx.Set(tenantKey, t)
+					return next(ctx)
+				}
+			}
+
+			return ctx.JSON(http.StatusUnauthorized, map[string]interface{}{"status": "fail", "reason": "valid token is required"})
+		}
+	}
+}
@@ -3,7 +3,8 @@ package api
 import (
 	"net/http"
 
-	"github.com/archaron/juniper-natlog/modules/clickhouse"
+	"github.com/archaron/juniper-natlog/modules/sink"
+	"github.com/archaron/juniper-natlog/modules/tenant"
 	"github.com/im-kulikov/helium/module"
 	"github.com/im-kulikov/helium/settings"
 	"github.com/labstack/echo/v4"
@@ -21,7 +22,8 @@ type (
 		Logger  *zap.Logger
 		Config  *viper.Viper
 		Setting *settings.Core
-		Clickhouse *clickhouse.Service
+		Sinks   *sink.Registry
+		Tenants *tenant.Registry
 	}
 )
 
@@ -30,7 +32,7 @@ var Module = module.Module{
 	{Constructor: newRouter},
 }
 
-func newRouter(r Router) http.Handler {
+func newRouter(r Router) (http.Handler, error) {
 
 	e := r.Engine
 	e.Pre(middleware.AddTrailingSlash())
@@ -56,12 +58,38 @@ func newRouter(r Router) http.Handler {
 
 	e.GET("/readiness/", func(ctx echo.Context) error {
 
-		if err := r.Clickhouse.Ping(); err != nil {
-			return ctx.JSON(http.StatusInternalServerError, map[string]interface{}{"status": "fail", "reason": "clickhouse server ping fail", "error": err.Error()})
+		failed := make(map[string]string)
+		for name, err := range r.Sinks.Health() {
+			if err != nil {
+				failed[name] = err.Error()
+			}
 		}
 
-		return ctx.JSON(http.StatusOK, map[string]interface{}{"status": "ok"})
+		circuits := r.Sinks.Circuits()
+		for name, state := range circuits {
+			if state == sink.CircuitOpen {
+				if _, ok := failed[name]; !ok {
+					failed[name] = "circuit breaker open"
+				}
+			}
+		}
+
+		if len(failed) > 0 {
+			return ctx.JSON(http.StatusInternalServerError, map[string]interface{}{"status": "fail", "reason": "sink health check fail", "sinks": failed, "circuits": circuits})
+		}
+
+		return ctx.JSON(http.StatusOK, map[string]interface{}{"status": "ok", "circuits": circuits})
 	})
 
-	return e
+	attributionCfg, err := newAttributionSettings(r.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(attributionCfg.Rules) > 0 {
+		e.GET("/attribution/", attribution(attributionCfg, r.Sinks, r.Tenants, r.Logger),
+			authorize(r.Config.GetStringSlice("api.tokens"), r.Tenants))
+	}
+
+	return e, nil
 }
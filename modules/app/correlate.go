@@ -0,0 +1,234 @@
+package app
+
+import (
+	"strings"
+	"time"
+
+	"github.com/archaron/juniper-natlog/common"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+const (
+	defaultCorrelationTimeout    = 30 * time.Minute
+	defaultCorrelationMaxEntries = 100000
+)
+
+type (
+	// correlator keeps rows of opening rules until the closing rule row with the same key arrives
+	correlator struct {
+		opens map[string]*correlation
+		joins map[string]joinFunc
+
+		lastSweep time.Time
+	}
+
+	// correlation - open rows of the opening rule, order holds their keys in order of arrival, expired and excess
+	// rows are removed from the front. Entries of rows joined or remembered again since are skipped.
+	correlation struct {
+		key     []string
+		timeout time.Duration
+		max     int
+
+		rows  map[string]openRow
+		order []openEntry
+		head  int
+		seq   uint64
+
+		evicted prometheus.Counter
+		expired prometheus.Counter
+	}
+
+	openRow struct {
+		fields common.FlowMessagePayload
+		seq    uint64
+	}
+
+	openEntry struct {
+		key  string
+		seen time.Time
+		seq  uint64
+	}
+)
+
+func newCorrelator(rules common.Rules) (*correlator, error) {
+	c := &correlator{
+		opens:     make(map[string]*correlation),
+		joins:     make(map[string]joinFunc),
+		lastSweep: time.Now(),
+	}
+
+	fields := make(map[string]map[string]bool, len(rules))
+	for i := range rules {
+		fields[rules[i].Name] = make(map[string]bool, len(rules[i].Fields))
+		for _, f := range rules[i].Fields {
+			if name, ok := f["name"].(string); ok {
+				fields[rules[i].Name][name] = true
+			}
+		}
+	}
+
+	for i := range rules {
+		r := &rules[i]
+		if r.Correlate == nil {
+			continue
+		}
+
+		if _, ok := fields[r.Correlate.Open]; !ok {
+			return nil, errors.Newf("rule %q: unknown opening rule %q", r.Name, r.Correlate.Open)
+		}
+
+		if len(r.Correlate.Key) == 0 {
+			return nil, errors.Newf("rule %q: correlation key is empty", r.Name)
+		}
+
+		for _, k := range r.Correlate.Key {
+			if !fields[r.Name][k] || !fields[r.Correlate.Open][k] {
+				return nil, errors.Newf("rule %q: correlation key field %q must be defined in both rules", r.Name, k)
+			}
+		}
+
+		if _, ok := c.opens[r.Correlate.Open]; ok {
+			return nil, errors.Newf("rule %q: opening rule %q is already correlated with another rule", r.Name, r.Correlate.Open)
+		}
+
+		if r.Correlate.MaxEntries < 0 {
+			return nil, errors.Newf("rule %q: correlation max_entries must not be negative", r.Name)
+		}
+
+		open := &correlation{
+			key:     r.Correlate.Key,
+			timeout: r.Correlate.Timeout,
+			max:     r.Correlate.MaxEntries,
+			rows:    make(map[string]openRow),
+			evicted: correlationEvicted.WithLabelValues(r.Correlate.Open),
+			expired: correlationExpired.WithLabelValues(r.Correlate.Open),
+		}
+
+		if open.timeout <= 0 {
+			open.timeout = defaultCorrelationTimeout
+		}
+
+		if open.max == 0 {
+			open.max = defaultCorrelationMaxEntries
+		}
+
+		c.opens[r.Correlate.Open] = open
+
+		counters := newCorrelationCounters(r.Name)
+		c.joins[r.Name] = func(row common.FlowMessagePayload) common.FlowMessagePayload {
+			key := rowKey(open.key, row)
+			found, ok := open.rows[key]
+			if !ok {
+				counters.unmatched.Inc()
+				return nil
+			}
+
+			delete(open.rows, key)
+			open.compact()
+			counters.joined.Inc()
+			return found.fields
+		}
+	}
+
+	return c, nil
+}
+
+func rowKey(key []string, row common.FlowMessagePayload) string {
+	var buf strings.Builder
+	for _, k := range key {
+		buf.WriteString(row[k])
+		buf.WriteByte(0)
+	}
+	return buf.String()
+}
+
+// join returns function looking up opening row for the closing rule, nil if rule is not correlated
+func (c *correlator) join(rule *common.Rule) joinFunc {
+	return c.joins[rule.Name]
+}
+
+// remember keeps row if it belongs to an opening rule, the oldest row of the rule is dropped when it has max entries.
+// Rows must come in order of receiving.
+func (c *correlator) remember(msg *common.FlowMessage, now time.Time) {
+	open, ok := c.opens[msg.Rule]
+	if !ok {
+		return
+	}
+
+	key := rowKey(open.key, msg.Fields)
+	if _, ok = open.rows[key]; !ok && len(open.rows) >= open.max {
+		open.evict()
+	}
+
+	open.seq++
+	open.rows[key] = openRow{fields: msg.Fields, seq: open.seq}
+	open.order = append(open.order, openEntry{key: key, seen: now, seq: open.seq})
+	open.compact()
+}
+
+// sweep drops opening rows never closed within correlation timeout, runs at most once a minute
+func (c *correlator) sweep(now time.Time) {
+	if now.Sub(c.lastSweep) < time.Minute {
+		return
+	}
+	c.lastSweep = now
+
+	for _, open := range c.opens {
+		for open.head < len(open.order) && now.Sub(open.order[open.head].seen) > open.timeout {
+			if open.pop() {
+				open.expired.Inc()
+			}
+		}
+	}
+}
+
+// evict drops the oldest open row
+func (o *correlation) evict() {
+	for o.head < len(o.order) {
+		if o.pop() {
+			o.evicted.Inc()
+			return
+		}
+	}
+}
+
+// pop removes the oldest entry of the order, reports whether its row was still open and is dropped
+func (o *correlation) pop() bool {
+	entry := o.order[o.head]
+	o.order[o.head] = openEntry{}
+	o.head++
+
+	row, ok := o.rows[entry.key]
+	open := ok && row.seq == entry.seq
+	if open {
+		delete(o.rows, entry.key)
+	}
+
+	if o.head == len(o.order) {
+		o.order, o.head = o.order[:0], 0
+	}
+	return open
+}
+
+// compact removes popped entries once they are half of the order, and entries of joined and replaced rows once
+// they outnumber open rows
+func (o *correlation) compact() {
+	stale := len(o.order) - o.head - len(o.rows)
+	if o.head*2 <= len(o.order) && stale <= len(o.rows)+16 {
+		return
+	}
+
+	n := 0
+	for _, entry := range o.order[o.head:] {
+		if row, ok := o.rows[entry.key]; ok && row.seq == entry.seq {
+			o.order[n] = entry
+			n++
+		}
+	}
+
+	for i := n; i < len(o.order); i++ {
+		o.order[i] = openEntry{}
+	}
+	o.order, o.head = o.order[:n], 0
+}
@@ -0,0 +1,157 @@
+package app
+
+import (
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/archaron/juniper-natlog/common"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+const (
+	defaultDedupWindow     = 10 * time.Second
+	defaultDedupMaxEntries = 100000
+)
+
+type (
+	// deduplicator drops rows of rules with the same key fields seen within the rule window
+	deduplicator struct {
+		windows map[string]*dedupWindow
+	}
+
+	// dedupWindow - keys of the rule in order of arrival, expired and excess keys are removed from the front
+	dedupWindow struct {
+		key    []string
+		window time.Duration
+		max    int
+
+		keys  map[string]struct{}
+		order []dedupEntry
+		head  int
+
+		counters dedupCounters
+	}
+
+	dedupEntry struct {
+		key  string
+		seen time.Time
+	}
+)
+
+func newDeduplicator(rules common.Rules) (*deduplicator, error) {
+	d := &deduplicator{windows: make(map[string]*dedupWindow)}
+
+	for i := range rules {
+		r := &rules[i]
+		if r.Dedup == nil {
+			continue
+		}
+
+		if len(r.Dedup.Key) == 0 {
+			return nil, errors.Newf("rule %q: dedup key is empty", r.Name)
+		}
+
+		fields := make(map[string]bool, len(r.Fields))
+		for _, f := range r.Fields {
+			if name, ok := f["name"].(string); ok {
+				fields[name] = true
+			}
+		}
+
+		for _, k := range r.Dedup.Key {
+			if !fields[k] {
+				return nil, errors.Newf("rule %q: dedup key field %q is not defined", r.Name, k)
+			}
+		}
+
+		if r.Dedup.Window < 0 || r.Dedup.MaxEntries < 0 {
+			return nil, errors.Newf("rule %q: dedup window and max_entries must not be negative", r.Name)
+		}
+
+		w := &dedupWindow{
+			key:      r.Dedup.Key,
+			window:   r.Dedup.Window,
+			max:      r.Dedup.MaxEntries,
+			keys:     make(map[string]struct{}),
+			counters: newDedupCounters(r.Name),
+		}
+
+		if w.window == 0 {
+			w.window = defaultDedupWindow
+		}
+
+		if w.max == 0 {
+			w.max = defaultDedupMaxEntries
+		}
+
+		d.windows[r.Name] = w
+	}
+
+	return d, nil
+}
+
+// duplicate reports whether the row key was seen within the window, the key is remembered otherwise.
+// Rows must come in order of receiving.
+func (d *deduplicator) duplicate(msg *common.FlowMessage, now time.Time) bool {
+	w, ok := d.windows[msg.Rule]
+	if !ok {
+		return false
+	}
+
+	for w.head < len(w.order) && now.Sub(w.order[w.head].seen) >= w.window {
+		w.pop()
+	}
+
+	key := dedupKey(w.key, msg.Fields)
+
+	if _, ok := w.keys[key]; ok {
+		w.counters.suppressed.Inc()
+		return true
+	}
+
+	if len(w.order)-w.head >= w.max {
+		w.pop()
+		w.counters.evicted.Inc()
+	}
+
+	w.keys[key] = struct{}{}
+	w.order = append(w.order, dedupEntry{key: key, seen: now})
+	w.counters.keys.Set(float64(len(w.keys)))
+
+	return false
+}
+
+func dedupKey(key []string, fields common.FlowMessagePayload) string {
+	var buf strings.Builder
+	for _, k := range key {
+		buf.WriteString(fields[k])
+		buf.WriteByte(0)
+	}
+	return buf.String()
+}
+
+// dedupHash - FNV-1a of the row key as decimal UInt64, for tables collapsing rows of all instances by it
+func dedupHash(key []string, fields common.FlowMessagePayload) string {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(dedupKey(key, fields)))
+	return strconv.FormatUint(h.Sum64(), 10)
+}
+
+// pop forgets the oldest key, the order slice is compacted once half of it is removed
+func (w *dedupWindow) pop() {
+	delete(w.keys, w.order[w.head].key)
+	w.order[w.head] = dedupEntry{}
+	w.head++
+
+	switch {
+	case w.head == len(w.order):
+		w.order, w.head = w.order[:0], 0
+	case w.head >= len(w.order)/2:
+		n := copy(w.order, w.order[w.head:])
+		w.order, w.head = w.order[:n], 0
+	}
+
+	w.counters.keys.Set(float64(len(w.keys)))
+}
@@ -0,0 +1,184 @@
+package app
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/archaron/juniper-natlog/common"
+	"github.com/archaron/juniper-natlog/modules/sink"
+	"github.com/archaron/juniper-natlog/modules/tenant"
+	"github.com/spf13/viper"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+type (
+	// deviceSettings - `syslog.devices.<sender IP or hostname>` section
+	deviceSettings struct {
+		// Timezone of timestamps without zone, e.g. RFC3164 header and captured timestamps
+		Timezone string
+		// Rules - names of rules tried for messages of the device, all rules when empty
+		Rules []string
+		// Tags - constant row fields, rules must define fields of the same names to store them
+		Tags map[string]string
+		// Table and Database override rule table, rows are written under route `<rule>.<device>`
+		Table    string
+		Database string
+		// Tenant of the device rows, its database and sinks are used unless set for the device
+		Tenant string
+	}
+
+	// device - settings of the sender, rows of routed devices are registered in sinks under their own names
+	device struct {
+		name     string
+		location *time.Location
+		rules    map[string]bool
+		tags     map[string]string
+		table    string
+		database string
+		tenant   string
+		// sinks of the tenant, sinks of rules when nil
+		sinks []sink.Sink
+	}
+)
+
+// newDevices reads `syslog.devices`, keys are sender addresses or hostnames in lower case
+func newDevices(v *viper.Viper, rules common.Rules, tenants *tenant.Registry, sinks *sink.Registry) (map[string]*device, error) {
+	var cfg map[string]deviceSettings
+	if err := v.UnmarshalKey("syslog.devices", &cfg); err != nil {
+		return nil, errors.Notef(err, nil, "syslog devices")
+	}
+
+	known := make(map[string]bool, len(rules))
+	for i := range rules {
+		known[rules[i].Name] = true
+	}
+
+	devices := make(map[string]*device, len(cfg))
+	for name, c := range cfg {
+		d := &device{
+			name:     name,
+			tags:     c.Tags,
+			table:    c.Table,
+			database: c.Database,
+			tenant:   c.Tenant,
+		}
+
+		if d.tenant != "" {
+			t, ok := tenants.Get(d.tenant)
+			if !ok {
+				return nil, errors.Newf("device %q: unknown tenant %q", name, d.tenant)
+			}
+
+			if d.database == "" {
+				d.database = t.Database
+			}
+
+			if len(t.Sinks) > 0 {
+				route, err := sinks.Route(t.Sinks)
+				if err != nil {
+					return nil, errors.Notef(err, nil, "device %q: tenant %q", name, d.tenant)
+				}
+				d.sinks = route
+			}
+		}
+
+		if c.Timezone != "" {
+			location, err := time.LoadLocation(c.Timezone)
+			if err != nil {
+				return nil, errors.Notef(err, nil, "device %q: timezone", name)
+			}
+			d.location = location
+		}
+
+		if len(c.Rules) > 0 {
+			d.rules = make(map[string]bool, len(c.Rules))
+			for _, rule := range c.Rules {
+				if !known[rule] {
+					return nil, errors.Newf("device %q: unknown rule %q", name, rule)
+				}
+				d.rules[rule] = true
+			}
+		}
+
+		devices[strings.ToLower(name)] = d
+	}
+
+	return devices, nil
+}
+
+// lookupDevice by sender address of the client `ip:port`, then by message hostname
+func lookupDevice(devices map[string]*device, client, hostname string) *device {
+	if len(devices) == 0 {
+		return nil
+	}
+
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		if d, ok := devices[host]; ok {
+			return d
+		}
+	}
+
+	return devices[strings.ToLower(hostname)]
+}
+
+// enabled reports whether the rule is tried for messages of the device
+func (d *device) enabled(rule string) bool {
+	return d == nil || d.rules == nil || d.rules[rule]
+}
+
+// routed reports whether rows of the device are written with their own models
+func (d *device) routed() bool {
+	return d != nil && (d.location != nil || d.table != "" || d.database != "" || d.tenant != "")
+}
+
+// route - name of rule models of the device in sinks
+func (d *device) route(rule string) string {
+	return rule + "." + d.name
+}
+
+// zone timestamps of the device are parsed in
+func (d *device) zone() *time.Location {
+	if d == nil || d.location == nil {
+		return time.UTC
+	}
+	return d.location
+}
+
+// tag sets constant fields of the device
+func (d *device) tag(msg *common.FlowMessage) {
+	if d == nil {
+		return
+	}
+
+	for k, v := range d.tags {
+		msg.Fields[k] = v
+	}
+}
+
+// model of the rule for the device: table is overridden and timestamps are parsed in device timezone,
+// meta times are formatted in it by buildMessage
+func (d *device) model(model common.Model) common.Model {
+	if d.table != "" {
+		model.Table = d.table
+	}
+
+	model.Table = tenant.Qualify(d.database, model.Table)
+
+	if d.location == nil {
+		return model
+	}
+
+	fields := make([]common.ConvertableField, len(model.Fields))
+	for i, f := range model.Fields {
+		if ts, ok := f.(*common.TimestampModelField); ok {
+			local := *ts
+			local.Location = d.location
+			f = &local
+		}
+		fields[i] = f
+	}
+	model.Fields = fields
+
+	return model
+}
@@ -0,0 +1,354 @@
+package app
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/archaron/juniper-natlog/common"
+	"gopkg.in/errgo.v2/fmt/errors"
+	"gopkg.in/mcuadros/go-syslog.v2/format"
+)
+
+const (
+	defaultLayout = "2006-01-02 15:04:05"
+
+	structuredParamsKey = "structured_params"
+)
+
+// fieldLayout returns time layout of the field definition, `default` is kept for older configs
+func fieldLayout(f map[string]interface{}) (string, bool) {
+	if layout, ok := f["layout"].(string); ok {
+		return layout, true
+	}
+
+	if layout, ok := f["default"].(string); ok {
+		return layout, true
+	}
+
+	return defaultLayout, false
+}
+
+// newFieldSource compiles `source` part of the rule field definition
+func newFieldSource(name string, f map[string]interface{}) (common.FieldSource, error) {
+	src := common.FieldSource{
+		Name:   name,
+		Source: common.SourceRegexp,
+	}
+
+	if v, ok := f["source"]; ok {
+		if src.Source, ok = v.(string); !ok {
+			return src, errors.New("field source must be a string")
+		}
+	}
+
+	switch src.Source {
+	case common.SourceRegexp:
+	case common.SourceConst:
+		v, ok := f["value"]
+		if !ok {
+			return src, errors.New("const field must contain 'value'")
+		}
+		src.Value = fmt.Sprint(v)
+	case common.SourceMeta:
+		key, ok := f["key"].(string)
+		if !ok {
+			return src, errors.New("meta field must contain 'key'")
+		}
+		if !common.MetaKeys[key] {
+			return src, errors.Newf("unknown meta key %q", key)
+		}
+		src.Value = key
+		src.Layout, _ = fieldLayout(f)
+	case common.SourceSD:
+		key, ok := f["key"].(string)
+		if !ok {
+			return src, errors.New("sd field must contain 'key'")
+		}
+		src.Value = key
+	case common.SourceCorrelate:
+		key, ok := f["key"].(string)
+		if !ok {
+			return src, errors.New("correlate field must contain 'key'")
+		}
+		src.Value = key
+
+		fallback, ok := f["fallback"].(string)
+		if !ok {
+			return src, errors.New("correlate field must contain 'fallback' expression")
+		}
+		e, err := common.ParseExpression(fallback)
+		if err != nil {
+			return src, errors.Notef(err, nil, "cannot parse fallback expression %q", fallback)
+		}
+		src.Fallback = e
+	case common.SourceSubscriber:
+		key, ok := f["key"].(string)
+		if !ok {
+			return src, errors.New("subscriber field must contain 'key' of the address field")
+		}
+		src.Value = key
+	case common.SourceDedup:
+	case common.SourceExpr:
+		expr, ok := f["expr"].(string)
+		if !ok {
+			return src, errors.New("expr field must contain 'expr'")
+		}
+		e, err := common.ParseExpression(expr)
+		if err != nil {
+			return src, errors.Notef(err, nil, "cannot parse expression %q", expr)
+		}
+		src.Value = expr
+		src.Expr = e
+	default:
+		return src, errors.Newf("unknown field source %q", src.Source)
+	}
+
+	return src, nil
+}
+
+// compileSources of the rule fields, regexp fields are mapped to capture groups by position,
+// or by name when the regexp has named groups
+func compileSources(r *common.Rule) error {
+	r.Sources = make([]common.FieldSource, 0, len(r.Fields))
+	r.Captures = 0
+
+	groups := make(map[string]int)
+	for g, name := range r.Regexp.SubexpNames() {
+		if name != "" {
+			groups[name] = g
+		}
+	}
+	r.Named = len(groups) > 0
+
+	for i, f := range r.Fields {
+		name, ok := f["name"].(string)
+		if !ok {
+			return errors.Newf("field %d: name is not specified or is not a string", i)
+		}
+
+		source, err := newFieldSource(name, f)
+		if err != nil {
+			return errors.Notef(err, nil, "field %q", name)
+		}
+
+		if source.Source == common.SourceDedup && r.Dedup == nil {
+			return errors.Newf("field %q: dedup field of rule without dedup key", name)
+		}
+
+		if source.Source == common.SourceRegexp {
+			r.Captures++
+			source.Group = r.Captures
+
+			if r.Named {
+				if source.Group, ok = groups[name]; !ok {
+					return errors.Newf("field %q: regexp has no capture group for the field", name)
+				}
+			}
+		}
+		r.Sources = append(r.Sources, source)
+	}
+
+	return checkReferences(r)
+}
+
+// checkReferences of expressions to fields filled before them by buildMessage: fallbacks may refer to regexp,
+// const, meta and sd fields and correlate fields above, expressions to any field but dedup hashes and expressions
+// below
+func checkReferences(r *common.Rule) error {
+	filled := make(map[string]bool, len(r.Sources))
+	for _, src := range r.Sources {
+		switch src.Source {
+		case common.SourceRegexp, common.SourceConst, common.SourceMeta, common.SourceSD:
+			filled[src.Name] = true
+		}
+	}
+
+	for _, src := range r.Sources {
+		if src.Source != common.SourceCorrelate {
+			continue
+		}
+
+		for _, name := range common.ExpressionFields(src.Fallback) {
+			if !filled[name] {
+				return errors.Newf("field %q: fallback refers to %q, which is not a field filled before it", src.Name, name)
+			}
+		}
+		filled[src.Name] = true
+	}
+
+	for _, src := range r.Sources {
+		if src.Source == common.SourceSubscriber {
+			filled[src.Name] = true
+		}
+	}
+
+	for _, src := range r.Sources {
+		if src.Source != common.SourceExpr {
+			continue
+		}
+
+		for _, name := range common.ExpressionFields(src.Expr) {
+			if !filled[name] {
+				return errors.Newf("field %q: expression refers to %q, which is not a field filled before it", src.Name, name)
+			}
+		}
+		filled[src.Name] = true
+	}
+
+	return nil
+}
+
+type (
+	// joinFunc returns opening row correlated with the given one, or nil
+	joinFunc func(row common.FlowMessagePayload) common.FlowMessagePayload
+
+	// lookupFunc returns subscriber who had the address at the time, or empty string
+	lookupFunc func(ip string, at time.Time) string
+)
+
+// buildMessage fills message fields from regexp match, constants, metadata and structured data first,
+// then fields of the correlated opening row, then subscribers of address fields, then expressions in definition order,
+// so expression may refer to any non-expression field or to expressions defined above it. Dedup hashes come last.
+// Meta times are formatted in zone, the zone timestamps of the device are parsed in.
+func buildMessage(rule *common.Rule, match []string, parts format.LogParts, received time.Time, zone *time.Location, join joinFunc, lookup lookupFunc) (*common.FlowMessage, error) {
+	msg := &common.FlowMessage{
+		Rule:   rule.Name,
+		Fields: make(common.FlowMessagePayload, len(rule.Sources)),
+	}
+
+	for _, src := range rule.Sources {
+		switch src.Source {
+		case common.SourceRegexp:
+			msg.Fields[src.Name] = match[src.Group]
+		case common.SourceConst:
+			msg.Fields[src.Name] = src.Value
+		case common.SourceMeta:
+			msg.Fields[src.Name] = metaValue(src, rule, parts, received, zone)
+		case common.SourceSD:
+			msg.Fields[src.Name] = structuredParams(parts)[src.Value]
+		}
+	}
+
+	if rule.Correlate != nil {
+		var open common.FlowMessagePayload
+		if join != nil {
+			open = join(msg.Fields)
+		}
+
+		for _, src := range rule.Sources {
+			if src.Source != common.SourceCorrelate {
+				continue
+			}
+
+			if v, ok := open[src.Value]; ok {
+				msg.Fields[src.Name] = v
+				continue
+			}
+
+			v, err := src.Fallback.Eval(msg.Fields)
+			if err != nil {
+				return nil, errors.Notef(err, nil, "field %q fallback", src.Name)
+			}
+			msg.Fields[src.Name] = v
+		}
+	}
+
+	for _, src := range rule.Sources {
+		if src.Source != common.SourceSubscriber {
+			continue
+		}
+
+		var subscriber string
+		if ip := msg.Fields[src.Value]; ip != "" && lookup != nil {
+			subscriber = lookup(ip, received)
+		}
+		msg.Fields[src.Name] = subscriber
+	}
+
+	for _, src := range rule.Sources {
+		if src.Source != common.SourceExpr {
+			continue
+		}
+
+		v, err := src.Expr.Eval(msg.Fields)
+		if err != nil {
+			return nil, errors.Notef(err, nil, "field %q", src.Name)
+		}
+		msg.Fields[src.Name] = v
+	}
+
+	for _, src := range rule.Sources {
+		if src.Source == common.SourceDedup {
+			msg.Fields[src.Name] = dedupHash(rule.Dedup.Key, msg.Fields)
+		}
+	}
+
+	return msg, nil
+}
+
+// structuredParams parses structured data of the message once and keeps result in log parts
+func structuredParams(parts format.LogParts) map[string]string {
+	if params, ok := parts[structuredParamsKey].(map[string]string); ok {
+		return params
+	}
+
+	sd, _ := parts["structured_data"].(string)
+	params := common.ParseStructuredData(sd)
+	parts[structuredParamsKey] = params
+
+	return params
+}
+
+// messageText returns text to match rules against: content of RFC3164 message, or RFC5424 message prefixed
+// with MSGID and structured data, like `RT_FLOW_SESSION_CREATE [junos@2636.1.1.1.2.26 ...]: session created ...`
+func messageText(parts format.LogParts) (string, bool) {
+	if content, ok := parts["content"].(string); ok {
+		return content, true
+	}
+
+	message, ok := parts["message"].(string)
+	if !ok {
+		return "", false
+	}
+
+	var prefix []string
+	if msgID, _ := parts["msg_id"].(string); msgID != "" && msgID != "-" {
+		prefix = append(prefix, msgID)
+	}
+
+	if sd, _ := parts["structured_data"].(string); sd != "" && sd != "-" {
+		prefix = append(prefix, sd)
+	}
+
+	if len(prefix) == 0 {
+		return message, true
+	}
+
+	return strings.Join(prefix, " ") + ": " + message, true
+}
+
+// metaValue formats times in zone, so they keep their instant when parsed in it. RFC3164 header timestamp has no zone
+// and is parsed as UTC, its wall clock is kept to be parsed in the device zone.
+func metaValue(src common.FieldSource, rule *common.Rule, parts format.LogParts, received time.Time, zone *time.Location) string {
+	switch src.Value {
+	case common.MetaReceived:
+		return received.In(zone).Format(src.Layout)
+	case common.MetaRule:
+		return rule.Name
+	}
+
+	switch v := parts[src.Value].(type) {
+	case nil:
+		return ""
+	case time.Time:
+		if _, rfc3164 := parts["content"]; rfc3164 {
+			return v.UTC().Format(src.Layout)
+		}
+		return v.In(zone).Format(src.Layout)
+	case string:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,45 @@
+package app
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/archaron/juniper-natlog/common"
+)
+
+func TestCompileSourcesChecksReferences(t *testing.T) {
+	regexpField := map[string]interface{}{"name": "start_port"}
+	constField := map[string]interface{}{"name": "site", "source": "const", "value": "msk-1"}
+	expr := func(name, src string) map[string]interface{} {
+		return map[string]interface{}{"name": name, "source": "expr", "expr": src}
+	}
+
+	for _, c := range []struct {
+		name   string
+		fields []map[string]interface{}
+		dedup  bool
+		valid  bool
+	}{
+		{"fields defined below", []map[string]interface{}{expr("key", `concat(site, start_port)`), regexpField, constField}, false, true},
+		{"expression above", []map[string]interface{}{regexpField, expr("next", "start_port + 1"), expr("last", "next + 1")}, false, true},
+		{"expression below", []map[string]interface{}{regexpField, expr("last", "next + 1"), expr("next", "start_port + 1")}, false, false},
+		{"itself", []map[string]interface{}{regexpField, expr("next", "next + 1")}, false, false},
+		{"unknown field", []map[string]interface{}{regexpField, expr("key", `concat(site, start_port)`)}, false, false},
+		{"dedup hash", []map[string]interface{}{regexpField, {"name": "hash", "source": "dedup"}, expr("key", "hash")}, true, false},
+		{"subscriber", []map[string]interface{}{regexpField, {"name": "user", "source": "subscriber", "key": "start_port"},
+			expr("key", "lower(user)")}, false, true},
+		{"fallback", []map[string]interface{}{regexpField, {"name": "start", "source": "correlate", "key": "start_port",
+			"fallback": "start_port"}}, false, true},
+		{"fallback to expression", []map[string]interface{}{regexpField, expr("next", "start_port + 1"),
+			{"name": "start", "source": "correlate", "key": "start_port", "fallback": "next"}}, false, false},
+	} {
+		r := common.Rule{Name: "test", Regexp: *regexp.MustCompile(`port (\d+)`), Fields: c.fields}
+		if c.dedup {
+			r.Dedup = &common.Deduplication{Key: []string{"start_port"}}
+		}
+
+		if err := compileSources(&r); (err == nil) != c.valid {
+			t.Errorf("%s: %v", c.name, err)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package app
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	ruleMatches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "natlog",
+		Subsystem: "rule",
+		Name:      "matches_total",
+		Help:      "Messages matched by the rule regexp",
+	}, []string{"rule"})
+
+	ruleMisses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "natlog",
+		Subsystem: "rule",
+		Name:      "misses_total",
+		Help:      "Messages passed the rule prefilter, but not matched by the rule regexp",
+	}, []string{"rule"})
+
+	ruleSkipped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "natlog",
+		Subsystem: "rule",
+		Name:      "prefilter_skipped_total",
+		Help:      "Messages rejected by the rule prefilter without running the regexp",
+	}, []string{"rule"})
+)
+
+type ruleCounters struct {
+	matches prometheus.Counter
+	misses  prometheus.Counter
+	skipped prometheus.Counter
+}
+
+func newRuleCounters(rule string) ruleCounters {
+	return ruleCounters{
+		matches: ruleMatches.WithLabelValues(rule),
+		misses:  ruleMisses.WithLabelValues(rule),
+		skipped: ruleSkipped.WithLabelValues(rule),
+	}
+}
+
+var (
+	correlationJoined = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "natlog",
+		Subsystem: "correlation",
+		Name:      "joined_total",
+		Help:      "Closing rows joined with the opening row",
+	}, []string{"rule"})
+
+	correlationUnmatched = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "natlog",
+		Subsystem: "correlation",
+		Name:      "unmatched_total",
+		Help:      "Closing rows without opening row, fallback values are used",
+	}, []string{"rule"})
+
+	correlationExpired = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "natlog",
+		Subsystem: "correlation",
+		Name:      "expired_total",
+		Help:      "Opening rows dropped after correlation timeout",
+	}, []string{"rule"})
+
+	correlationEvicted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "natlog",
+		Subsystem: "correlation",
+		Name:      "evicted_total",
+		Help:      "Opening rows dropped before correlation timeout because max entries was reached",
+	}, []string{"rule"})
+)
+
+var (
+	sourceAccepted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "natlog",
+		Subsystem: "source",
+		Name:      "accepted_total",
+		Help:      "Messages of senders of the allow entry passed to rules, source is empty without allow list",
+	}, []string{"source"})
+
+	sourceLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "natlog",
+		Subsystem: "source",
+		Name:      "rate_limited_total",
+		Help:      "Messages of senders of the allow entry dropped by their rate limit",
+	}, []string{"source"})
+
+	sourceDenied = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "natlog",
+		Subsystem: "source",
+		Name:      "denied_total",
+		Help:      "Messages of senders not allowed by the sources ACL",
+	})
+)
+
+type sourceCounters struct {
+	accepted prometheus.Counter
+	limited  prometheus.Counter
+}
+
+func newSourceCounters(source string) sourceCounters {
+	return sourceCounters{
+		accepted: sourceAccepted.WithLabelValues(source),
+		limited:  sourceLimited.WithLabelValues(source),
+	}
+}
+
+var (
+	dedupSuppressed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "natlog",
+		Subsystem: "dedup",
+		Name:      "suppressed_total",
+		Help:      "Rows dropped as duplicates seen within the dedup window",
+	}, []string{"rule"})
+
+	dedupEvicted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "natlog",
+		Subsystem: "dedup",
+		Name:      "evicted_total",
+		Help:      "Keys forgotten before the dedup window expired because max entries was reached",
+	}, []string{"rule"})
+
+	dedupKeys = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "natlog",
+		Subsystem: "dedup",
+		Name:      "keys",
+		Help:      "Keys remembered within the dedup window",
+	}, []string{"rule"})
+)
+
+type dedupCounters struct {
+	suppressed prometheus.Counter
+	evicted    prometheus.Counter
+	keys       prometheus.Gauge
+}
+
+func newDedupCounters(rule string) dedupCounters {
+	return dedupCounters{
+		suppressed: dedupSuppressed.WithLabelValues(rule),
+		evicted:    dedupEvicted.WithLabelValues(rule),
+		keys:       dedupKeys.WithLabelValues(rule),
+	}
+}
+
+type correlationCounters struct {
+	joined    prometheus.Counter
+	unmatched prometheus.Counter
+}
+
+func newCorrelationCounters(rule string) correlationCounters {
+	return correlationCounters{
+		joined:    correlationJoined.WithLabelValues(rule),
+		unmatched: correlationUnmatched.WithLabelValues(rule),
+	}
+}
@@ -3,6 +3,15 @@ package app
 import (
 	"github.com/archaron/juniper-natlog/modules/api"
 	"github.com/archaron/juniper-natlog/modules/clickhouse"
+	"github.com/archaron/juniper-natlog/modules/sink"
+	"github.com/archaron/juniper-natlog/modules/sink/file"
+	"github.com/archaron/juniper-natlog/modules/sink/kafka"
+	"github.com/archaron/juniper-natlog/modules/sink/parquet"
+	"github.com/archaron/juniper-natlog/modules/sink/postgres"
+	"github.com/archaron/juniper-natlog/modules/sink/relay"
+	"github.com/archaron/juniper-natlog/modules/sink/sqlite"
+	"github.com/archaron/juniper-natlog/modules/subscriber"
+	"github.com/archaron/juniper-natlog/modules/tenant"
 	"github.com/go-helium/echo"
 	"github.com/im-kulikov/helium"
 	"github.com/im-kulikov/helium/grace"
@@ -25,5 +34,14 @@ var Module = module.Module{
 		api.Module,
 		service.Module,
 		clickhouse.Module,
+		sink.Module,
+		file.Module,
+		kafka.Module,
+		parquet.Module,
+		postgres.Module,
+		relay.Module,
+		sqlite.Module,
+		subscriber.Module,
+		tenant.Module,
 		web.DefaultServersModule,
 	)
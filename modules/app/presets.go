@@ -0,0 +1,95 @@
+package app
+
+import (
+	"time"
+
+	"github.com/archaron/juniper-natlog/common"
+	"gopkg.in/errgo.v2/fmt/errors"
+	"gopkg.in/mcuadros/go-syslog.v2/format"
+)
+
+// applyPreset fills rule parts that are not set in config from the built-in preset
+func applyPreset(r *common.Rule) error {
+	p, ok := common.Presets[r.Preset]
+	if !ok {
+		return errors.Newf("rule %q: unknown preset %q", r.Name, r.Preset)
+	}
+
+	if r.Name == "" {
+		r.Name = p.Name
+	}
+
+	if r.Table == "" {
+		r.Table = p.Table
+	}
+
+	if r.Regexp.String() == "" && r.Pattern == "" {
+		r.Pattern = p.Pattern
+	}
+
+	if len(r.Fields) == 0 {
+		r.Fields = p.Fields
+	}
+
+	if len(r.Contains) == 0 {
+		r.Contains = p.Contains
+	}
+
+	if p.Correlate != nil {
+		if r.Correlate == nil {
+			r.Correlate = &common.Correlation{Timeout: p.Correlate.Timeout}
+		}
+
+		if r.Correlate.Open == "" {
+			r.Correlate.Open = p.Correlate.Open
+		}
+
+		if len(r.Correlate.Key) == 0 {
+			r.Correlate.Key = p.Correlate.Key
+		}
+	}
+
+	if r.DDL == "" {
+		r.DDL = p.DDL
+	}
+
+	return nil
+}
+
+// verifyPreset runs preset samples through the compiled rule, unless the rule overrides preset pattern
+func verifyPreset(r *common.Rule) error {
+	p := common.Presets[r.Preset]
+	if r.Pattern != p.Pattern {
+		return nil
+	}
+
+	for i, sample := range p.Samples {
+		parts := format.LogParts{"content": sample.Line}
+		if sample.MsgID != "" {
+			parts = format.LogParts{"msg_id": sample.MsgID, "structured_data": sample.StructuredData, "message": sample.Line}
+		}
+
+		line, _ := messageText(parts)
+		if !r.Prefilter(line) {
+			return errors.Newf("preset %q sample %d: rejected by prefilter", p.Name, i)
+		}
+
+		match := r.Regexp.FindStringSubmatch(line)
+		if match == nil {
+			return errors.Newf("preset %q sample %d: not matched", p.Name, i)
+		}
+
+		msg, err := buildMessage(r, match, parts, time.Now(), time.UTC, nil, nil)
+		if err != nil {
+			return errors.Notef(err, nil, "preset %q sample %d", p.Name, i)
+		}
+
+		for field, expect := range sample.Expect {
+			if msg.Fields[field] != expect {
+				return errors.Newf("preset %q sample %d: field %q is %q, expected %q", p.Name, i, field, msg.Fields[field], expect)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,86 @@
+package app
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/archaron/juniper-natlog/common"
+	"gopkg.in/mcuadros/go-syslog.v2/format"
+)
+
+// TestPresetSamples compiles every preset and parses its samples the way the listener does
+func TestPresetSamples(t *testing.T) {
+	names := make([]string, 0, len(common.Presets))
+	for name := range common.Presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		t.Run(name, func(t *testing.T) {
+			p := common.Presets[name]
+			if len(p.Samples) == 0 {
+				t.Fatal("preset has no samples")
+			}
+
+			r := common.Rule{Preset: name}
+			if err := applyPreset(&r); err != nil {
+				t.Fatal(err)
+			}
+
+			re, err := common.NewPatternLibrary().Compile(r.Pattern)
+			if err != nil {
+				t.Fatalf("cannot compile pattern: %v", err)
+			}
+			r.Regexp = *re
+
+			if err := compileSources(&r); err != nil {
+				t.Fatal(err)
+			}
+
+			for i, sample := range p.Samples {
+				t.Run(fmt.Sprint(i), func(t *testing.T) {
+					parts := format.LogParts{"content": sample.Line}
+					if strings.HasSuffix(name, "-sd") {
+						if sample.MsgID == "" {
+							t.Fatal("structured-data sample has no MsgID")
+						}
+						parts = format.LogParts{"msg_id": sample.MsgID, "structured_data": sample.StructuredData, "message": sample.Line}
+					}
+
+					line, ok := messageText(parts)
+					if !ok {
+						t.Fatal("no message text")
+					}
+
+					if !r.Prefilter(line) {
+						t.Fatalf("rejected by prefilter: %s", line)
+					}
+
+					match := r.Regexp.FindStringSubmatch(line)
+					if match == nil {
+						t.Fatalf("not matched: %s", line)
+					}
+
+					msg, err := buildMessage(&r, match, parts, time.Now(), time.UTC, nil, nil)
+					if err != nil {
+						t.Fatal(err)
+					}
+
+					for field, expect := range sample.Expect {
+						if got := msg.Fields[field]; got != expect {
+							t.Errorf("field %q is %q, expected %q", field, got, expect)
+						}
+					}
+				})
+			}
+
+			if err := verifyPreset(&r); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package app
+
+import (
+	"net"
+
+	"gopkg.in/mcuadros/go-syslog.v2"
+	"gopkg.in/mcuadros/go-syslog.v2/format"
+)
+
+const rawKey = "raw"
+
+type (
+	// rawFormat detects message format like syslog.Automatic and keeps the received line in log parts for relays
+	rawFormat struct {
+		*format.Automatic
+	}
+
+	rawParser struct {
+		format.LogParser
+		raw string
+	}
+)
+
+func newRawFormat() format.Format {
+	return &rawFormat{Automatic: syslog.Automatic}
+}
+
+func (f *rawFormat) GetParser(line []byte) format.LogParser {
+	return &rawParser{LogParser: f.Automatic.GetParser(line), raw: string(line)}
+}
+
+func (p *rawParser) Dump() format.LogParts {
+	parts := p.LogParser.Dump()
+	parts[rawKey] = p.raw
+	return parts
+}
+
+// fillHostname - server fills hostname of RFC3164 messages from client address for its own formats only
+func fillHostname(parts format.LogParts) {
+	if hostname, _ := parts["hostname"].(string); hostname != "" {
+		return
+	}
+
+	client, _ := parts["client"].(string)
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+	parts["hostname"] = client
+}
+
+// relay raw message with names of matched rules
+func (s *syslogListener) relay(parts format.LogParts, matched []string) {
+	raw, ok := parts[rawKey].(string)
+	if !ok {
+		return
+	}
+
+	for _, relay := range s.relays {
+		relay.Relay(raw, matched)
+	}
+}
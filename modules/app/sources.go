@@ -0,0 +1,200 @@
+package app
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+type (
+	// sourceSettings - `syslog.sources` section, Allow and Deny are CIDRs or addresses, zero Rate is unlimited
+	sourceSettings struct {
+		Allow []string
+		Deny  []string
+		// Rate - messages per second of one sender, Burst - messages received at once, Rate by default
+		Rate  float64
+		Burst int
+	}
+
+	// sourceFilter drops messages of senders denied by ACL or exceeding their rate, before rules are matched
+	sourceFilter struct {
+		log   *zap.Logger
+		allow []*net.IPNet
+		deny  []*net.IPNet
+		rate  float64
+		burst float64
+
+		buckets   map[string]*tokenBucket
+		lastSweep time.Time
+
+		// counters of allow entries, others - of senders without allow list, series are bounded by the config
+		counters []sourceCounters
+		others   sourceCounters
+	}
+
+	tokenBucket struct {
+		tokens float64
+		last   time.Time
+	}
+)
+
+func newSourceFilter(v *viper.Viper, log *zap.Logger) (*sourceFilter, error) {
+	var cfg sourceSettings
+	if err := v.UnmarshalKey("syslog.sources", &cfg); err != nil {
+		return nil, errors.Notef(err, nil, "syslog sources")
+	}
+
+	if cfg.Rate < 0 || cfg.Burst < 0 {
+		return nil, errors.New("syslog sources: 'rate' and 'burst' must not be negative")
+	}
+
+	f := &sourceFilter{
+		log:       log,
+		rate:      cfg.Rate,
+		burst:     float64(cfg.Burst),
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+		others:    newSourceCounters(""),
+	}
+
+	if f.rate > 0 && f.burst == 0 {
+		f.burst = f.rate
+	}
+
+	if f.burst < 1 {
+		f.burst = 1
+	}
+
+	var err error
+	if f.allow, err = parseNetworks(cfg.Allow); err != nil {
+		return nil, errors.Notef(err, nil, "syslog sources allow")
+	}
+
+	if f.deny, err = parseNetworks(cfg.Deny); err != nil {
+		return nil, errors.Notef(err, nil, "syslog sources deny")
+	}
+
+	f.counters = make([]sourceCounters, len(cfg.Allow))
+	for i, entry := range cfg.Allow {
+		f.counters[i] = newSourceCounters(entry)
+	}
+
+	return f, nil
+}
+
+// parseNetworks of CIDRs, addresses without prefix length are single host networks
+func parseNetworks(list []string) ([]*net.IPNet, error) {
+	result := make([]*net.IPNet, 0, len(list))
+	for _, item := range list {
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, errors.Newf("invalid address %q", item)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			result = append(result, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, network)
+	}
+	return result, nil
+}
+
+func inNetworks(networks []*net.IPNet, ip net.IP) bool {
+	return networkIndex(networks, ip) >= 0
+}
+
+// networkIndex - index of the first network containing the address, -1 when none does
+func networkIndex(networks []*net.IPNet, ip net.IP) int {
+	for i, network := range networks {
+		if network.Contains(ip) {
+			return i
+		}
+	}
+	return -1
+}
+
+// accept reports whether message of the client `ip:port` is accepted. Messages are counted by the allow entry
+// of the sender, not by its address: without allow list any address, even spoofed, would add series.
+func (f *sourceFilter) accept(client string, now time.Time) bool {
+	host, _, err := net.SplitHostPort(client)
+	if err != nil {
+		host = client
+	}
+
+	ip := net.ParseIP(host)
+	allowed := -1
+	if ip != nil {
+		allowed = networkIndex(f.allow, ip)
+	}
+
+	if ip == nil || inNetworks(f.deny, ip) || (len(f.allow) > 0 && allowed < 0) {
+		sourceDenied.Inc()
+		f.log.Debug("message of denied sender dropped", zap.String("client", client))
+		return false
+	}
+
+	counters := f.others
+	if allowed >= 0 {
+		counters = f.counters[allowed]
+	}
+
+	f.sweep(now)
+
+	if f.rate > 0 && !f.take(host, now) {
+		counters.limited.Inc()
+		return false
+	}
+
+	counters.accepted.Inc()
+	return true
+}
+
+// take a token from the bucket of the sender, buckets are filled by rate up to burst
+func (f *sourceFilter) take(host string, now time.Time) bool {
+	b, ok := f.buckets[host]
+	if !ok {
+		b = &tokenBucket{tokens: f.burst, last: now}
+		f.buckets[host] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * f.rate
+	if b.tokens > f.burst {
+		b.tokens = f.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// sweep drops buckets filled up since the last message, runs at most once a minute
+func (f *sourceFilter) sweep(now time.Time) {
+	if len(f.buckets) == 0 || now.Sub(f.lastSweep) < time.Minute {
+		return
+	}
+	f.lastSweep = now
+
+	for host, b := range f.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*f.rate >= f.burst {
+			delete(f.buckets, host)
+		}
+	}
+}
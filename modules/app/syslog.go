@@ -4,25 +4,31 @@ import (
 	"context"
 	"reflect"
 	"regexp"
+	"sort"
 	"time"
 
 	"github.com/archaron/juniper-natlog/common"
-	"github.com/archaron/juniper-natlog/modules/clickhouse"
+	"github.com/archaron/juniper-natlog/modules/sink"
+	"github.com/archaron/juniper-natlog/modules/subscriber"
+	"github.com/archaron/juniper-natlog/modules/tenant"
 	"github.com/im-kulikov/helium/service"
 	"github.com/im-kulikov/helium/web"
 	"github.com/mitchellh/mapstructure"
 	"github.com/spf13/viper"
 	"go.uber.org/dig"
 	"go.uber.org/zap"
+	"gopkg.in/errgo.v2/fmt/errors"
 	"gopkg.in/mcuadros/go-syslog.v2"
 )
 
 type (
 	syslogParams struct {
 		dig.In
-		Viper  *viper.Viper
-		Logger *zap.Logger
-		CH     *clickhouse.Service
+		Viper      *viper.Viper
+		Logger     *zap.Logger
+		Sinks      *sink.Registry
+		Tenants    *tenant.Registry
+		Accounting *subscriber.Accounting
 	}
 
 	syslogOutParams struct {
@@ -36,22 +42,50 @@ type (
 
 		address    string
 		msgChannel syslog.LogPartsChannel
+		// handled is closed when every parsed message is inserted into sinks
+		handled    chan struct{}
 		handler    *syslog.ChannelHandler
 		server     *syslog.Server
-		ch         *clickhouse.Service
-
-		rules common.Rules
+		sinks      *sink.Registry
+		relays     []sink.Relay
+		tenants    *tenant.Registry
+		accounting *subscriber.Accounting
+
+		rules      common.Rules
+		routes     [][]sink.Sink
+		counters   []ruleCounters
+		correlator *correlator
+		dedup      *deduplicator
+		sources    *sourceFilter
+		devices    map[string]*device
 	}
 )
 
 func (s *syslogListener) registerModels() {
-	for _, r := range s.rules {
+	for ri := range s.rules {
+		r := &s.rules[ri]
 		model := common.Model{
 			Table: r.Table,
+			DDL:   r.DDL,
+		}
+
+		if t, ok := s.tenants.Get(r.Tenant); ok {
+			model.Table = tenant.Qualify(t.Database, model.Table)
 		}
 
 		log := s.log.With(zap.String("rule", r.Name))
 
+		if err := compileSources(r); err != nil {
+			log.Fatal("cannot compile rule fields", zap.Error(err))
+		}
+
+		for _, src := range r.Sources {
+			if src.Source == common.SourceSubscriber && !s.accounting.Enabled() {
+				log.Fatal("subscriber field requires RADIUS accounting, 'radius.address' is not set",
+					zap.String("name", src.Name))
+			}
+		}
+
 		for i, f := range r.Fields {
 			name, ok := f["name"].(string)
 			if !ok {
@@ -78,10 +112,9 @@ func (s *syslogListener) registerModels() {
 					ModelField: modelField,
 				})
 			case "timestamp":
-				layout, ok := f["default"].(string)
+				layout, ok := fieldLayout(f)
 				if !ok {
 					log.Debug("no layout for timestamp parse, using default")
-					layout = "2006-01-02 15:04:05"
 				}
 
 				model.Fields = append(model.Fields, &common.TimestampModelField{
@@ -133,23 +166,100 @@ func (s *syslogListener) registerModels() {
 				model.Fields = append(model.Fields, &common.UInt16ModelField{
 					ModelField: modelField,
 				})
+			case "uint32":
+				model.Fields = append(model.Fields, &common.UInt32ModelField{
+					ModelField: modelField,
+				})
+			case "uint64":
+				model.Fields = append(model.Fields, &common.UInt64ModelField{
+					ModelField: modelField,
+				})
+			case "ip":
+				model.Fields = append(model.Fields, &common.IpModelField{
+					ModelField: modelField,
+				})
 
 			default:
 				log.Fatal("unknown field type")
 			}
 
 		}
-		s.ch.RegisterModel(r.Name, &model)
+		if r.NoInsert {
+			continue
+		}
+
+		for _, snk := range s.routes[ri] {
+			m := model
+			if err := snk.RegisterModel(r.Name, &m); err != nil {
+				log.Fatal("cannot register model", zap.String("sink", snk.Name()), zap.Error(err))
+			}
+		}
+		s.tenants.AddRoute(r.Name, tenant.Route{Name: r.Name, Tenant: r.Tenant, Sinks: sinkNames(s.routes[ri]), Table: model.Table})
+
+		for _, d := range s.devices {
+			if !d.routed() || !d.enabled(r.Name) {
+				continue
+			}
+
+			sinks := s.routes[ri]
+			if d.sinks != nil {
+				sinks = d.sinks
+			}
+
+			table := d.model(model).Table
+			for _, snk := range sinks {
+				m := d.model(model)
+				if err := snk.RegisterModel(d.route(r.Name), &m); err != nil {
+					log.Fatal("cannot register device model", zap.String("sink", snk.Name()),
+						zap.String("device", d.name), zap.Error(err))
+				}
+			}
+
+			owner := d.tenant
+			if owner == "" {
+				owner = r.Tenant
+			}
+			s.tenants.AddRoute(r.Name, tenant.Route{Name: d.route(r.Name), Tenant: owner, Sinks: sinkNames(sinks), Table: table})
+		}
+	}
+
+	if err := s.tenants.Verify(); err != nil {
+		s.log.Fatal("tenant rows would share tables", zap.Error(err))
 	}
 }
 
+// lookup of subscribers, nil when RADIUS accounting is disabled
+func (s *syslogListener) lookup() lookupFunc {
+	if !s.accounting.Enabled() {
+		return nil
+	}
+	return s.accounting.Lookup
+}
+
+func sinkNames(sinks []sink.Sink) []string {
+	names := make([]string, 0, len(sinks))
+	for _, snk := range sinks {
+		names = append(names, snk.Name())
+	}
+	return names
+}
+
+// ListenAndServe starts sinks before receiving messages, sinks are not stopped on shutdown signal, but by Shutdown
 func (s *syslogListener) ListenAndServe() error {
+	if err := s.sinks.Start(context.Background()); err != nil {
+		return err
+	}
+
+	if err := s.accounting.Start(); err != nil {
+		return err
+	}
 
 	s.msgChannel = make(syslog.LogPartsChannel)
+	s.handled = make(chan struct{})
 	s.handler = syslog.NewChannelHandler(s.msgChannel)
 
 	s.server = syslog.NewServer()
-	s.server.SetFormat(syslog.Automatic)
+	s.server.SetFormat(newRawFormat())
 	s.server.SetHandler(s.handler)
 	if err := s.server.ListenUDP(s.address); err != nil {
 		return err
@@ -167,66 +277,141 @@ func (s *syslogListener) ListenAndServe() error {
 }
 
 func (s *syslogListener) messageHandler(channel syslog.LogPartsChannel) {
+	defer close(s.handled)
+
 	for logParts := range channel {
-		content, ok := logParts["content"].(string)
+		received := time.Now()
+		client, _ := logParts["client"].(string)
+		if !s.sources.accept(client, received) {
+			continue
+		}
+
+		fillHostname(logParts)
+		hostname, _ := logParts["hostname"].(string)
+		dev := lookupDevice(s.devices, client, hostname)
+
+		content, ok := messageText(logParts)
 		if !ok {
-			s.log.Fatal("cannot parse content", zap.Any("log_parts", logParts))
+			s.log.Error("cannot get message text", zap.Any("log_parts", logParts))
+			s.relay(logParts, nil)
+			continue
 		}
+
+		var matched []string
 		for i := range s.rules {
+			if !dev.enabled(s.rules[i].Name) {
+				continue
+			}
+
+			if !s.rules[i].Prefilter(content) {
+				s.counters[i].skipped.Inc()
+				continue
+			}
+
 			matches := s.rules[i].Regexp.FindAllStringSubmatch(content, -1)
 			if len(matches) == 0 {
+				s.counters[i].misses.Inc()
 				continue
 			}
-			colsNum := len(s.rules[i].Fields)
+			s.counters[i].matches.Inc()
+			matched = append(matched, s.rules[i].Name)
+
 			for m := range matches {
-				if len(matches[m]) != colsNum+1 {
+				if !s.rules[i].Named && len(matches[m]) != s.rules[i].Captures+1 {
 					s.log.Error("fields count mismatch in regexp and in fields definition",
-						zap.Int("rule_fields_num", colsNum),
+						zap.Int("rule_fields_num", s.rules[i].Captures),
 						zap.Int("regexp_results", len(matches[m])-1),
 						zap.String("rule", s.rules[i].Name),
 					)
 					continue
 				}
 
-				msg := common.FlowMessage{
-					Rule:   s.rules[i].Name,
-					Fields: make(map[string]string, colsNum),
+				msg, err := buildMessage(&s.rules[i], matches[m], logParts, received, dev.zone(), s.correlator.join(&s.rules[i]), s.lookup())
+				if err != nil {
+					s.log.Error("cannot build message fields", zap.Error(err), zap.String("rule", s.rules[i].Name))
+					continue
 				}
 
-				for j := range s.rules[i].Fields {
+				dev.tag(msg)
 
-					fieldName, ok := s.rules[i].Fields[j]["name"].(string)
-					if !ok {
-						s.log.Fatal("field 'name' must be string", zap.Any("field", s.rules[i].Fields[j]))
-					}
+				if s.dedup.duplicate(msg, received) {
+					continue
+				}
 
-					msg.Fields[fieldName] = matches[m][j+1]
+				s.correlator.remember(msg, received)
+
+				if s.rules[i].NoInsert {
+					continue
 				}
 
-				s.ch.Insert(&msg)
+				routes := s.routes[i]
+				if dev.routed() {
+					msg.Rule = dev.route(msg.Rule)
+					if dev.sinks != nil {
+						routes = dev.sinks
+					}
+				}
+
+				for _, snk := range routes {
+					snk.Insert(msg)
+				}
 
 			}
 
+			if s.rules[i].Stop {
+				break
+			}
 		}
+
+		s.correlator.sweep(received)
+		s.relay(logParts, matched)
 	}
 }
 
+// Shutdown stops receiving, inserts messages already received and stops sinks, writing pending rows
 func (s *syslogListener) Shutdown(ctx context.Context) error {
-	if s.server != nil {
-		return s.server.Kill()
+	if s.server == nil {
+		return nil
 	}
 
-	return nil
+	if err := s.server.Kill(); err != nil {
+		return err
+	}
+
+	s.server.Wait()
+	close(s.msgChannel)
+
+	// sinks are stopped even when the deadline is missed, so queued rows are spilled rather than dropped
+	var lastError error
+	select {
+	case <-s.handled:
+	case <-ctx.Done():
+		s.log.Error("received messages are not inserted before shutdown deadline")
+		lastError = ctx.Err()
+	}
+
+	if err := s.accounting.Shutdown(ctx); err != nil {
+		s.log.Error("could not stop accounting", zap.Error(err))
+		lastError = err
+	}
+
+	s.log.Info("syslog listener stopped, stopping sinks")
+	if err := s.sinks.Stop(ctx); err != nil {
+		return err
+	}
+	return lastError
 }
 
 func newSyslogService(p syslogParams) (syslogOutParams, error) {
 
 	l := &syslogListener{
-		timeout: p.Viper.GetDuration("syslog.timeout"),
-		address: p.Viper.GetString("syslog.address"),
-		log:     p.Logger,
-		ch:      p.CH,
-
+		timeout:    p.Viper.GetDuration("syslog.timeout"),
+		address:    p.Viper.GetString("syslog.address"),
+		log:        p.Logger,
+		sinks:      p.Sinks,
+		relays:     p.Sinks.Relays(),
+		tenants:    p.Tenants,
+		accounting: p.Accounting,
 	}
 
 	var svc service.Service
@@ -238,9 +423,98 @@ func newSyslogService(p syslogParams) (syslogOutParams, error) {
 		))); err != nil {
 		return syslogOutParams{}, err
 	}
+
+	patterns, err := newPatternLibrary(p.Viper)
+	if err != nil {
+		return syslogOutParams{}, err
+	}
+
+	for i := range l.rules {
+		if l.rules[i].Preset != "" {
+			if err := applyPreset(&l.rules[i]); err != nil {
+				return syslogOutParams{}, err
+			}
+		}
+
+		if l.rules[i].Pattern == "" {
+			continue
+		}
+
+		if l.rules[i].Regexp.String() != "" {
+			return syslogOutParams{}, errors.Newf("rule %q: only one of 'regexp' and 'pattern' can be set", l.rules[i].Name)
+		}
+
+		re, err := patterns.Compile(l.rules[i].Pattern)
+		if err != nil {
+			return syslogOutParams{}, errors.Notef(err, nil, "rule %q: cannot compile pattern", l.rules[i].Name)
+		}
+		l.rules[i].Regexp = *re
+	}
+
+	sort.SliceStable(l.rules, func(i, j int) bool {
+		return l.rules[i].Priority > l.rules[j].Priority
+	})
+
+	l.counters = make([]ruleCounters, 0, len(l.rules))
+	l.routes = make([][]sink.Sink, 0, len(l.rules))
+	for i := range l.rules {
+		if l.rules[i].Name == subscriber.Route && l.accounting.Enabled() {
+			return syslogOutParams{}, errors.Newf("rule %q: the name is used by RADIUS session rows", l.rules[i].Name)
+		}
+
+		l.counters = append(l.counters, newRuleCounters(l.rules[i].Name))
+
+		if l.rules[i].Tenant != "" {
+			t, ok := l.tenants.Get(l.rules[i].Tenant)
+			if !ok {
+				return syslogOutParams{}, errors.Newf("rule %q: unknown tenant %q", l.rules[i].Name, l.rules[i].Tenant)
+			}
+
+			if len(l.rules[i].Sinks) == 0 {
+				l.rules[i].Sinks = t.Sinks
+			}
+		}
+
+		if len(l.rules[i].Sinks) == 0 {
+			l.rules[i].Sinks = p.Viper.GetStringSlice("syslog.sinks")
+		}
+
+		route, err := l.sinks.Route(l.rules[i].Sinks)
+		if err != nil {
+			return syslogOutParams{}, errors.Notef(err, nil, "rule %q", l.rules[i].Name)
+		}
+		l.routes = append(l.routes, route)
+	}
+
+	if l.devices, err = newDevices(p.Viper, l.rules, l.tenants, l.sinks); err != nil {
+		return syslogOutParams{}, err
+	}
+
+	if l.correlator, err = newCorrelator(l.rules); err != nil {
+		return syslogOutParams{}, err
+	}
+
+	if l.dedup, err = newDeduplicator(l.rules); err != nil {
+		return syslogOutParams{}, err
+	}
+
+	if l.sources, err = newSourceFilter(p.Viper, l.log); err != nil {
+		return syslogOutParams{}, err
+	}
+
 	l.registerModels()
 
-	svc, err := web.NewListener(l,
+	for i := range l.rules {
+		if l.rules[i].Preset == "" {
+			continue
+		}
+
+		if err := verifyPreset(&l.rules[i]); err != nil {
+			return syslogOutParams{}, err
+		}
+	}
+
+	svc, err = web.NewListener(l,
 		web.ListenerShutdownTimeout(p.Viper.GetDuration("syslog.shutdown_timeout")),
 		web.ListenerName("syslog listener " + l.address),
 	)
@@ -249,6 +523,35 @@ func newSyslogService(p syslogParams) (syslogOutParams, error) {
 	}, err
 }
 
+// newPatternLibrary - built-in patterns extended by `syslog.patterns_files` and inline `syslog.patterns`
+func newPatternLibrary(v *viper.Viper) (*common.PatternLibrary, error) {
+	patterns := common.NewPatternLibrary()
+
+	for _, file := range v.GetStringSlice("syslog.patterns_files") {
+		if err := patterns.Load(file); err != nil {
+			return nil, errors.Notef(err, nil, "cannot load patterns file %q", file)
+		}
+	}
+
+	// a list, not a map: viper lower-cases map keys, pattern names are case-sensitive
+	var inline []struct {
+		Name    string
+		Pattern string
+	}
+	if err := v.UnmarshalKey("syslog.patterns", &inline); err != nil {
+		return nil, errors.Notef(err, nil, "syslog patterns")
+	}
+
+	for i, p := range inline {
+		if p.Name == "" || p.Pattern == "" {
+			return nil, errors.Newf("syslog pattern %d: 'name' and 'pattern' are required", i)
+		}
+		patterns.Add(p.Name, p.Pattern)
+	}
+
+	return patterns, nil
+}
+
 // StringToRegexp returns a DecodeHookFunc that converts
 // strings to regexp.Regexp
 func StringToRegexp() mapstructure.DecodeHookFunc {
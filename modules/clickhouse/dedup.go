@@ -0,0 +1,25 @@
+package clickhouse
+
+import (
+	"regexp"
+	"strings"
+)
+
+// valuesRe - the driver sends the statement up to VALUES, settings are put before it
+var valuesRe = regexp.MustCompile(`(?i)\sVALUES\s*\(`)
+
+// deduplicated adds insert_deduplication_token setting to the insert statement, statement is kept when token
+// is empty. Blocks with the same token are skipped by MergeTree tables with deduplication enabled.
+func deduplicated(statement, token string) string {
+	if token == "" {
+		return statement
+	}
+
+	loc := valuesRe.FindStringIndex(statement)
+	if loc == nil {
+		return statement
+	}
+
+	escaped := strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(token)
+	return statement[:loc[0]] + " SETTINGS insert_deduplication_token = '" + escaped + "'" + statement[loc[0]:]
+}
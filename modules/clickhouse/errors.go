@@ -0,0 +1,65 @@
+package clickhouse
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/ClickHouse/clickhouse-go"
+	"github.com/archaron/juniper-natlog/modules/sink"
+)
+
+// permanentCodes - server exception codes of schema and data errors, retrying the same batch fails again
+var permanentCodes = map[int32]string{
+	6:   "CANNOT_PARSE_TEXT",
+	8:   "THERE_IS_NO_COLUMN",
+	16:  "NO_SUCH_COLUMN_IN_TABLE",
+	20:  "NUMBER_OF_COLUMNS_DOESNT_MATCH",
+	27:  "CANNOT_PARSE_INPUT_ASSERTION_FAILED",
+	44:  "ILLEGAL_COLUMN",
+	47:  "UNKNOWN_IDENTIFIER",
+	53:  "TYPE_MISMATCH",
+	60:  "UNKNOWN_TABLE",
+	62:  "SYNTAX_ERROR",
+	70:  "CANNOT_CONVERT_TYPE",
+	81:  "UNKNOWN_DATABASE",
+	117: "INCORRECT_DATA",
+}
+
+// httpError - non-OK response of HTTP interface, Code is taken from X-ClickHouse-Exception-Code
+type httpError struct {
+	Status  int
+	Code    int32
+	Message string
+}
+
+func (e *httpError) Error() string {
+	return fmt.Sprintf("clickhouse http status %d: %s", e.Status, e.Message)
+}
+
+// classify marks schema errors as permanent, other errors (network, timeouts, overload) are retried
+func classify(err error) error {
+	if err == nil || sink.IsPermanent(err) {
+		return err
+	}
+
+	for e := err; e != nil; {
+		switch v := e.(type) {
+		case *clickhouse.Exception:
+			if _, ok := permanentCodes[v.Code]; ok {
+				return sink.Permanent(err)
+			}
+			return err
+		case *httpError:
+			if _, ok := permanentCodes[v.Code]; ok || (v.Code == 0 && v.Status == http.StatusBadRequest) {
+				return sink.Permanent(err)
+			}
+			return err
+		case interface{ Underlying() error }:
+			e = v.Underlying()
+		default:
+			return err
+		}
+	}
+
+	return err
+}
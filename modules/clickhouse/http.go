@@ -0,0 +1,320 @@
+package clickhouse
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/archaron/juniper-natlog/common"
+	"github.com/archaron/juniper-natlog/modules/sink"
+	"github.com/klauspost/compress/zstd"
+	"go.uber.org/zap"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+// httpInserter posts batches to the HTTP interface of replicas in RowBinary or Native format,
+// values are encoded by table column types read from system.columns
+type httpInserter struct {
+	cfg    *Settings
+	log    *zap.Logger
+	db     *sql.DB
+	client *http.Client
+	scheme string
+	hosts  []string
+	// next - replica tried first
+	next int
+
+	// columns of model fields by table
+	columns map[string][]*columnType
+}
+
+func newHTTPInserter(cfg *Settings, db *sql.DB, hosts []string, log *zap.Logger) (*httpInserter, error) {
+	h := &httpInserter{
+		cfg:     cfg,
+		log:     log,
+		db:      db,
+		client:  &http.Client{Timeout: time.Duration(cfg.WriteTimeout) * time.Second},
+		scheme:  "http",
+		hosts:   hosts,
+		columns: make(map[string][]*columnType),
+	}
+
+	if cfg.Secure {
+		tlsConfig, err := cfg.TLS.Config("")
+		if err != nil {
+			return nil, errors.Notef(err, nil, "clickhouse tls")
+		}
+
+		h.scheme = "https"
+		h.client.Transport = &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		}
+	}
+
+	return h, nil
+}
+
+// describe types of model fields columns, cached until insert fails
+func (h *httpInserter) describe(ctx context.Context, model *common.Model) ([]*columnType, error) {
+	if columns, ok := h.columns[model.Table]; ok {
+		return columns, nil
+	}
+
+	database, table := h.cfg.Database, model.Table
+	if i := strings.IndexByte(table, '.'); i > 0 {
+		database, table = table[:i], table[i+1:]
+	}
+
+	rows, err := h.db.QueryContext(ctx, "SELECT name, type FROM system.columns WHERE database = ? AND table = ?", database, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	types := make(map[string]string)
+	for rows.Next() {
+		var name, typ string
+		if err = rows.Scan(&name, &typ); err != nil {
+			return nil, err
+		}
+		types[name] = typ
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	columns := make([]*columnType, 0, len(model.Fields))
+	for _, f := range model.Fields {
+		typ, ok := types[f.GetName()]
+		if !ok {
+			return nil, sink.Permanent(errors.Newf("table %q has no column %q", model.Table, f.GetName()))
+		}
+
+		column, err := parseColumnType(typ)
+		if err != nil {
+			return nil, sink.Permanent(errors.Notef(err, nil, "column %q", f.GetName()))
+		}
+
+		if column.lowCardinality && h.cfg.HTTPFormat == FormatNative {
+			return nil, sink.Permanent(errors.Newf("column %q: %s is not supported in %s format, use %s", f.GetName(), typ, FormatNative, FormatRowBinary))
+		}
+		columns = append(columns, column)
+	}
+
+	h.columns[model.Table] = columns
+	return columns, nil
+}
+
+func (h *httpInserter) close() {
+	h.client.CloseIdleConnections()
+}
+
+func (h *httpInserter) insert(ctx context.Context, model *common.Model, rule, token string, items []common.FlowMessagePayload, reason string) error {
+	columns, err := h.describe(ctx, model)
+	if err != nil {
+		return errors.Notef(err, nil, "could not describe table %q", model.Table)
+	}
+
+	rows := make([][]interface{}, 0, len(items))
+	for _, msg := range items {
+		values, err := model.Convert(msg)
+		if err != nil {
+			h.log.Error("cannot convert field", zap.Error(err), zap.String("rule", rule), zap.String("reason", reason))
+			continue
+		}
+		rows = append(rows, values)
+	}
+
+	if len(rows) == 0 {
+		return nil
+	}
+
+	var body []byte
+	if h.cfg.HTTPFormat == FormatNative {
+		body, err = encodeNative(model, columns, rows)
+	} else {
+		body, err = encodeRowBinary(columns, rows)
+	}
+	if err != nil {
+		// table may be altered since it was described
+		delete(h.columns, model.Table)
+		return errors.Notef(err, nil, "could not encode rows")
+	}
+
+	if err = h.post(ctx, model, token, body); err != nil {
+		delete(h.columns, model.Table)
+		return err
+	}
+
+	return nil
+}
+
+func encodeRowBinary(columns []*columnType, rows [][]interface{}) ([]byte, error) {
+	var (
+		buf []byte
+		err error
+	)
+	for _, row := range rows {
+		for i, column := range columns {
+			if buf, err = column.encode(buf, row[i]); err != nil {
+				return nil, errors.Notef(err, nil, "column %d", i)
+			}
+		}
+	}
+	return buf, nil
+}
+
+// encodeNative writes one block: columns and rows count, then name, type and values of every column,
+// null map of Nullable column precedes its values
+func encodeNative(model *common.Model, columns []*columnType, rows [][]interface{}) ([]byte, error) {
+	buf := binary.AppendUvarint(nil, uint64(len(columns)))
+	buf = binary.AppendUvarint(buf, uint64(len(rows)))
+
+	var err error
+	for i, column := range columns {
+		name := model.Fields[i].GetName()
+		buf = binary.AppendUvarint(buf, uint64(len(name)))
+		buf = append(buf, name...)
+		buf = binary.AppendUvarint(buf, uint64(len(column.name)))
+		buf = append(buf, column.name...)
+
+		if column.nullable {
+			buf = append(buf, make([]byte, len(rows))...)
+		}
+
+		for _, row := range rows {
+			if buf, err = column.encodeValue(buf, row[i]); err != nil {
+				return nil, errors.Notef(err, nil, "column %q", name)
+			}
+		}
+	}
+	return buf, nil
+}
+
+func (h *httpInserter) compress(body []byte) ([]byte, error) {
+	var out bytes.Buffer
+	switch h.cfg.Compression {
+	case CompressionGzip:
+		w := gzip.NewWriter(&out)
+		if _, err := w.Write(body); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	case CompressionZstd:
+		w, err := zstd.NewWriter(&out)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = w.Write(body); err != nil {
+			return nil, err
+		}
+		if err = w.Close(); err != nil {
+			return nil, err
+		}
+	default:
+		return body, nil
+	}
+	return out.Bytes(), nil
+}
+
+func (h *httpInserter) post(ctx context.Context, model *common.Model, token string, body []byte) error {
+	names := make([]string, 0, len(model.Fields))
+	for _, f := range model.Fields {
+		names = append(names, f.GetName())
+	}
+
+	q := url.Values{}
+	q.Set("database", h.cfg.Database)
+	q.Set("query", "INSERT INTO "+model.Table+" ("+strings.Join(names, ",")+") FORMAT "+h.cfg.HTTPFormat)
+	if token != "" {
+		q.Set("insert_deduplication_token", token)
+	}
+
+	body, err := h.compress(body)
+	if err != nil {
+		return errors.Notef(err, nil, "could not compress rows")
+	}
+
+	// replicas are tried in failover order until one responds, round robin starts from the next one each time
+	start := 0
+	if h.cfg.Failover == FailoverRoundRobin {
+		start = h.next
+		h.next = (h.next + 1) % len(h.hosts)
+	}
+
+	for i := range h.hosts {
+		host := h.hosts[(start+i)%len(h.hosts)]
+		u := url.URL{
+			Scheme:   h.scheme,
+			Host:     host,
+			Path:     "/",
+			RawQuery: q.Encode(),
+		}
+
+		if err = h.do(ctx, u.String(), body); err == nil {
+			return nil
+		}
+
+		// canceled write is not retried on other replicas
+		if !unavailable(err) || ctx.Err() != nil {
+			return err
+		}
+
+		h.log.Warn("clickhouse replica unavailable", zap.String("host", host), zap.Error(err))
+	}
+
+	return errors.Notef(err, nil, "could not post rows")
+}
+
+// unavailable reports whether the next replica should be tried: connection errors and 5xx responses, except
+// schema and data errors, ClickHouse answers them with 500 too and every replica would reject the rows
+func unavailable(err error) bool {
+	switch e := err.(type) {
+	case *url.Error:
+		return true
+	case *httpError:
+		_, permanent := permanentCodes[e.Code]
+		return e.Status >= http.StatusInternalServerError && !permanent
+	}
+	return false
+}
+
+func (h *httpInserter) do(ctx context.Context, address string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, address, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("X-ClickHouse-User", h.cfg.Username)
+	req.Header.Set("X-ClickHouse-Key", h.cfg.Password)
+	if h.cfg.Compression == CompressionGzip || h.cfg.Compression == CompressionZstd {
+		req.Header.Set("Content-Encoding", h.cfg.Compression)
+	}
+
+	res, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+		code, _ := strconv.ParseInt(res.Header.Get("X-ClickHouse-Exception-Code"), 10, 32)
+		return &httpError{Status: res.StatusCode, Code: int32(code), Message: strings.TrimSpace(string(msg))}
+	}
+
+	_, _ = io.Copy(io.Discard, res.Body)
+	return nil
+}
@@ -0,0 +1,105 @@
+package clickhouse
+
+import (
+	"context"
+	"database/sql/driver"
+	"sync"
+
+	"github.com/ClickHouse/clickhouse-go"
+	"github.com/archaron/juniper-natlog/common"
+	"go.uber.org/zap"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+// nativeInserter writes every batch as one column-oriented block over its own direct connection,
+// connection is dropped on errors and opened again with the next batch
+type nativeInserter struct {
+	dsn string
+	cfg *Settings
+	log *zap.Logger
+	// mu guards connection closed on stop
+	mu   sync.Mutex
+	conn clickhouse.Clickhouse
+}
+
+func (n *nativeInserter) close() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.drop()
+}
+
+func (n *nativeInserter) drop() {
+	if n.conn != nil {
+		if err := n.conn.Close(); err != nil {
+			n.log.Error("could not close connection", zap.Error(err))
+		}
+		n.conn = nil
+	}
+}
+
+func (n *nativeInserter) insert(ctx context.Context, model *common.Model, rule, token string, items []common.FlowMessagePayload, reason string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.conn == nil {
+		conn, err := clickhouse.OpenDirect(n.dsn)
+		if err != nil {
+			return errors.Notef(n.cfg.redactError(err), nil, "could not connect")
+		}
+		n.conn = conn
+	}
+
+	// direct connection takes no context, closing it on cancel unblocks the write
+	conn := n.conn
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer func() {
+		if !stop() {
+			n.conn = nil
+		}
+	}()
+
+	if _, err := n.conn.Begin(); err != nil {
+		n.drop()
+		return errors.Notef(err, nil, "could not begin transaction")
+	}
+
+	if _, err := n.conn.Prepare(deduplicated(model.Statement, token)); err != nil {
+		n.drop()
+		return errors.Notef(err, nil, "could not prepare insert statement")
+	}
+
+	block, err := n.conn.Block()
+	if err != nil {
+		n.drop()
+		return errors.Notef(err, nil, "could not get block")
+	}
+
+	row := make([]driver.Value, len(model.Fields))
+	for _, msg := range items {
+		values, err := model.Convert(msg)
+		if err != nil {
+			n.log.Error("cannot convert field", zap.Error(err), zap.String("rule", rule), zap.String("reason", reason))
+			continue
+		}
+
+		for i := range values {
+			row[i] = values[i]
+		}
+
+		if err = block.AppendRow(row); err != nil {
+			if rbErr := n.conn.Rollback(); rbErr != nil {
+				n.log.Error("transaction rollback error", zap.Error(rbErr))
+			}
+			n.drop()
+			return errors.Notef(err, nil, "could not append row")
+		}
+	}
+
+	// commit sends the block
+	if err = n.conn.Commit(); err != nil {
+		n.drop()
+		return errors.Notef(err, nil, "could not commit block")
+	}
+
+	return nil
+}
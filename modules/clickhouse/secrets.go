@@ -0,0 +1,65 @@
+package clickhouse
+
+import (
+	"net/url"
+	"strings"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+const redacted = "******"
+
+// redact password from the text, e.g. from DSN quoted by connection errors
+func (s Settings) redact(text string) string {
+	if s.Password == "" {
+		return text
+	}
+
+	text = strings.Replace(text, s.Password, redacted, -1)
+	return strings.Replace(text, url.QueryEscape(s.Password), redacted, -1)
+}
+
+// redactError keeps error as is, unless its message contains password
+func (s Settings) redactError(err error) error {
+	if err == nil || s.Password == "" {
+		return err
+	}
+
+	if msg := err.Error(); strings.Contains(msg, s.Password) || strings.Contains(msg, url.QueryEscape(s.Password)) {
+		return errors.New(s.redact(msg))
+	}
+	return err
+}
+
+// MarshalLogObject - settings without password for logs
+func (s Settings) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddString("addresses", strings.Join(s.Addresses, ","))
+	enc.AddString("failover", s.Failover)
+	enc.AddString("username", s.Username)
+	if s.Password != "" {
+		enc.AddString("password", redacted)
+	}
+	enc.AddString("password_file", s.PasswordFile)
+	enc.AddString("database", s.Database)
+	enc.AddString("insert", s.Insert)
+	enc.AddString("compression", s.Compression)
+	enc.AddBool("secure", s.Secure)
+	enc.AddString("distributed_table", s.DistributedTable)
+	enc.AddInt("shards", len(s.Sharding.Shards))
+	enc.AddInt("batch_size", s.BatchSize)
+	enc.AddDuration("batch_timeout", s.BatchTimeout)
+	return nil
+}
+
+// debugWriter passes driver debug output to the logger without password
+type debugWriter struct {
+	log *zap.Logger
+	cfg *Settings
+}
+
+func (w *debugWriter) Write(p []byte) (int, error) {
+	w.log.Debug("clickhouse driver", zap.String("message", w.cfg.redact(strings.TrimSpace(string(p)))))
+	return len(p), nil
+}
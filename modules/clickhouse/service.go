@@ -3,8 +3,10 @@ package clickhouse
 import (
 	"context"
 	"database/sql"
-	"errors"
+	"hash/fnv"
+	"net"
 	"net/url"
+	"os"
 	"reflect"
 	"strconv"
 	"strings"
@@ -12,80 +14,215 @@ import (
 	"text/template"
 	"time"
 
-	// Clickhouse driver
-	_ "github.com/ClickHouse/clickhouse-go"
+	"github.com/ClickHouse/clickhouse-go"
 	"github.com/archaron/juniper-natlog/common"
-	"github.com/im-kulikov/helium/service"
+	"github.com/archaron/juniper-natlog/modules/sink"
 	"github.com/spf13/viper"
 	"go.uber.org/dig"
 	"go.uber.org/zap"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+const (
+	// InsertSQL - rows are inserted with prepared statement of database/sql
+	InsertSQL = "sql"
+	// InsertNative - rows are appended into column-oriented block of a direct native connection
+	InsertNative = "native"
+	// InsertHTTP - rows are posted to HTTP interface in HTTPFormat
+	InsertHTTP = "http"
+
+	FormatRowBinary = "RowBinary"
+	FormatNative    = "Native"
+
+	CompressionNone = "none"
+	// CompressionLZ4 - native protocol blocks compression
+	CompressionLZ4 = "lz4"
+	// CompressionGzip and CompressionZstd - HTTP request body compression
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+
+	// FailoverInOrder - the first available address is used
+	FailoverInOrder = "in_order"
+	// FailoverRoundRobin - connections are spread over addresses
+	FailoverRoundRobin = "round_robin"
+
+	tlsConfigName = "natlog"
 )
 
 type (
 	Settings struct {
-		Address   string
-		Username  string
-		Password  string
+		Address string
+		// Addresses - replicas, Address is used when empty
+		Addresses []string
+		// Failover - FailoverInOrder or FailoverRoundRobin over Addresses
+		Failover string
+		Username string
+		Password string
+		// PasswordFile - password is read from the file
+		PasswordFile string
+		// PasswordEnv - password is read from the environment variable
+		PasswordEnv string
 		Database  string
 		FlowTable string
 		Debug     bool
+		// Disabled - do not connect, no clickhouse sink is provided
+		Disabled bool
+		// CreateTables - run model DDL (e.g. from rule presets) on model registration
+		CreateTables bool
+		// Deduplicate - batches are inserted with insert_deduplication_token of the batch id,
+		// so the server skips blocks of a retried batch it accepted before
+		Deduplicate bool
 		BatchSize int
 		BatchTimeout time.Duration
 
+		// Insert - InsertSQL, InsertNative or InsertHTTP
+		Insert      string
+		Compression string
+		// HTTPAddresses - host:port of HTTP interface of replicas, hosts of Addresses and HTTPPort by default
+		HTTPAddresses []string
+		HTTPPort      int
+		// HTTPFormat - FormatRowBinary or FormatNative
+		HTTPFormat string
+
+		// Secure - TLS connections, TLS CA, client certificate and key are optional
+		Secure bool
+		TLS    common.TLSSettings
+
+		// DistributedTable - template of the table rows are inserted into and queried from, e.g. `{{.Table}}_all`,
+		// tables of rules are created on every shard
+		DistributedTable string
+		Sharding         ShardingSettings
+
 		ReadTimeout  int
 		WriteTimeout int
+
+		Batch sink.BatchSettings
+		Retry sink.RetrySettings
+		Queue sink.QueueSettings
 	}
 
+	// ShardingSettings - rows are written directly to shards by hash of the rule Field, each shard is a list of replicas
+	ShardingSettings struct {
+		Field  string
+		Shards [][]string
+	}
+
+	// clickhouseOutParams - the service is started and stopped by the sink registry
 	clickhouseOutParams struct {
 		dig.Out
-		Service    service.Service `group:"services"`
+		Sink       sink.Sink `group:"sinks"`
 		Clickhouse *Service
 	}
 
 	Service struct {
-		con *sql.DB
-		log *zap.Logger
-		cfg *Settings
+		// con - connection of the first shard, used for queries
+		con    *sql.DB
+		log    *zap.Logger
+		cfg    *Settings
+		shards []*shard
 
 		once   sync.Once
 		cancel context.CancelFunc
 
-		pool   chan *common.FlowMessage
-		models map[string]*common.Model
+		batcher *sink.Batcher
+		models  map[string]*common.Model
+		// targets - models of the tables rows are inserted into
+		targets map[string]*common.Model
+
+		// written - shards which accepted rows of batches being retried, by batch id
+		mu      sync.Mutex
+		written map[string]*shardProgress
+	}
+
+	// shardProgress of the batch, retries insert rows of failed shards only
+	shardProgress struct {
+		done  []bool
+		since time.Time
+	}
+
+	shard struct {
+		hosts    []string
+		con      *sql.DB
+		inserter inserter
+	}
+
+	// inserter writes batches of the model into its table
+	inserter interface {
+		insert(ctx context.Context, model *common.Model, rule, token string, items []common.FlowMessagePayload, reason string) error
+		close()
 	}
 )
 
+// Ping every shard, replicas of a shard are tried in failover order
 func (s *Service) Ping() error {
-	return s.con.Ping()
+	for _, sh := range s.shards {
+		if err := sh.con.Ping(); err != nil {
+			return errors.Notef(s.cfg.redactError(err), nil, "shard %s", strings.Join(sh.hosts, ","))
+		}
+	}
+	return nil
+}
+
+// Circuit state of batch inserts
+func (s *Service) Circuit() sink.CircuitState {
+	return s.batcher.Circuit()
+}
+
+// Health - sink health check
+func (s *Service) Health() error {
+	return s.Ping()
 }
 
 func (s *Service) Start(ctx context.Context) error {
 	s.once.Do(func() {
 		ctx, s.cancel = context.WithCancel(ctx)
-		go s.Worker(ctx)
+		go s.batcher.Run(ctx)
 	})
 	return nil
 }
 
-func (s *Service) Stop() error {
+// Stop inserts pending rows and closes connections
+func (s *Service) Stop(ctx context.Context) error {
+	if err := s.batcher.Close(ctx); err != nil {
+		s.log.Error("could not insert pending rows", zap.Error(err))
+	}
 	s.cancel()
-	if s.con != nil {
-		return s.con.Close()
+
+	var lastError error
+	for _, sh := range s.shards {
+		sh.inserter.close()
+		if err := sh.con.Close(); err != nil {
+			lastError = err
+		}
 	}
-	return nil
+	return lastError
 }
 
 func (s *Service) Name() string {
 	return "clickhouse"
 }
 
-func (s Settings) buildDSN() string {
+// buildDSN of replicas, the first one is the host and others are alternative hosts
+func (s Settings) buildDSN(hosts []string) string {
 	u := url.URL{
 		Scheme: "tcp",
-		Host:   s.Address,
+		Host:   hosts[0],
 	}
 
 	q := u.Query()
+	if len(hosts) > 1 {
+		q.Set("alt_hosts", strings.Join(hosts[1:], ","))
+		if s.Failover == FailoverRoundRobin {
+			q.Set("connection_open_strategy", "random")
+		} else {
+			q.Set("connection_open_strategy", "in_order")
+		}
+	}
+	if s.Secure {
+		q.Set("secure", "true")
+		q.Set("tls_config", tlsConfigName)
+		q.Set("skip_verify", strconv.FormatBool(s.TLS.InsecureSkipVerify))
+	}
 	q.Set("username", s.Username)
 	q.Set("password", s.Password)
 	q.Set("database", s.Database)
@@ -94,6 +231,9 @@ func (s Settings) buildDSN() string {
 	if s.Debug {
 		q.Set("debug", "true")
 	}
+	if s.Compression == CompressionLZ4 {
+		q.Set("compress", "true")
+	}
 	u.RawQuery = q.Encode()
 	return u.String()
 }
@@ -115,6 +255,57 @@ func newSettings(v *viper.Viper) (*Settings, error) {
 	v.SetDefault("clickhouse.password", "")
 	cfg.Password = v.GetString("clickhouse.password")
 
+	if cfg.PasswordEnv = v.GetString("clickhouse.password_env"); cfg.PasswordEnv != "" {
+		password, ok := os.LookupEnv(cfg.PasswordEnv)
+		if !ok {
+			return nil, errors.Newf("clickhouse password environment variable %q is not set", cfg.PasswordEnv)
+		}
+		cfg.Password = password
+	}
+
+	if cfg.PasswordFile = v.GetString("clickhouse.password_file"); cfg.PasswordFile != "" {
+		password, err := os.ReadFile(cfg.PasswordFile)
+		if err != nil {
+			return nil, errors.Notef(err, nil, "clickhouse password file")
+		}
+		cfg.Password = strings.TrimSpace(string(password))
+	}
+
+	cfg.Addresses = v.GetStringSlice("clickhouse.addresses")
+	if len(cfg.Addresses) == 0 {
+		cfg.Addresses = []string{cfg.Address}
+	}
+
+	v.SetDefault("clickhouse.failover", FailoverInOrder)
+	if cfg.Failover = v.GetString("clickhouse.failover"); cfg.Failover != FailoverInOrder && cfg.Failover != FailoverRoundRobin {
+		return nil, errors.Newf("unknown failover %q", cfg.Failover)
+	}
+
+	cfg.Secure = v.GetBool("clickhouse.secure")
+	if err := v.UnmarshalKey("clickhouse.tls", &cfg.TLS); err != nil {
+		return nil, errors.Notef(err, nil, "clickhouse tls")
+	}
+
+	cfg.DistributedTable = v.GetString("clickhouse.distributed_table")
+	if err := v.UnmarshalKey("clickhouse.sharding", &cfg.Sharding); err != nil {
+		return nil, errors.Notef(err, nil, "clickhouse sharding")
+	}
+
+	if len(cfg.Sharding.Shards) > 0 && cfg.Sharding.Field == "" {
+		return nil, errors.New("clickhouse sharding: 'field' is required")
+	}
+
+	// Distributed table would shard rows of every shard once again
+	if len(cfg.Sharding.Shards) > 0 && cfg.DistributedTable != "" {
+		return nil, errors.New("clickhouse: only one of 'sharding' and 'distributed_table' can be set")
+	}
+
+	for i, replicas := range cfg.Sharding.Shards {
+		if len(replicas) == 0 {
+			return nil, errors.Newf("clickhouse sharding: shard %d has no replicas", i)
+		}
+	}
+
 	v.SetDefault("clickhouse.batch_size", 10000)
 	cfg.BatchSize = v.GetInt("clickhouse.batch_size")
 
@@ -130,182 +321,340 @@ func newSettings(v *viper.Viper) (*Settings, error) {
 	v.SetDefault("clickhouse.write_timeout", 30)
 	cfg.WriteTimeout = v.GetInt("clickhouse.write_timeout")
 
+	batch, err := sink.NewBatchSettings(v, "clickhouse.batch", cfg.BatchSize, cfg.BatchTimeout)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Batch = batch
+
+	retry, err := sink.NewRetrySettings(v, "clickhouse.retry")
+	if err != nil {
+		return nil, err
+	}
+	cfg.Retry = retry
+
+	if cfg.Queue, err = sink.NewQueueSettings(v, "clickhouse.queue"); err != nil {
+		return nil, err
+	}
+
 	cfg.Debug = v.GetBool("clickhouse.debug")
 
+	cfg.Disabled = v.GetBool("clickhouse.disabled")
+
+	cfg.CreateTables = v.GetBool("clickhouse.create_tables")
+
+	cfg.Deduplicate = v.GetBool("clickhouse.deduplicate")
+
+	v.SetDefault("clickhouse.insert", InsertSQL)
+	cfg.Insert = v.GetString("clickhouse.insert")
+
+	v.SetDefault("clickhouse.compression", CompressionNone)
+	cfg.Compression = v.GetString("clickhouse.compression")
+
+	v.SetDefault("clickhouse.http_format", FormatRowBinary)
+	cfg.HTTPFormat = v.GetString("clickhouse.http_format")
+
+	cfg.HTTPAddresses = v.GetStringSlice("clickhouse.http_addresses")
+	if address := v.GetString("clickhouse.http_address"); address != "" {
+		cfg.HTTPAddresses = append(cfg.HTTPAddresses, address)
+	}
+
+	if cfg.Secure {
+		v.SetDefault("clickhouse.http_port", 8443)
+	} else {
+		v.SetDefault("clickhouse.http_port", 8123)
+	}
+	cfg.HTTPPort = v.GetInt("clickhouse.http_port")
+
+	switch cfg.Insert {
+	case InsertSQL, InsertNative:
+		if cfg.Compression != CompressionNone && cfg.Compression != CompressionLZ4 {
+			return nil, errors.Newf("compression %q is not supported by %s insert, use %s", cfg.Compression, cfg.Insert, CompressionLZ4)
+		}
+	case InsertHTTP:
+		switch cfg.Compression {
+		case CompressionNone, CompressionGzip, CompressionZstd:
+		default:
+			return nil, errors.Newf("compression %q is not supported by %s insert, use %s or %s", cfg.Compression, cfg.Insert, CompressionGzip, CompressionZstd)
+		}
+
+		if cfg.HTTPFormat != FormatRowBinary && cfg.HTTPFormat != FormatNative {
+			return nil, errors.Newf("unknown http format %q", cfg.HTTPFormat)
+		}
+
+		if len(cfg.HTTPAddresses) > 0 && len(cfg.Sharding.Shards) > 0 {
+			return nil, errors.New("http addresses of shards are hosts of shard replicas and 'http_port'")
+		}
+	default:
+		return nil, errors.Newf("unknown insert %q", cfg.Insert)
+	}
+
 	return &cfg, nil
 }
 
 // newService - Create service
 func newService(cfg *Settings, log *zap.Logger) (clickhouseOutParams, error) {
-	var (
-		err error
-		out clickhouseOutParams
-	)
+	var out clickhouseOutParams
+
+	if cfg.Disabled {
+		log.Info("clickhouse disabled")
+		return out, nil
+	}
+
+	if cfg.Debug {
+		clickhouse.SetLogOutput(&debugWriter{log: log, cfg: cfg})
+	}
+	log.Debug("clickhouse settings", zap.Object("settings", cfg))
 
 	ch := &Service{
-		log:    log,
-		cfg:    cfg,
-		models: make(map[string]*common.Model),
-		cancel: func() {},
+		log:     log,
+		cfg:     cfg,
+		models:  make(map[string]*common.Model),
+		targets: make(map[string]*common.Model),
+		written: make(map[string]*shardProgress),
+		cancel:  func() {},
 	}
 
-	ch.con, err = sql.Open("clickhouse", cfg.buildDSN())
-	if err != nil {
-		return out, err
+	if cfg.Secure {
+		tlsConfig, err := cfg.TLS.Config("")
+		if err != nil {
+			return out, errors.Notef(err, nil, "clickhouse tls")
+		}
+
+		if err = clickhouse.RegisterTLSConfig(tlsConfigName, tlsConfig); err != nil {
+			return out, err
+		}
 	}
 
-	if err = ch.con.Ping(); err != nil {
+	shards := cfg.Sharding.Shards
+	if len(shards) == 0 {
+		shards = [][]string{cfg.Addresses}
+	}
+
+	for _, hosts := range shards {
+		sh, err := newShard(cfg, hosts, log)
+		if err != nil {
+			ch.closeShards()
+			return out, errors.Notef(err, nil, "shard %s", strings.Join(hosts, ","))
+		}
+		ch.shards = append(ch.shards, sh)
+	}
+	ch.con = ch.shards[0].con
+
+	ch.batcher = sink.NewBatcher(ch.Name(), log, cfg.BatchSize, cfg.BatchTimeout, ch.insertBatch)
+	ch.batcher.SetLimits(cfg.Batch)
+	ch.batcher.SetRetry(cfg.Retry)
+	if err := ch.batcher.SetQueue(cfg.Queue); err != nil {
+		ch.closeShards()
 		return out, err
 	}
 
-	ch.pool = make(chan *common.FlowMessage, cfg.BatchSize)
 	out.Clickhouse = ch
-	out.Service = ch
+	out.Sink = ch
 
 	log.Info("clickhouse connected")
 
 	return out, nil
 }
 
-func (s *Service) RegisterModel(rule string, model *common.Model) {
+func (s *Service) RegisterModel(rule string, model *common.Model) error {
 	s.log.Debug("register model", zap.String("rule", rule))
 	if err := s.compileSQLTemplate(model); err != nil {
-		s.log.Fatal("cannot compile sql statement", zap.Error(err))
+		return errors.Notef(err, nil, "cannot compile sql statement")
 	}
+
+	target := model
+	if s.cfg.DistributedTable != "" {
+		table, err := distributedTable(s.cfg.DistributedTable, model.Table)
+		if err != nil {
+			return errors.Notef(err, nil, "cannot render distributed table name")
+		}
+
+		target = &common.Model{Table: table, DDL: model.DDL, Fields: model.Fields}
+		if err = s.compileSQLTemplate(target); err != nil {
+			return errors.Notef(err, nil, "cannot compile sql statement")
+		}
+	}
+
+	if s.cfg.CreateTables && model.DDL != "" {
+		if err := s.createTable(model); err != nil {
+			return errors.Notef(err, nil, "cannot create table %q", model.Table)
+		}
+	}
+
 	s.models[rule] = model
+	s.targets[rule] = target
+	s.batcher.Register(rule)
+	return nil
 }
 
 func (s *Service) Insert(message *common.FlowMessage) {
+	s.batcher.Insert(message)
+}
 
-	if s.pool == nil {
-		s.log.Fatal("pool is nil")
-	}
-	s.pool <- message
+// Flush pending batches of all rules
+func (s *Service) Flush(ctx context.Context) error {
+	return s.batcher.Flush(ctx)
 }
 
-func (s *Service) Worker(ctx context.Context) {
-	s.log.Debug("batch", zap.Duration("timeout", s.cfg.BatchTimeout), zap.Int("size", s.cfg.BatchSize))
-	var (
-		done   = make(chan *common.PoolBump, 10)
-		pool   = make(map[string]*common.PoolItem, len(s.models))
-		ticker = time.NewTimer(s.cfg.BatchTimeout)
-	)
+// insertBatch writes rule rows into the shard, or into shards by hash of the sharding field
+func (s *Service) insertBatch(ctx context.Context, rule, batch string, items []common.FlowMessagePayload, reason string) error {
+	model := s.targets[rule]
 
-	for rule := range s.models {
-		pool[rule] = &common.PoolItem{
-			Size:  0,
-			Items: make([]common.FlowMessagePayload, 0, s.cfg.BatchSize),
-			Last: time.Now(),
-		}
+	token := ""
+	if s.cfg.Deduplicate {
+		token = batch
 	}
 
-loop:
-	for {
-		select {
-		case <-ctx.Done():
-			break loop
-		case <-ticker.C:
-			for rule := range pool {
-				if pool[rule].Size > 0  && time.Since(pool[rule].Last) >= s.cfg.BatchTimeout {
-					done <- &common.PoolBump{
-						Reason: "ticker",
-						Rule:   rule,
-					}
-				}
-			}
-			ticker.Reset(s.cfg.BatchTimeout)
-		case msg := <-s.pool:
-			var (
-				ruleItem *common.PoolItem
-				ok bool
-			)
-
-			if ruleItem, ok =pool[msg.Rule]; !ok {
-				s.log.Error("unknown message rule", zap.String("rule", msg.Rule))
-				continue loop
-			}
+	if len(s.shards) == 1 {
+		return classify(s.shards[0].inserter.insert(ctx, model, rule, token, items, reason))
+	}
+
+	// retries skip shards which accepted their rows, after restart spilled batches are inserted into every shard
+	// again and duplicates are dropped by token of the shard, when deduplicated
+	groups := make([][]common.FlowMessagePayload, len(s.shards))
+	for _, item := range items {
+		i := shardIndex(item[s.cfg.Sharding.Field], len(s.shards))
+		groups[i] = append(groups[i], item)
+	}
 
+	progress := s.progress(batch)
 
-			 ruleItem.Items = append(ruleItem.Items, msg.Fields)
-			 ruleItem.Size += len(msg.Fields)
+	var lastError error
+	for i, group := range groups {
+		if len(group) == 0 || progress.done[i] {
+			continue
+		}
 
-			if  ruleItem.Size < s.cfg.BatchSize {
-				continue loop
-			}
-			done <- &common.PoolBump{
-				Reason: "filled",
-				Rule:   msg.Rule,
+		shardToken := token
+		if token != "" {
+			shardToken = token + "-" + strconv.Itoa(i)
+		}
+
+		if err := s.shards[i].inserter.insert(ctx, model, rule, shardToken, group, reason); err != nil {
+			s.log.Error("shard insert failed", zap.Strings("shard", s.shards[i].hosts), zap.Error(err))
+			if lastError == nil || sink.IsPermanent(lastError) {
+				lastError = classify(err)
 			}
+			continue
+		}
+		progress.done[i] = true
+	}
 
-		case bump := <-done:
-			total := 0
-			now := time.Now()
+	// permanently failed batches are not retried
+	if lastError == nil || sink.IsPermanent(lastError) {
+		s.forget(batch)
+	}
 
-			ruleItem := pool[bump.Rule]
+	return lastError
+}
 
+// progress of the batch on shards, batches not retried for a day are forgotten
+func (s *Service) progress(batch string) *shardProgress {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-			if ruleItem.Size == 0 {
-				continue loop
-			}
+	now := time.Now()
+	for id, p := range s.written {
+		if now.Sub(p.since) > 24*time.Hour {
+			delete(s.written, id)
+		}
+	}
 
-			tx, _ := s.con.Begin()
+	p, ok := s.written[batch]
+	if !ok {
+		p = &shardProgress{done: make([]bool, len(s.shards)), since: now}
+		if batch != "" {
+			s.written[batch] = p
+		}
+	}
+	return p
+}
 
-			stmt, err := tx.Prepare(s.models[bump.Rule].Statement)
-			if err != nil {
-				s.log.Error("could not prepare insert statement", zap.Error(err))
-				continue loop
-			}
+func (s *Service) forget(batch string) {
+	s.mu.Lock()
+	delete(s.written, batch)
+	s.mu.Unlock()
+}
 
-			for _, msg := range ruleItem.Items {
-				values := make([]interface{}, 0, len(msg))
-				for _, field := range s.models[bump.Rule].Fields {
-					val, err := field.Convert(msg[field.GetName()])
-					if err != nil {
-						s.log.Error("cannot convert field", zap.Error(err), zap.String("rule", bump.Rule), zap.String("field", field.GetName()), zap.String("reason", bump.Reason))
-						continue
-					}
-					values = append(values, val)
-					total++
-				}
+// sqlInserter writes rows with prepared statement of database/sql in one transaction
+type sqlInserter struct {
+	con *sql.DB
+	log *zap.Logger
+}
 
-				if _, err := stmt.Exec(values...); err != nil {
+func (i *sqlInserter) close() {}
 
-					s.log.Error("could not exec insert statement", zap.Error(err))
-					if err = stmt.Close(); err != nil {
-						s.log.Error("could not close statement", zap.Error(err))
-					}
+func (i *sqlInserter) insert(ctx context.Context, model *common.Model, rule, token string, items []common.FlowMessagePayload, reason string) error {
+	tx, err := i.con.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Notef(err, nil, "could not begin transaction")
+	}
 
-					if err = tx.Rollback(); err != nil {
-						s.log.Error("transaction rollback error", zap.Error(err))
-					}
+	stmt, err := tx.PrepareContext(ctx, deduplicated(model.Statement, token))
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			i.log.Error("transaction rollback error", zap.Error(rbErr))
+		}
+		return errors.Notef(err, nil, "could not prepare insert statement")
+	}
 
-					continue loop
+	for _, msg := range items {
+		values, err := model.Convert(msg)
+		if err != nil {
+			i.log.Error("cannot convert field", zap.Error(err), zap.String("rule", rule), zap.String("reason", reason))
+			continue
+		}
 
-				}
+		if _, err := stmt.ExecContext(ctx, values...); err != nil {
+			if err := stmt.Close(); err != nil {
+				i.log.Error("could not close statement", zap.Error(err))
 			}
 
-			if err := tx.Commit(); err != nil {
-				s.log.Error("could not commit transaction", zap.Error(err))
-				if err = stmt.Close(); err != nil {
-					s.log.Error("could not close statement", zap.Error(err))
-				}
+			if err := tx.Rollback(); err != nil {
+				i.log.Error("transaction rollback error", zap.Error(err))
+			}
 
-				continue loop
+			return errors.Notef(err, nil, "could not exec insert statement")
+		}
+	}
 
-			}
+	if err := tx.Commit(); err != nil {
+		if err := stmt.Close(); err != nil {
+			i.log.Error("could not close statement", zap.Error(err))
+		}
 
-			s.log.Debug("inserted", zap.String("rule",bump.Rule), zap.String("reason", bump.Reason), zap.Int("records", total), zap.Duration("time", time.Since(now)))
+		return errors.Notef(err, nil, "could not commit transaction")
+	}
+
+	return nil
+}
 
-			ruleItem.Items = make([]common.FlowMessagePayload, 0,s.cfg.BatchSize)
-			ruleItem.Size = 0
-			ruleItem.Last = now
+// Attribute looks up the latest rule row covering public address and port
+func (s *Service) Attribute(ctx context.Context, rule string, q *sink.AttributionQuery) (map[string]interface{}, error) {
+	model, ok := s.targets[rule]
+	if !ok {
+		return nil, errors.Newf("rule %q is not stored in clickhouse", rule)
+	}
 
+	statement, args, err := q.Statement(model, nil)
+	if err != nil {
+		return nil, err
+	}
 
+	// driver interpolates arguments, addresses must be quoted strings instead of byte lists
+	for i, arg := range args {
+		if ip, ok := arg.(net.IP); ok {
+			args[i] = ip.String()
 		}
+	}
 
+	rows, err := s.con.QueryContext(ctx, statement, append(args, q.From.Unix(), q.Time.Unix())...)
+	if err != nil {
+		return nil, err
 	}
 
-	ticker.Stop()
+	return sink.ScanRow(model, rows)
 }
 
 type insertData struct {
@@ -328,6 +677,96 @@ func (s *Service) compileSQLTemplate(model *common.Model) error {
 	return nil
 }
 
+func (s *Service) createTable(model *common.Model) error {
+	tpl, err := template.New("ddl").Parse(model.DDL)
+	if err != nil {
+		return err
+	}
+
+	var buf strings.Builder
+	if err = tpl.Execute(&buf, struct{ Table string }{Table: model.Table}); err != nil {
+		return err
+	}
+
+	// local tables are created on every shard
+	for _, sh := range s.shards {
+		if _, err = sh.con.Exec(buf.String()); err != nil {
+			return errors.Notef(err, nil, "shard %s", strings.Join(sh.hosts, ","))
+		}
+	}
+	return nil
+}
+
+func distributedTable(tpl, table string) (string, error) {
+	t, err := template.New("distributed").Parse(tpl)
+	if err != nil {
+		return "", err
+	}
+
+	var buf strings.Builder
+	if err = t.Execute(&buf, struct{ Table string }{Table: table}); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// newShard connects to replicas of the shard
+func newShard(cfg *Settings, hosts []string, log *zap.Logger) (*shard, error) {
+	con, err := sql.Open("clickhouse", cfg.buildDSN(hosts))
+	if err != nil {
+		return nil, cfg.redactError(err)
+	}
+
+	if err = con.Ping(); err != nil {
+		_ = con.Close()
+		return nil, cfg.redactError(err)
+	}
+
+	sh := &shard{hosts: hosts, con: con}
+	switch cfg.Insert {
+	case InsertNative:
+		sh.inserter = &nativeInserter{dsn: cfg.buildDSN(hosts), cfg: cfg, log: log}
+	case InsertHTTP:
+		if sh.inserter, err = newHTTPInserter(cfg, con, cfg.httpAddresses(hosts), log); err != nil {
+			_ = con.Close()
+			return nil, err
+		}
+	default:
+		sh.inserter = &sqlInserter{con: con, log: log}
+	}
+
+	return sh, nil
+}
+
+func (s *Service) closeShards() {
+	for _, sh := range s.shards {
+		_ = sh.con.Close()
+	}
+}
+
+// httpAddresses of HTTP interface of replicas
+func (s Settings) httpAddresses(hosts []string) []string {
+	if len(s.HTTPAddresses) > 0 {
+		return s.HTTPAddresses
+	}
+
+	result := make([]string, 0, len(hosts))
+	for _, h := range hosts {
+		if host, _, err := net.SplitHostPort(h); err == nil {
+			h = host
+		}
+		result = append(result, net.JoinHostPort(h, strconv.Itoa(s.HTTPPort)))
+	}
+	return result
+}
+
+// shardIndex of the sharding field value
+func shardIndex(value string, shards int) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(value))
+	return int(h.Sum32() % uint32(shards))
+}
+
 var insertTemplate, _ = template.New("insertTemplate").Funcs(template.FuncMap{
 	"last": func(x int, a interface{}) bool {
 		return x == reflect.ValueOf(a).Len()-1
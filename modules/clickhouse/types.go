@@ -0,0 +1,234 @@
+package clickhouse
+
+import (
+	"encoding/binary"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+// columnType of a table column, parsed from its ClickHouse type name
+type columnType struct {
+	name string
+	// base - type name without parameters, e.g. FixedString, DateTime64, Enum8
+	base string
+	// size - N of FixedString(N), precision of DateTime64(P)
+	size int
+	// enum - values of Enum8 and Enum16 by name
+	enum     map[string]int64
+	nullable bool
+	// lowCardinality - LowCardinality(T) is written as T in RowBinary, not supported in Native
+	lowCardinality bool
+}
+
+// parseColumnType parses type names like `UInt16`, `Nullable(String)`, `DateTime64(3, 'UTC')`, `Enum8('a' = 1)`
+func parseColumnType(name string) (*columnType, error) {
+	t := &columnType{name: name}
+
+	for {
+		switch {
+		case strings.HasPrefix(name, "Nullable(") && strings.HasSuffix(name, ")"):
+			t.nullable = true
+			name = name[len("Nullable(") : len(name)-1]
+			continue
+		case strings.HasPrefix(name, "LowCardinality(") && strings.HasSuffix(name, ")"):
+			t.lowCardinality = true
+			name = name[len("LowCardinality(") : len(name)-1]
+			continue
+		}
+		break
+	}
+
+	t.base = name
+	var params string
+	if i := strings.IndexByte(name, '('); i > 0 && strings.HasSuffix(name, ")") {
+		t.base, params = name[:i], name[i+1:len(name)-1]
+	}
+
+	// Float32 and Float64 are not supported, model fields convert to integers, strings and addresses only
+	switch t.base {
+	case "UInt8", "UInt16", "UInt32", "UInt64", "Int8", "Int16", "Int32", "Int64", "Bool", "String", "Date", "Date32",
+		"DateTime", "IPv4", "IPv6":
+	case "FixedString", "DateTime64":
+		size := params
+		if i := strings.IndexByte(size, ','); i >= 0 {
+			size = size[:i]
+		}
+
+		n, err := strconv.Atoi(strings.TrimSpace(size))
+		if err != nil {
+			return nil, errors.Newf("type %q: bad parameter", t.name)
+		}
+		t.size = n
+	case "Enum8", "Enum16":
+		t.enum = make(map[string]int64)
+		for _, pair := range strings.Split(params, ",") {
+			i := strings.LastIndexByte(pair, '=')
+			if i < 0 {
+				return nil, errors.Newf("type %q: bad enum value %q", t.name, pair)
+			}
+
+			key := strings.Trim(strings.TrimSpace(pair[:i]), "'")
+			value, err := strconv.ParseInt(strings.TrimSpace(pair[i+1:]), 10, 16)
+			if err != nil {
+				return nil, errors.Newf("type %q: bad enum value %q", t.name, pair)
+			}
+			t.enum[key] = value
+		}
+	default:
+		return nil, errors.Newf("type %q is not supported", t.name)
+	}
+
+	return t, nil
+}
+
+func toInt64(v interface{}) (int64, error) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), nil
+	case int16:
+		return int64(n), nil
+	case int32:
+		return int64(n), nil
+	case int64:
+		return n, nil
+	case uint16:
+		return int64(n), nil
+	case uint32:
+		return int64(n), nil
+	case uint64:
+		return int64(n), nil
+	case string:
+		return strconv.ParseInt(n, 10, 64)
+	case net.IP:
+		if ip4 := n.To4(); ip4 != nil {
+			return int64(binary.BigEndian.Uint32(ip4)), nil
+		}
+	}
+	return 0, errors.Newf("cannot convert %T to integer", v)
+}
+
+func toIP(v interface{}) (net.IP, error) {
+	switch ip := v.(type) {
+	case net.IP:
+		return ip, nil
+	case uint32:
+		result := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(result, ip)
+		return result, nil
+	case string:
+		if result := net.ParseIP(ip); result != nil {
+			return result, nil
+		}
+	}
+	return nil, errors.Newf("cannot convert %T to ip address", v)
+}
+
+// toUnix - timestamps are unix seconds after model conversion
+func toUnix(v interface{}) (int64, error) {
+	if t, ok := v.(time.Time); ok {
+		return t.Unix(), nil
+	}
+	return toInt64(v)
+}
+
+// encode appends value in RowBinary encoding, Nullable values are prefixed with the null flag
+func (t *columnType) encode(buf []byte, v interface{}) ([]byte, error) {
+	if t.nullable {
+		buf = append(buf, 0)
+	}
+	return t.encodeValue(buf, v)
+}
+
+// encodeValue appends value without null flag. Numbers, enums, dates, String, FixedString, IPv4 and IPv6 are encoded
+// the same way in RowBinary rows and Native columns, Native null maps and LowCardinality dictionaries are not.
+func (t *columnType) encodeValue(buf []byte, v interface{}) ([]byte, error) {
+	switch t.base {
+	case "String":
+		var s string
+		switch str := v.(type) {
+		case string:
+			s = str
+		case net.IP:
+			s = str.String()
+		case uint64:
+			s = strconv.FormatUint(str, 10)
+		default:
+			n, err := toInt64(v)
+			if err != nil {
+				return nil, err
+			}
+			s = strconv.FormatInt(n, 10)
+		}
+		buf = binary.AppendUvarint(buf, uint64(len(s)))
+		return append(buf, s...), nil
+	case "FixedString":
+		s, ok := v.(string)
+		if !ok {
+			return nil, errors.Newf("cannot convert %T to string", v)
+		}
+		if len(s) > t.size {
+			return nil, errors.Newf("value %q is too long for %s", s, t.name)
+		}
+		buf = append(buf, s...)
+		return append(buf, make([]byte, t.size-len(s))...), nil
+	case "IPv4":
+		ip, err := toIP(v)
+		if err != nil {
+			return nil, err
+		}
+		ip4 := ip.To4()
+		if ip4 == nil {
+			return nil, errors.Newf("%s is not an IPv4 address", ip)
+		}
+		return binary.LittleEndian.AppendUint32(buf, binary.BigEndian.Uint32(ip4)), nil
+	case "IPv6":
+		ip, err := toIP(v)
+		if err != nil {
+			return nil, err
+		}
+		return append(buf, ip.To16()...), nil
+	case "Date", "Date32", "DateTime", "DateTime64":
+		unix, err := toUnix(v)
+		if err != nil {
+			return nil, err
+		}
+		switch t.base {
+		case "Date":
+			return binary.LittleEndian.AppendUint16(buf, uint16(unix/86400)), nil
+		case "Date32":
+			return binary.LittleEndian.AppendUint32(buf, uint32(int32(unix/86400))), nil
+		case "DateTime":
+			return binary.LittleEndian.AppendUint32(buf, uint32(unix)), nil
+		default:
+			return binary.LittleEndian.AppendUint64(buf, uint64(unix*int64(math.Pow10(t.size)))), nil
+		}
+	}
+
+	var (
+		n   int64
+		err error
+	)
+	if s, ok := v.(string); ok && t.enum != nil {
+		if n, ok = t.enum[s]; !ok {
+			return nil, errors.Newf("value %q is not in %s", s, t.name)
+		}
+	} else if n, err = toInt64(v); err != nil {
+		return nil, err
+	}
+
+	switch t.base {
+	case "UInt8", "Int8", "Enum8", "Bool":
+		return append(buf, byte(n)), nil
+	case "UInt16", "Int16", "Enum16":
+		return binary.LittleEndian.AppendUint16(buf, uint16(n)), nil
+	case "UInt32", "Int32":
+		return binary.LittleEndian.AppendUint32(buf, uint32(n)), nil
+	default:
+		return binary.LittleEndian.AppendUint64(buf, uint64(n)), nil
+	}
+}
@@ -0,0 +1,182 @@
+package clickhouse
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/archaron/juniper-natlog/common"
+)
+
+// unhex decodes hex bytes separated by spaces
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// 2024-03-01 00:00:00 UTC, 19783 days
+const testUnix = int64(1709251200)
+
+func TestEncodeRowBinary(t *testing.T) {
+	long := strings.Repeat("x", 300)
+
+	for _, c := range []struct {
+		typ    string
+		value  interface{}
+		expect string
+	}{
+		{"UInt8", 200, "c8"},
+		{"Int8", int16(-2), "fe"},
+		{"Bool", 1, "01"},
+		{"UInt16", uint16(0x1234), "34 12"},
+		{"Int16", int16(-32768), "00 80"},
+		{"UInt32", uint32(0xdeadbeef), "ef be ad de"},
+		{"Int32", int16(-1), "ff ff ff ff"},
+		{"UInt64", uint64(18446744073709551615), "ff ff ff ff ff ff ff ff"},
+		{"Int64", int64(-2), "fe ff ff ff ff ff ff ff"},
+		{"UInt64", "42", "2a 00 00 00 00 00 00 00"},
+		{"Enum8('ALLOC' = 1, 'RELEASE' = 2)", "RELEASE", "02"},
+		{"Enum8('ALLOC' = 1, 'RELEASE' = 2)", 1, "01"},
+		{"Enum16('a' = 1000, 'b' = -1)", "a", "e8 03"},
+		{"Enum16('a' = 1000, 'b' = -1)", "b", "ff ff"},
+		{"String", "abc", "03 61 62 63"},
+		{"String", "", "00"},
+		{"String", long, "ac 02" + strings.Repeat(" 78", 300)},
+		{"String", uint64(18446744073709551615), "14" + hex.EncodeToString([]byte("18446744073709551615"))},
+		{"String", int16(-5), "02 2d 35"},
+		{"String", net.ParseIP("100.64.0.7"), "0a" + hex.EncodeToString([]byte("100.64.0.7"))},
+		{"FixedString(4)", "ab", "61 62 00 00"},
+		{"FixedString(2)", "ab", "61 62"},
+		{"IPv4", uint32(0xc6336414), "14 64 33 c6"},
+		{"IPv4", net.ParseIP("198.51.100.20"), "14 64 33 c6"},
+		{"IPv4", "198.51.100.20", "14 64 33 c6"},
+		{"IPv6", net.ParseIP("2001:db8::1"), "20 01 0d b8 00 00 00 00 00 00 00 00 00 00 00 01"},
+		{"IPv6", net.ParseIP("100.64.0.7"), "00 00 00 00 00 00 00 00 00 00 ff ff 64 40 00 07"},
+		{"Date", testUnix, "47 4d"},
+		{"Date32", testUnix, "47 4d 00 00"},
+		{"Date32", int64(-86400), "ff ff ff ff"},
+		{"DateTime", testUnix, "80 1a e1 65"},
+		{"DateTime('Europe/Moscow')", testUnix, "80 1a e1 65"},
+		{"DateTime64(3, 'UTC')", testUnix, "00 84 4f f7 8d 01 00 00"},
+		{"DateTime64(0)", testUnix, "80 1a e1 65 00 00 00 00"},
+		{"Nullable(UInt16)", uint16(1), "00 01 00"},
+		{"Nullable(String)", "a", "00 01 61"},
+		{"LowCardinality(String)", "a", "01 61"},
+		{"LowCardinality(Nullable(String))", "a", "00 01 61"},
+	} {
+		column, err := parseColumnType(c.typ)
+		if err != nil {
+			t.Errorf("%s: %v", c.typ, err)
+			continue
+		}
+
+		buf, err := column.encode([]byte{0xaa}, c.value)
+		if err != nil {
+			t.Errorf("%s %#v: %v", c.typ, c.value, err)
+			continue
+		}
+
+		// value is appended to the buffer
+		if expect := append([]byte{0xaa}, unhex(t, c.expect)...); !bytes.Equal(buf, expect) {
+			t.Errorf("%s %#v: % x, expected % x", c.typ, c.value, buf, expect)
+		}
+	}
+}
+
+func TestEncodeRejectsValues(t *testing.T) {
+	for _, c := range []struct {
+		typ   string
+		value interface{}
+	}{
+		{"FixedString(2)", "abc"},
+		{"FixedString(2)", uint16(1)},
+		{"IPv4", net.ParseIP("2001:db8::1")},
+		{"IPv4", "example.com"},
+		{"Enum8('ALLOC' = 1)", "RELEASE"},
+		{"UInt32", "1.5"},
+		{"DateTime", "yesterday"},
+	} {
+		column, err := parseColumnType(c.typ)
+		if err != nil {
+			t.Fatalf("%s: %v", c.typ, err)
+		}
+
+		if buf, err := column.encode(nil, c.value); err == nil {
+			t.Errorf("%s %#v is encoded: % x", c.typ, c.value, buf)
+		}
+	}
+}
+
+func TestParseColumnTypeRejectsUnsupported(t *testing.T) {
+	for _, typ := range []string{
+		"Float32", "Float64", "Nullable(Float64)", "Decimal(9, 2)", "Array(String)", "UUID",
+		"FixedString(n)", "Enum8('a')", "Enum8('a' = x)",
+	} {
+		if _, err := parseColumnType(typ); err == nil {
+			t.Errorf("%s is accepted", typ)
+		}
+	}
+}
+
+func TestEncodeBlocks(t *testing.T) {
+	model := &common.Model{
+		Table: "jnat_log",
+		Fields: []common.ConvertableField{
+			&common.UInt16ModelField{ModelField: common.ModelField{Name: "port"}},
+			&common.StringModelField{ModelField: common.ModelField{Name: "user"}},
+		},
+	}
+
+	var columns []*columnType
+	for _, typ := range []string{"UInt16", "Nullable(String)"} {
+		column, err := parseColumnType(typ)
+		if err != nil {
+			t.Fatal(err)
+		}
+		columns = append(columns, column)
+	}
+
+	rows := [][]interface{}{
+		{uint16(1024), "alice"},
+		{uint16(443), ""},
+	}
+
+	rowBinary, err := encodeRowBinary(columns, rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// rows one after another, every value of a Nullable column is prefixed with its null flag
+	expect := unhex(t, "00 04 00 05 61 6c 69 63 65"+
+		"bb 01 00 00")
+	if !bytes.Equal(rowBinary, expect) {
+		t.Errorf("RowBinary: % x, expected % x", rowBinary, expect)
+	}
+
+	native, err := encodeNative(model, columns, rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 2 columns, 2 rows, then name, type and values of every column, null map of Nullable column before its values
+	expect = unhex(t, "02 02"+
+		"04"+hex.EncodeToString([]byte("port"))+"06"+hex.EncodeToString([]byte("UInt16"))+
+		"00 04 bb 01"+
+		"04"+hex.EncodeToString([]byte("user"))+"10"+hex.EncodeToString([]byte("Nullable(String)"))+
+		"00 00"+
+		"05 61 6c 69 63 65 00")
+	if !bytes.Equal(native, expect) {
+		t.Errorf("Native: % x, expected % x", native, expect)
+	}
+
+	if _, err = encodeNative(model, columns, [][]interface{}{{"port", "alice"}}); err == nil {
+		t.Error("Native block with bad value is encoded")
+	}
+}
@@ -0,0 +1,691 @@
+package sink
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/archaron/juniper-natlog/common"
+	"go.uber.org/zap"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+// abortGrace - time given to a canceled write to return before rows of the batcher are given up
+const abortGrace = 5 * time.Second
+
+type (
+	// WriteFunc writes batch of rule rows, on error rows are kept and retried after backoff with the same batch id,
+	// unless the error is Permanent. Write must return once context is done.
+	WriteFunc func(ctx context.Context, rule, batch string, items []common.FlowMessagePayload, reason string) error
+
+	// batch of rows which failed to be written, frozen to be retried with the same id
+	batch struct {
+		id    string
+		rule  string
+		items []common.FlowMessagePayload
+	}
+
+	// Batcher collects messages per rule and writes them by rows, bytes or age limits, shared by sinks
+	Batcher struct {
+		name   string
+		log    *zap.Logger
+		limits BatchSettings
+		write  WriteFunc
+
+		// rules - limits of registered rules, resolved on Run
+		rules map[string]BatchLimits
+		pool  chan *common.FlowMessage
+		flush chan chan struct{}
+		queue QueueSettings
+		spill *spill
+		seq   *sequence
+
+		// failed batches of rules in order of writes, replaying collects a spilled batch, unwritten - rules with
+		// spilled rows in their pools
+		failed    map[string][]*batch
+		replaying *batch
+		unwritten map[string]bool
+
+		// stop carries deadline of shutdown, done is closed when worker exits
+		stop   chan context.Context
+		done   chan struct{}
+		closed int32
+
+		// writes - context of writes while running, canceled by Close when the deadline is missed
+		writes context.Context
+		abort  context.CancelFunc
+
+		retry RetrySettings
+		timer *time.Timer
+
+		// mu guards failures state, read by Circuit
+		mu       sync.Mutex
+		failures int
+		retryAt  time.Time
+	}
+)
+
+// NewBatcher creates batcher of the sink writing batches of size rows or older than timeout,
+// rules must be registered before Run
+func NewBatcher(name string, log *zap.Logger, size int, timeout time.Duration, write WriteFunc) *Batcher {
+	writes, abort := context.WithCancel(context.Background())
+
+	return &Batcher{
+		name: name,
+		log:  log,
+		limits: BatchSettings{
+			BatchLimits: BatchLimits{
+				MaxRows: size,
+				MaxAge:  timeout,
+			},
+		},
+		write:     write,
+		rules:     make(map[string]BatchLimits),
+		failed:    make(map[string][]*batch),
+		unwritten: make(map[string]bool),
+		pool:      make(chan *common.FlowMessage, size),
+		flush:     make(chan chan struct{}),
+		stop:      make(chan context.Context),
+		done:      make(chan struct{}),
+		writes:    writes,
+		abort:     abort,
+		queue: QueueSettings{
+			Policy:   QueueBlock,
+			Capacity: size,
+		},
+		retry: RetrySettings{
+			MinBackoff: time.Second,
+			MaxBackoff: time.Minute,
+			Threshold:  5,
+		},
+	}
+}
+
+// SetRetry overrides default retry settings, must be called before Run, zero settings keep defaults
+func (b *Batcher) SetRetry(r RetrySettings) {
+	if r.Threshold > 0 {
+		b.retry = r
+	}
+}
+
+// SetLimits overrides batch size and timeout, adds rules overrides, must be called before Run,
+// zero settings keep defaults
+func (b *Batcher) SetLimits(l BatchSettings) {
+	if l.MaxRows > 0 {
+		b.limits = l
+	}
+}
+
+// SetQueue overrides default blocking queue of batch size, must be called before Insert.
+// Rows are spilled to SpillPath, when set, also on shutdown and replayed on start. Sequence of batch ids
+// is kept next to spilled rows, so replayed batches keep their ids.
+func (b *Batcher) SetQueue(q QueueSettings) error {
+	if q.SpillPath != "" {
+		seq, err := openSequence(filepath.Join(q.SpillPath, b.name+".seq"))
+		if err != nil {
+			return errors.Notef(err, nil, "could not open batch sequence")
+		}
+
+		s, err := openSpill(filepath.Join(q.SpillPath, b.name+".jsonl"), b.log)
+		if err != nil {
+			return errors.Notef(err, nil, "could not open spill")
+		}
+		b.seq, b.spill = seq, s
+	}
+
+	b.queue = q
+	b.pool = make(chan *common.FlowMessage, q.Capacity)
+	return nil
+}
+
+// Circuit state of writes
+func (b *Batcher) Circuit() CircuitState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch {
+	case b.failures < b.retry.Threshold:
+		return CircuitClosed
+	case time.Now().Before(b.retryAt):
+		return CircuitOpen
+	default:
+		return CircuitHalfOpen
+	}
+}
+
+// Register rule to batch messages for
+func (b *Batcher) Register(rule string) {
+	b.rules[rule] = BatchLimits{}
+}
+
+// Insert message, when queue is full it blocks, drops or spills messages according to queue policy
+func (b *Batcher) Insert(message *common.FlowMessage) {
+	if atomic.LoadInt32(&b.closed) == 1 {
+		b.log.Error("message inserted after shutdown", zap.String("rule", message.Rule))
+		b.drop(message.Rule, DropShutdown, 1)
+		return
+	}
+
+	switch b.queue.Policy {
+	case QueueDropNewest:
+		select {
+		case b.pool <- message:
+		default:
+			b.drop(message.Rule, DropQueueFull, 1)
+		}
+	case QueueDropOldest:
+		for {
+			select {
+			case b.pool <- message:
+				return
+			default:
+			}
+
+			select {
+			case old := <-b.pool:
+				b.drop(old.Rule, DropQueueFull, 1)
+			default:
+			}
+		}
+	case QueueSpill:
+		select {
+		case b.pool <- message:
+		default:
+			if err := b.spill.write(spilledRow{Rule: message.Rule, Fields: message.Fields}); err != nil {
+				b.log.Error("could not spill message", zap.String("rule", message.Rule), zap.Error(err))
+				b.drop(message.Rule, DropSpillFailed, 1)
+				return
+			}
+			sinkSpilled.WithLabelValues(b.name, message.Rule).Inc()
+		}
+	default:
+		b.pool <- message
+	}
+}
+
+func (b *Batcher) drop(rule, reason string, count int) {
+	sinkDropped.WithLabelValues(b.name, rule, reason).Add(float64(count))
+}
+
+// Flush writes all pending batches, waits for the worker to finish writing
+func (b *Batcher) Flush(ctx context.Context) error {
+	done := make(chan struct{})
+
+	select {
+	case b.flush <- done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close drains the queue, writes pending batches once and spills rows that could not be written, then stops
+// the worker. Writes are canceled when context is done, remaining rows are spilled anyway. Worker gets abortGrace
+// to return from a canceled write, rows left in memory after it are lost.
+func (b *Batcher) Close(ctx context.Context) error {
+	atomic.StoreInt32(&b.closed, 1)
+
+	select {
+	case b.stop <- ctx:
+	case <-b.done:
+		return nil
+	case <-ctx.Done():
+		// worker is busy writing, canceled write lets it take the stop and spill
+		b.abort()
+
+		grace := time.NewTimer(abortGrace)
+		defer grace.Stop()
+
+		select {
+		case b.stop <- ctx:
+		case <-b.done:
+			return nil
+		case <-grace.C:
+			return errors.Notef(ctx.Err(), nil, "canceled write of %s did not return", b.name)
+		}
+	}
+
+	select {
+	case <-b.done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	// shutdown writes are bound to the same context, rows are spilled once they return
+	grace := time.NewTimer(abortGrace)
+	defer grace.Stop()
+
+	select {
+	case <-b.done:
+		return nil
+	case <-grace.C:
+		return errors.Notef(ctx.Err(), nil, "canceled write of %s did not return", b.name)
+	}
+}
+
+// Run worker until context is done or batcher is closed
+func (b *Batcher) Run(ctx context.Context) {
+	defer close(b.done)
+
+	var (
+		pool = make(map[string]*common.PoolItem, len(b.rules))
+		// period - max age of the youngest batches
+		period = b.limits.MaxAge
+	)
+
+	if b.seq == nil {
+		// without spill path ids are unique within the process only
+		b.seq, _ = openSequence("")
+	}
+
+	known := make(map[string]bool, len(b.rules))
+	for rule := range b.rules {
+		known[strings.ToLower(rule)] = true
+	}
+
+	for rule := range b.limits.Rules {
+		if !known[rule] {
+			b.log.Warn("batch limits of unknown rule", zap.String("rule", rule))
+		}
+	}
+
+	for rule := range b.rules {
+		limits := b.limits.Limits(rule)
+		b.log.Debug("batch", zap.String("rule", rule), zap.Int("max_rows", limits.MaxRows),
+			zap.Int("max_bytes", limits.MaxBytes), zap.Duration("max_age", limits.MaxAge))
+
+		b.rules[rule] = limits
+		if limits.MaxAge < period {
+			period = limits.MaxAge
+		}
+
+		pool[rule] = &common.PoolItem{
+			Items: make([]common.FlowMessagePayload, 0, limits.prealloc()),
+		}
+	}
+
+	ticker := time.NewTimer(period)
+
+	b.timer = time.NewTimer(time.Hour)
+	b.timer.Stop()
+
+	var replay <-chan time.Time
+	if b.spill != nil {
+		t := time.NewTicker(time.Second)
+		defer t.Stop()
+		replay = t.C
+	}
+
+loop:
+	for {
+		// rows are left in the queue while a filled batch waits for retry, so queue policy bounds memory
+		in := b.pool
+		if b.saturated(pool) {
+			in = nil
+		}
+
+		select {
+		case <-ctx.Done():
+			break loop
+		case <-ticker.C:
+			for rule := range pool {
+				if pool[rule].Size > 0 && time.Since(pool[rule].Since) >= b.rules[rule].MaxAge {
+					b.bump(b.writes, pool, &common.PoolBump{
+						Reason: "ticker",
+						Rule:   rule,
+					})
+				}
+			}
+			ticker.Reset(period)
+		case <-b.timer.C:
+			for rule := range pool {
+				b.bump(b.writes, pool, &common.PoolBump{
+					Reason: "retry",
+					Rule:   rule,
+				})
+			}
+		case <-replay:
+			b.replay(b.writes, pool)
+		case deadline := <-b.stop:
+			b.shutdown(deadline, pool)
+			break loop
+		case done := <-b.flush:
+			// messages inserted before the flush request must be written too
+			for drained := false; !drained; {
+				select {
+				case msg := <-b.pool:
+					b.append(pool, msg)
+				default:
+					drained = true
+				}
+			}
+
+			for rule := range pool {
+				b.bump(b.writes, pool, &common.PoolBump{
+					Reason: "flush",
+					Rule:   rule,
+				})
+			}
+			close(done)
+		case msg := <-in:
+			if !b.append(pool, msg) {
+				continue loop
+			}
+
+			b.bump(b.writes, pool, &common.PoolBump{
+				Reason: "filled",
+				Rule:   msg.Rule,
+			})
+		}
+	}
+
+	ticker.Stop()
+	b.timer.Stop()
+	b.abort()
+
+	if b.spill != nil {
+		if err := b.spill.close(); err != nil {
+			b.log.Error("could not close spill", zap.Error(err))
+		}
+	}
+}
+
+// shutdown writes everything queued within the deadline unless the circuit is open, rows not written are spilled
+func (b *Batcher) shutdown(ctx context.Context, pool map[string]*common.PoolItem) {
+	for drained := false; !drained; {
+		select {
+		case msg := <-b.pool:
+			b.append(pool, msg)
+		default:
+			drained = true
+		}
+	}
+
+	if b.Circuit() == CircuitOpen {
+		b.log.Warn("circuit breaker open, rows are not written on shutdown")
+	} else {
+		for rule := range pool {
+			if ctx.Err() != nil {
+				break
+			}
+
+			b.bump(ctx, pool, &common.PoolBump{
+				Reason: "shutdown",
+				Rule:   rule,
+			})
+		}
+	}
+
+	if b.replaying != nil {
+		b.failed[b.replaying.rule] = append(b.failed[b.replaying.rule], b.replaying)
+		b.replaying = nil
+	}
+
+	complete := true
+	for rule, ruleItem := range pool {
+		// failed batches keep their ids, rows never written are spilled without id
+		batches := append(b.failed[rule], &batch{rule: rule, items: ruleItem.Items})
+		delete(b.failed, rule)
+
+		rows, spilled := 0, 0
+		for _, current := range batches {
+			rows += len(current.items)
+		}
+
+		if rows == 0 {
+			continue
+		}
+
+		if b.spill != nil {
+			spilled = b.spillBatches(batches)
+			sinkSpilled.WithLabelValues(b.name, rule).Add(float64(spilled))
+		}
+
+		if lost := rows - spilled; lost > 0 {
+			b.log.Error("rows not written on shutdown are lost", zap.String("rule", rule), zap.Int("records", lost))
+			b.drop(rule, DropShutdown, lost)
+			complete = false
+		} else {
+			b.log.Warn("rows not written on shutdown are spilled", zap.String("rule", rule), zap.Int("records", spilled))
+		}
+	}
+
+	// rows read from the replay file are written or spilled again by now, unless spilling failed and the file is
+	// replayed once more on start
+	if b.spill != nil && complete {
+		b.unwritten = make(map[string]bool)
+		b.release()
+	}
+}
+
+// spillBatches writes rows of batches with their ids, returns count of spilled rows
+func (b *Batcher) spillBatches(batches []*batch) int {
+	spilled := 0
+	for _, current := range batches {
+		for _, item := range current.items {
+			if err := b.spill.write(spilledRow{Rule: current.rule, Batch: current.id, Fields: item}); err != nil {
+				b.log.Error("could not spill message", zap.String("rule", current.rule), zap.Error(err))
+				return spilled
+			}
+			spilled++
+		}
+	}
+	return spilled
+}
+
+// replay spilled messages while the queue is not busy and writes do not fail. Rows of a failed batch are
+// collected and written with the batch id, other rows are batched as inserted ones.
+func (b *Batcher) replay(ctx context.Context, pool map[string]*common.PoolItem) {
+	for b.spill.pending() && len(b.pool) < cap(b.pool)/2 && !b.backingOff(time.Now()) {
+		rows, err := b.spill.next(b.queue.Capacity)
+		if err != nil {
+			b.log.Error("could not read spill", zap.Error(err))
+			return
+		}
+
+		for _, row := range rows {
+			if b.replaying != nil && (row.Batch != b.replaying.id || row.Rule != b.replaying.rule) {
+				b.replayed(ctx)
+			}
+
+			if _, ok := pool[row.Rule]; !ok || row.Batch == "" {
+				msg := &common.FlowMessage{Rule: row.Rule, Fields: row.Fields}
+				b.unwritten[row.Rule] = true
+				if b.append(pool, msg) {
+					b.bump(ctx, pool, &common.PoolBump{
+						Reason: "spill",
+						Rule:   msg.Rule,
+					})
+				}
+				continue
+			}
+
+			if b.replaying == nil {
+				b.replaying = &batch{id: row.Batch, rule: row.Rule}
+			}
+			b.replaying.items = append(b.replaying.items, row.Fields)
+		}
+	}
+
+	if b.replaying != nil && !b.spill.pending() {
+		b.replayed(ctx)
+	}
+
+	b.release()
+}
+
+// release removes the replay file read to the end once its rows are written: none is left in pools, failed
+// batches or the collected batch
+func (b *Batcher) release() {
+	if b.replaying != nil || len(b.failed) > 0 || len(b.unwritten) > 0 {
+		return
+	}
+
+	if err := b.spill.done(); err != nil {
+		b.log.Error("could not remove replayed spill", zap.Error(err))
+	}
+}
+
+// replayed queues collected spilled batch to failed ones and writes them unless backing off
+func (b *Batcher) replayed(ctx context.Context) {
+	rule := b.replaying.rule
+	b.failed[rule] = append(b.failed[rule], b.replaying)
+	b.replaying = nil
+
+	if !b.backingOff(time.Now()) {
+		b.writeFailed(ctx, &common.PoolBump{
+			Reason: "spill",
+			Rule:   rule,
+		})
+	}
+}
+
+// append message to its rule pool, reports whether the pool is filled
+func (b *Batcher) append(pool map[string]*common.PoolItem, msg *common.FlowMessage) bool {
+	ruleItem, ok := pool[msg.Rule]
+	if !ok {
+		b.log.Error("unknown message rule", zap.String("rule", msg.Rule))
+		return false
+	}
+
+	if ruleItem.Size == 0 {
+		ruleItem.Since = time.Now()
+	}
+
+	ruleItem.Items = append(ruleItem.Items, msg.Fields)
+	ruleItem.Size++
+	ruleItem.Bytes += payloadBytes(msg.Fields)
+
+	return b.rules[msg.Rule].filled(ruleItem)
+}
+
+// saturated reports whether a filled batch can not be written until backoff expires,
+// a rule has at most one failed batch besides the filled one, unless replayed from spill
+func (b *Batcher) saturated(pool map[string]*common.PoolItem) bool {
+	for rule, ruleItem := range pool {
+		if b.rules[rule].filled(ruleItem) {
+			return b.backingOff(time.Now())
+		}
+	}
+	return false
+}
+
+// bump writes failed batches of the rule, then its pool with a new batch id. Rows of failed write are frozen
+// in a batch to be retried with the same id. Writes other than flush and shutdown are skipped while backing off
+// after failure.
+func (b *Batcher) bump(ctx context.Context, pool map[string]*common.PoolItem, bump *common.PoolBump) {
+	ruleItem := pool[bump.Rule]
+	if ruleItem.Size == 0 && len(b.failed[bump.Rule]) == 0 {
+		return
+	}
+
+	if bump.Reason != "flush" && bump.Reason != "shutdown" && b.backingOff(time.Now()) {
+		return
+	}
+
+	if !b.writeFailed(ctx, bump) || ruleItem.Size == 0 {
+		return
+	}
+
+	id, err := b.seq.id(b.name, bump.Rule)
+	if err != nil {
+		b.log.Error("could not reserve batch sequence", zap.String("path", b.seq.path), zap.Error(err))
+	}
+
+	current := &batch{id: id, rule: bump.Rule, items: ruleItem.Items}
+	delete(b.unwritten, bump.Rule)
+	ruleItem.Items = make([]common.FlowMessagePayload, 0, b.rules[bump.Rule].prealloc())
+	ruleItem.Size = 0
+	ruleItem.Bytes = 0
+
+	if !b.writeBatch(ctx, bump, current) {
+		b.failed[bump.Rule] = append(b.failed[bump.Rule], current)
+	}
+}
+
+// writeFailed writes failed batches of the rule in order, reports whether all of them are done
+func (b *Batcher) writeFailed(ctx context.Context, bump *common.PoolBump) bool {
+	for len(b.failed[bump.Rule]) > 0 {
+		if !b.writeBatch(ctx, bump, b.failed[bump.Rule][0]) {
+			return false
+		}
+		b.failed[bump.Rule] = b.failed[bump.Rule][1:]
+	}
+
+	delete(b.failed, bump.Rule)
+	return true
+}
+
+// writeBatch reports whether the batch is done, written or dropped on permanent error
+func (b *Batcher) writeBatch(ctx context.Context, bump *common.PoolBump, current *batch) bool {
+	now := time.Now()
+	if err := b.write(ctx, bump.Rule, current.id, current.items, bump.Reason); err != nil {
+		if !IsPermanent(err) {
+			b.fail(bump, current, err)
+			return false
+		}
+
+		b.log.Error("could not write batch, dropped on permanent error", zap.String("rule", bump.Rule),
+			zap.String("batch", current.id), zap.String("reason", bump.Reason),
+			zap.Int("records", len(current.items)), zap.Error(err))
+		b.drop(bump.Rule, DropPermanent, len(current.items))
+		return true
+	}
+
+	b.succeed()
+	b.log.Debug("inserted", zap.String("rule", bump.Rule), zap.String("batch", current.id),
+		zap.String("reason", bump.Reason), zap.Int("records", len(current.items)), zap.Duration("time", time.Since(now)))
+	return true
+}
+
+func (b *Batcher) backingOff(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return now.Before(b.retryAt)
+}
+
+// fail schedules retry of pending batches after backoff
+func (b *Batcher) fail(bump *common.PoolBump, current *batch, err error) {
+	b.mu.Lock()
+	b.failures++
+	failures := b.failures
+	delay := b.retry.backoff(failures)
+	b.retryAt = time.Now().Add(delay)
+	b.mu.Unlock()
+
+	if !b.timer.Stop() {
+		select {
+		case <-b.timer.C:
+		default:
+		}
+	}
+	b.timer.Reset(delay)
+
+	b.log.Error("could not write batch", zap.String("rule", bump.Rule), zap.String("batch", current.id),
+		zap.String("reason", bump.Reason), zap.Int("failures", failures), zap.Duration("retry_in", delay), zap.Error(err))
+
+	if failures == b.retry.Threshold {
+		b.log.Warn("circuit breaker open", zap.Int("failures", failures))
+	}
+}
+
+func (b *Batcher) succeed() {
+	b.mu.Lock()
+	failures := b.failures
+	b.failures = 0
+	b.retryAt = time.Time{}
+	b.mu.Unlock()
+
+	if failures >= b.retry.Threshold {
+		b.log.Info("circuit breaker closed", zap.Int("failures", failures))
+	}
+}
@@ -0,0 +1,127 @@
+package file
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// indexName - per rule directory index of closed files, one JSON entry per line
+const indexName = "index.jsonl"
+
+type indexEntry struct {
+	File string    `json:"file"`
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+	// Rows is -1 for files recovered after unclean shutdown
+	Rows      int  `json:"rows"`
+	Recovered bool `json:"recovered,omitempty"`
+}
+
+func appendIndex(dir string, entry indexEntry) error {
+	f, err := os.OpenFile(filepath.Join(dir, indexName), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	if _, err = f.Write(append(data, '\n')); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	if err = f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+func readIndex(dir string) ([]indexEntry, error) {
+	f, err := os.Open(filepath.Join(dir, indexName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []indexEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry indexEntry
+		if err = json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, scanner.Err()
+}
+
+// applyRetention removes files with all rows older than the deadline and rewrites the index
+func applyRetention(dir string, deadline time.Time, log *zap.Logger) error {
+	entries, err := readIndex(dir)
+	if err != nil {
+		return err
+	}
+
+	keep := make([]indexEntry, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.To.Before(deadline) {
+			keep = append(keep, entry)
+			continue
+		}
+
+		if err = os.Remove(filepath.Join(dir, entry.File)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		log.Info("file removed by retention", zap.String("file", entry.File), zap.Time("to", entry.To))
+	}
+
+	if len(keep) == len(entries) {
+		return nil
+	}
+
+	tmp := filepath.Join(dir, indexName+tmpSuffix)
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, entry := range keep {
+		if err = enc.Encode(entry); err != nil {
+			_ = f.Close()
+			return err
+		}
+	}
+
+	if err = w.Flush(); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	if err = f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filepath.Join(dir, indexName))
+}
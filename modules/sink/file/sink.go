@@ -0,0 +1,248 @@
+package file
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/archaron/juniper-natlog/common"
+	"github.com/archaron/juniper-natlog/modules/sink"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+const (
+	FormatJSONLines = "jsonl"
+	FormatCSV       = "csv"
+
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+
+	RotateHourly = "hourly"
+	RotateDaily  = "daily"
+)
+
+type (
+	Settings struct {
+		Path        string
+		Format      string
+		Compression string
+		Rotate      string
+		// Retention - closed files older than that are removed, zero keeps files forever
+		Retention time.Duration
+		// TimeField - rule field used for time ranges in the index
+		TimeField string
+
+		BatchSize    int
+		BatchTimeout time.Duration
+		Batch        sink.BatchSettings
+		Retry        sink.RetrySettings
+		Queue        sink.QueueSettings
+	}
+
+	// Sink writes rows of every rule into its own rotated and compressed files
+	Sink struct {
+		name string
+		log  *zap.Logger
+		cfg  *Settings
+
+		once   sync.Once
+		cancel context.CancelFunc
+
+		batcher *sink.Batcher
+
+		mu      sync.Mutex
+		writers map[string]*writer
+	}
+)
+
+func newSettings(v *viper.Viper) (*Settings, error) {
+	v.SetDefault("format", FormatJSONLines)
+	v.SetDefault("compression", CompressionGzip)
+	v.SetDefault("rotate", RotateHourly)
+	v.SetDefault("time_field", "timestamp")
+	v.SetDefault("batch_size", 10000)
+	v.SetDefault("batch_timeout", 10*time.Second)
+
+	cfg := &Settings{
+		Path:         v.GetString("path"),
+		Format:       v.GetString("format"),
+		Compression:  v.GetString("compression"),
+		Rotate:       v.GetString("rotate"),
+		Retention:    v.GetDuration("retention"),
+		TimeField:    v.GetString("time_field"),
+		BatchSize:    v.GetInt("batch_size"),
+		BatchTimeout: v.GetDuration("batch_timeout"),
+	}
+
+	if cfg.Path == "" {
+		return nil, errors.New("'path' is required")
+	}
+
+	switch cfg.Format {
+	case FormatJSONLines, FormatCSV:
+	default:
+		return nil, errors.Newf("unknown format %q", cfg.Format)
+	}
+
+	switch cfg.Compression {
+	case CompressionNone, CompressionGzip, CompressionZstd:
+	default:
+		return nil, errors.Newf("unknown compression %q", cfg.Compression)
+	}
+
+	switch cfg.Rotate {
+	case RotateHourly, RotateDaily:
+	default:
+		return nil, errors.Newf("unknown rotation %q", cfg.Rotate)
+	}
+
+	batch, err := sink.NewBatchSettings(v, "batch", cfg.BatchSize, cfg.BatchTimeout)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Batch = batch
+
+	retry, err := sink.NewRetrySettings(v, "retry")
+	if err != nil {
+		return nil, err
+	}
+	cfg.Retry = retry
+
+	queue, err := sink.NewQueueSettings(v, "queue")
+	if err != nil {
+		return nil, err
+	}
+	cfg.Queue = queue
+
+	return cfg, nil
+}
+
+func newSink(name string, v *viper.Viper, log *zap.Logger) (sink.Sink, error) {
+	cfg, err := newSettings(v)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = os.MkdirAll(cfg.Path, 0755); err != nil {
+		return nil, err
+	}
+
+	s := &Sink{
+		name:    name,
+		log:     log,
+		cfg:     cfg,
+		cancel:  func() {},
+		writers: make(map[string]*writer),
+	}
+	s.batcher = sink.NewBatcher(name, log, cfg.BatchSize, cfg.BatchTimeout, s.write)
+	s.batcher.SetLimits(cfg.Batch)
+	s.batcher.SetRetry(cfg.Retry)
+	if err = s.batcher.SetQueue(cfg.Queue); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *Sink) Name() string {
+	return s.name
+}
+
+func (s *Sink) RegisterModel(rule string, model *common.Model) error {
+	w, err := newWriter(s.cfg, rule, model, s.log.With(zap.String("rule", rule)))
+	if err != nil {
+		return err
+	}
+
+	s.writers[rule] = w
+	s.batcher.Register(rule)
+	return nil
+}
+
+func (s *Sink) Insert(message *common.FlowMessage) {
+	s.batcher.Insert(message)
+}
+
+func (s *Sink) Flush(ctx context.Context) error {
+	return s.batcher.Flush(ctx)
+}
+
+// Circuit state of batch writes
+func (s *Sink) Circuit() sink.CircuitState {
+	return s.batcher.Circuit()
+}
+
+// Health checks that directory is still writable
+func (s *Sink) Health() error {
+	f, err := os.CreateTemp(s.cfg.Path, ".health")
+	if err != nil {
+		return err
+	}
+
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	return os.Remove(f.Name())
+}
+
+func (s *Sink) Start(ctx context.Context) error {
+	s.once.Do(func() {
+		ctx, s.cancel = context.WithCancel(ctx)
+		go s.batcher.Run(ctx)
+		go s.rotator(ctx)
+	})
+	return nil
+}
+
+// Stop writes pending rows and closes current files
+func (s *Sink) Stop(ctx context.Context) error {
+	if err := s.batcher.Close(ctx); err != nil {
+		s.log.Error("could not write pending rows", zap.Error(err))
+	}
+	s.cancel()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var lastError error
+	for rule, w := range s.writers {
+		if err := w.close(); err != nil {
+			s.log.Error("could not close file", zap.String("rule", rule), zap.Error(err))
+			lastError = err
+		}
+	}
+	return lastError
+}
+
+func (s *Sink) write(_ context.Context, rule, _ string, items []common.FlowMessagePayload, reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.writers[rule].write(items, time.Now())
+}
+
+// rotator closes files of finished periods even when no new rows arrive
+func (s *Sink) rotator(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.mu.Lock()
+			for rule, w := range s.writers {
+				if err := w.rotate(now); err != nil {
+					s.log.Error("could not rotate file", zap.String("rule", rule), zap.Error(err))
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,340 @@
+package file
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/archaron/juniper-natlog/common"
+	"github.com/klauspost/compress/zstd"
+	"go.uber.org/zap"
+)
+
+const tmpSuffix = ".tmp"
+
+type (
+	// writer appends rows of one rule into the file of the current period,
+	// file is written under temporary name and renamed when the period is over
+	writer struct {
+		cfg   *Settings
+		rule  string
+		model *common.Model
+		log   *zap.Logger
+		dir   string
+
+		period    time.Time
+		file      *os.File
+		buf       *bufio.Writer
+		comp      io.WriteCloser
+		csv       *csv.Writer
+		tmp, name string
+
+		rows     int
+		from, to time.Time
+	}
+
+	flusher interface {
+		Flush() error
+	}
+
+	nopCloser struct {
+		io.Writer
+	}
+)
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+func newWriter(cfg *Settings, rule string, model *common.Model, log *zap.Logger) (*writer, error) {
+	w := &writer{
+		cfg:   cfg,
+		rule:  rule,
+		model: model,
+		log:   log,
+		dir:   filepath.Join(cfg.Path, rule),
+	}
+
+	if err := os.MkdirAll(w.dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return w, w.recover()
+}
+
+// recover finalizes files left by unclean shutdown, their last rows may be lost
+func (w *writer) recover() error {
+	tmps, err := filepath.Glob(filepath.Join(w.dir, "*"+tmpSuffix))
+	if err != nil {
+		return err
+	}
+
+	for _, tmp := range tmps {
+		if filepath.Base(tmp) == indexName+tmpSuffix {
+			if err = os.Remove(tmp); err != nil {
+				return err
+			}
+			continue
+		}
+
+		info, err := os.Stat(tmp)
+		if err != nil {
+			return err
+		}
+
+		name := strings.TrimSuffix(tmp, tmpSuffix)
+		if err = os.Rename(tmp, name); err != nil {
+			return err
+		}
+
+		w.log.Warn("recovered unfinished file", zap.String("file", name))
+
+		if err = appendIndex(w.dir, indexEntry{
+			File:      filepath.Base(name),
+			From:      w.periodStart(info.ModTime()),
+			To:        info.ModTime().UTC(),
+			Rows:      -1,
+			Recovered: true,
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (w *writer) periodStart(t time.Time) time.Time {
+	t = t.UTC()
+	if w.cfg.Rotate == RotateDaily {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+	return t.Truncate(time.Hour)
+}
+
+func (w *writer) periodEnd() time.Time {
+	if w.cfg.Rotate == RotateDaily {
+		return w.period.AddDate(0, 0, 1)
+	}
+	return w.period.Add(time.Hour)
+}
+
+func (w *writer) write(items []common.FlowMessagePayload, now time.Time) error {
+	if err := w.rotate(now); err != nil {
+		return err
+	}
+
+	if w.file == nil {
+		if err := w.open(now); err != nil {
+			return err
+		}
+	}
+
+	timeField := -1
+	for i, f := range w.model.Fields {
+		if f.GetName() == w.cfg.TimeField {
+			timeField = i
+		}
+	}
+
+	for _, item := range items {
+		values, err := w.model.Convert(item)
+		if err != nil {
+			w.log.Error("cannot convert field", zap.Error(err))
+			continue
+		}
+
+		if err = w.encode(values); err != nil {
+			return err
+		}
+
+		w.rows++
+
+		ts := now.UTC()
+		if timeField >= 0 {
+			if unix, ok := values[timeField].(int64); ok {
+				ts = time.Unix(unix, 0).UTC()
+			}
+		}
+
+		if w.from.IsZero() || ts.Before(w.from) {
+			w.from = ts
+		}
+
+		if ts.After(w.to) {
+			w.to = ts
+		}
+	}
+
+	if w.csv != nil {
+		w.csv.Flush()
+		if err := w.csv.Error(); err != nil {
+			return err
+		}
+	}
+
+	if f, ok := w.comp.(flusher); ok {
+		if err := f.Flush(); err != nil {
+			return err
+		}
+	}
+
+	return w.buf.Flush()
+}
+
+func (w *writer) encode(values []interface{}) error {
+	if w.csv != nil {
+		record := make([]string, 0, len(values))
+		for _, v := range values {
+			record = append(record, fmt.Sprint(v))
+		}
+		return w.csv.Write(record)
+	}
+
+	row := make(map[string]interface{}, len(values))
+	for i, f := range w.model.Fields {
+		row[f.GetName()] = values[i]
+	}
+
+	data, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+
+	if _, err = w.comp.Write(data); err != nil {
+		return err
+	}
+
+	_, err = w.comp.Write([]byte{'\n'})
+	return err
+}
+
+func (w *writer) open(now time.Time) error {
+	w.period = w.periodStart(now)
+
+	stamp := w.period.Format("20060102T15")
+	if w.cfg.Rotate == RotateDaily {
+		stamp = w.period.Format("20060102")
+	}
+
+	ext := "." + w.cfg.Format
+	switch w.cfg.Compression {
+	case CompressionGzip:
+		ext += ".gz"
+	case CompressionZstd:
+		ext += ".zst"
+	}
+
+	// file of the same period may exist after restart
+	w.name = filepath.Join(w.dir, w.rule+"-"+stamp+ext)
+	for seq := 1; ; seq++ {
+		if _, err := os.Stat(w.name); os.IsNotExist(err) {
+			break
+		}
+		w.name = filepath.Join(w.dir, fmt.Sprintf("%s-%s-%d%s", w.rule, stamp, seq, ext))
+	}
+	w.tmp = w.name + tmpSuffix
+
+	var err error
+	if w.file, err = os.OpenFile(w.tmp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644); err != nil {
+		return err
+	}
+
+	w.buf = bufio.NewWriter(w.file)
+
+	switch w.cfg.Compression {
+	case CompressionGzip:
+		w.comp = gzip.NewWriter(w.buf)
+	case CompressionZstd:
+		if w.comp, err = zstd.NewWriter(w.buf); err != nil {
+			return err
+		}
+	default:
+		w.comp = nopCloser{w.buf}
+	}
+
+	w.rows = 0
+	w.from, w.to = time.Time{}, time.Time{}
+
+	if w.cfg.Format == FormatCSV {
+		w.csv = csv.NewWriter(w.comp)
+
+		header := make([]string, 0, len(w.model.Fields))
+		for _, f := range w.model.Fields {
+			header = append(header, f.GetName())
+		}
+		return w.csv.Write(header)
+	}
+
+	return nil
+}
+
+// rotate closes file of the finished period and applies retention
+func (w *writer) rotate(now time.Time) error {
+	if w.file == nil || w.periodStart(now).Equal(w.period) {
+		return nil
+	}
+
+	if err := w.close(); err != nil {
+		return err
+	}
+
+	if w.cfg.Retention <= 0 {
+		return nil
+	}
+
+	return applyRetention(w.dir, now.Add(-w.cfg.Retention), w.log)
+}
+
+// close finishes compressed stream, renames file to its final name and adds it to the index
+func (w *writer) close() error {
+	if w.file == nil {
+		return nil
+	}
+
+	if w.csv != nil {
+		w.csv.Flush()
+		w.csv = nil
+	}
+
+	if err := w.comp.Close(); err != nil {
+		return err
+	}
+
+	if err := w.buf.Flush(); err != nil {
+		return err
+	}
+
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	w.file = nil
+
+	if err := os.Rename(w.tmp, w.name); err != nil {
+		return err
+	}
+
+	from, to := w.from, w.to
+	if w.rows == 0 {
+		from, to = w.period, w.periodEnd()
+	}
+
+	w.log.Debug("file closed", zap.String("file", w.name), zap.Int("rows", w.rows))
+
+	return appendIndex(w.dir, indexEntry{
+		File: filepath.Base(w.name),
+		From: from,
+		To:   to,
+		Rows: w.rows,
+	})
+}
@@ -0,0 +1,390 @@
+package kafka
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+const produceAttempts = 3
+
+type (
+	// conn to one broker, requests are sent one at a time
+	conn struct {
+		net.Conn
+		rd *bufio.Reader
+	}
+
+	// client is a minimal producer speaking kafka protocol: metadata to find partition leaders
+	// and produce requests with record batches
+	client struct {
+		cfg *Settings
+		log *zap.Logger
+
+		mu          sync.Mutex
+		correlation int32
+		brokers     map[int32]string
+		conns       map[string]*conn
+		// leaders of topic partitions by partition index
+		leaders map[string][]int32
+		// next - round robin partition of messages without key
+		next int
+	}
+
+	// produceResult of one leader request
+	produceResult struct {
+		failed []Message
+		err    error
+	}
+)
+
+func newClient(cfg *Settings, log *zap.Logger) *client {
+	return &client{
+		cfg:     cfg,
+		log:     log,
+		brokers: make(map[int32]string),
+		conns:   make(map[string]*conn),
+		leaders: make(map[string][]int32),
+	}
+}
+
+func (c *client) dial(addr string) (*conn, error) {
+	if cn, ok := c.conns[addr]; ok {
+		return cn, nil
+	}
+
+	nc, err := net.DialTimeout("tcp", addr, c.cfg.DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	cn := &conn{Conn: nc, rd: bufio.NewReader(nc)}
+	c.conns[addr] = cn
+	return cn, nil
+}
+
+func (c *client) drop(addr string) {
+	if cn, ok := c.conns[addr]; ok {
+		_ = cn.Close()
+		delete(c.conns, addr)
+	}
+}
+
+// request sends request and reads its response body, acks=0 produce requests have no response
+func (c *client) request(addr string, api, version int16, body []byte, response bool) ([]byte, error) {
+	cn, err := c.dial(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	c.correlation++
+	correlation := c.correlation
+
+	req := &encoder{}
+	req.int32(0) // size placeholder
+	req.int16(api)
+	req.int16(version)
+	req.int32(correlation)
+	req.string(c.cfg.ClientID)
+	req.buf = append(req.buf, body...)
+	binary.BigEndian.PutUint32(req.buf, uint32(len(req.buf)-4))
+
+	if err = cn.SetDeadline(time.Now().Add(c.cfg.Timeout)); err != nil {
+		c.drop(addr)
+		return nil, err
+	}
+
+	if _, err = cn.Write(req.buf); err != nil {
+		c.drop(addr)
+		return nil, err
+	}
+
+	if !response {
+		return nil, nil
+	}
+
+	var size [4]byte
+	if _, err = io.ReadFull(cn.rd, size[:]); err != nil {
+		c.drop(addr)
+		return nil, err
+	}
+
+	data := make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err = io.ReadFull(cn.rd, data); err != nil {
+		c.drop(addr)
+		return nil, err
+	}
+
+	d := &decoder{buf: data}
+	if got := d.int32(); got != correlation {
+		c.drop(addr)
+		return nil, errors.Newf("unexpected correlation id %d, expected %d", got, correlation)
+	}
+
+	return d.buf, d.err
+}
+
+// refresh metadata of topics from any known broker
+func (c *client) refresh(topics []string) error {
+	body := &encoder{}
+	body.int32(int32(len(topics)))
+	for _, t := range topics {
+		body.string(t)
+	}
+
+	addrs := make([]string, 0, len(c.cfg.Brokers)+len(c.brokers))
+	for _, addr := range c.brokers {
+		addrs = append(addrs, addr)
+	}
+	addrs = append(addrs, c.cfg.Brokers...)
+
+	var lastError error
+	for _, addr := range addrs {
+		data, err := c.request(addr, apiMetadata, metadataVersion, body.buf, true)
+		if err != nil {
+			lastError = err
+			continue
+		}
+		return c.parseMetadata(data)
+	}
+
+	return errors.Notef(lastError, nil, "no broker available")
+}
+
+func (c *client) parseMetadata(data []byte) error {
+	d := &decoder{buf: data}
+
+	for i, n := 0, d.array(); i < n; i++ {
+		id := d.int32()
+		host := d.string()
+		port := d.int32()
+		_ = d.string() // rack
+		c.brokers[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+
+	_ = d.int32() // controller
+
+	var lastError error
+	for i, n := 0, d.array(); i < n; i++ {
+		code := d.int16()
+		topic := d.string()
+		_ = d.int8() // internal
+
+		var leaders []int32
+		for j, m := 0, d.array(); j < m; j++ {
+			_ = d.int16() // partition error
+			index := d.int32()
+			leader := d.int32()
+			for k, r := 0, d.array(); k < r; k++ {
+				_ = d.int32() // replica
+			}
+			for k, r := 0, d.array(); k < r; k++ {
+				_ = d.int32() // isr
+			}
+
+			for int(index) >= len(leaders) {
+				leaders = append(leaders, -1)
+			}
+			leaders[index] = leader
+		}
+
+		if code != errNone || len(leaders) == 0 {
+			delete(c.leaders, topic)
+			lastError = errors.Newf("topic %q metadata error %d", topic, code)
+			continue
+		}
+		c.leaders[topic] = leaders
+	}
+
+	if d.err != nil {
+		return d.err
+	}
+
+	return lastError
+}
+
+// Produce sends messages to partition leaders, keyed messages are partitioned like the java client does,
+// returns messages not acknowledged after retries
+func (c *client) Produce(ctx context.Context, messages []Message) ([]Message, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	pending := messages
+	var lastError error
+	for attempt := 0; attempt < produceAttempts && len(pending) > 0; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return pending, ctx.Err()
+			case <-time.After(time.Duration(attempt) * 100 * time.Millisecond):
+			}
+		}
+
+		if err := c.ensure(pending, attempt > 0); err != nil {
+			lastError = err
+			continue
+		}
+
+		pending, lastError = c.produce(pending)
+	}
+
+	return pending, lastError
+}
+
+// ensure metadata of message topics is known
+func (c *client) ensure(messages []Message, force bool) error {
+	var topics []string
+	seen := make(map[string]bool)
+	for _, m := range messages {
+		if seen[m.Topic] {
+			continue
+		}
+		seen[m.Topic] = true
+
+		if _, ok := c.leaders[m.Topic]; !ok || force {
+			topics = append(topics, m.Topic)
+		}
+	}
+
+	if len(topics) == 0 {
+		return nil
+	}
+
+	return c.refresh(topics)
+}
+
+func (c *client) produce(messages []Message) ([]Message, error) {
+	// leader -> topic -> partition -> messages
+	var (
+		groups    = make(map[int32]map[string]map[int32][]Message)
+		failed    []Message
+		lastError error
+	)
+	for _, m := range messages {
+		leaders := c.leaders[m.Topic]
+		if len(leaders) == 0 {
+			failed = append(failed, m)
+			lastError = errors.Newf("topic %q has no partitions", m.Topic)
+			continue
+		}
+
+		var p int
+		if m.Key != nil {
+			p = partition(m.Key, len(leaders))
+		} else {
+			p = c.next % len(leaders)
+			c.next++
+		}
+
+		leader := leaders[p]
+		if groups[leader] == nil {
+			groups[leader] = make(map[string]map[int32][]Message)
+		}
+		if groups[leader][m.Topic] == nil {
+			groups[leader][m.Topic] = make(map[int32][]Message)
+		}
+		groups[leader][m.Topic][int32(p)] = append(groups[leader][m.Topic][int32(p)], m)
+	}
+
+	for leader, topics := range groups {
+		res := c.produceLeader(leader, topics)
+		if res.err != nil {
+			lastError = res.err
+			failed = append(failed, res.failed...)
+		}
+	}
+
+	return failed, lastError
+}
+
+func (c *client) produceLeader(leader int32, topics map[string]map[int32][]Message) produceResult {
+	all := func() []Message {
+		var result []Message
+		for _, partitions := range topics {
+			for _, msgs := range partitions {
+				result = append(result, msgs...)
+			}
+		}
+		return result
+	}
+
+	addr, ok := c.brokers[leader]
+	if !ok {
+		return produceResult{failed: all(), err: errors.Newf("leader %d is not available", leader)}
+	}
+
+	body := &encoder{}
+	body.nullString() // transactional id
+	body.int16(c.cfg.acks())
+	body.int32(int32(c.cfg.Timeout.Milliseconds()))
+	body.int32(int32(len(topics)))
+	for topic, partitions := range topics {
+		body.string(topic)
+		body.int32(int32(len(partitions)))
+		for p, msgs := range partitions {
+			batch, err := recordBatch(msgs, c.cfg.Compression)
+			if err != nil {
+				return produceResult{failed: all(), err: err}
+			}
+			body.int32(p)
+			body.bytes(batch)
+		}
+	}
+
+	data, err := c.request(addr, apiProduce, produceVersion, body.buf, c.cfg.acks() != 0)
+	if err != nil {
+		return produceResult{failed: all(), err: err}
+	}
+
+	if c.cfg.acks() == 0 {
+		return produceResult{}
+	}
+
+	var result produceResult
+	d := &decoder{buf: data}
+	for i, n := 0, d.array(); i < n; i++ {
+		topic := d.string()
+		for j, m := 0, d.array(); j < m; j++ {
+			p := d.int32()
+			code := d.int16()
+			_ = d.int64() // base offset
+			_ = d.int64() // log append time
+
+			if code == errNone || d.err != nil {
+				continue
+			}
+
+			if retriable(code) {
+				delete(c.leaders, topic)
+			}
+
+			result.failed = append(result.failed, topics[topic][p]...)
+			result.err = errors.Newf("topic %q partition %d: produce error %d", topic, p, code)
+		}
+	}
+
+	if d.err != nil {
+		return produceResult{failed: all(), err: d.err}
+	}
+
+	return result
+}
+
+// Close connections to all brokers
+func (c *client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for addr := range c.conns {
+		c.drop(addr)
+	}
+	return nil
+}
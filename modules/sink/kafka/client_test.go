@@ -0,0 +1,332 @@
+package kafka
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// fakeBroker is a single kafka broker answering metadata and produce requests of the client,
+// topics have the given number of partitions led by the broker
+type fakeBroker struct {
+	t          *testing.T
+	ln         net.Listener
+	partitions int
+
+	mu sync.Mutex
+	// failures - produce error codes returned before accepting batches
+	failures  []int16
+	metadata  int
+	published map[string]map[int32][]Message
+}
+
+func newFakeBroker(t *testing.T, partitions int) *fakeBroker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &fakeBroker{t: t, ln: ln, partitions: partitions, published: make(map[string]map[int32][]Message)}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(c)
+		}
+	}()
+
+	return b
+}
+
+func (b *fakeBroker) addr() string {
+	return b.ln.Addr().String()
+}
+
+func (b *fakeBroker) serve(c net.Conn) {
+	defer c.Close()
+
+	rd := bufio.NewReader(c)
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(rd, size[:]); err != nil {
+			return
+		}
+
+		data := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(rd, data); err != nil {
+			return
+		}
+
+		d := &decoder{buf: data}
+		api := d.int16()
+		_ = d.int16() // version
+		correlation := d.int32()
+		_ = d.string() // client id
+
+		resp := &encoder{}
+		resp.int32(0) // size placeholder
+		resp.int32(correlation)
+
+		switch api {
+		case apiMetadata:
+			b.metadataResponse(d, resp)
+		case apiProduce:
+			b.produce(d, resp)
+		default:
+			b.t.Errorf("unexpected api %d", api)
+			return
+		}
+
+		if d.err != nil {
+			b.t.Errorf("malformed request: %v", d.err)
+			return
+		}
+
+		binary.BigEndian.PutUint32(resp.buf, uint32(len(resp.buf)-4))
+		if _, err := c.Write(resp.buf); err != nil {
+			return
+		}
+	}
+}
+
+func (b *fakeBroker) metadataResponse(d *decoder, resp *encoder) {
+	b.mu.Lock()
+	b.metadata++
+	b.mu.Unlock()
+
+	var topics []string
+	for i, n := 0, d.array(); i < n; i++ {
+		topics = append(topics, d.string())
+	}
+
+	host, port, _ := net.SplitHostPort(b.addr())
+	portNum, _ := strconv.Atoi(port)
+
+	resp.int32(1) // brokers
+	resp.int32(1)
+	resp.string(host)
+	resp.int32(int32(portNum))
+	resp.nullString() // rack
+	resp.int32(1)     // controller
+
+	resp.int32(int32(len(topics)))
+	for _, topic := range topics {
+		resp.int16(errNone)
+		resp.string(topic)
+		resp.int8(0) // internal
+		resp.int32(int32(b.partitions))
+		for p := 0; p < b.partitions; p++ {
+			resp.int16(errNone)
+			resp.int32(int32(p))
+			resp.int32(1) // leader
+			resp.int32(1) // replicas
+			resp.int32(1)
+			resp.int32(1) // isr
+			resp.int32(1)
+		}
+	}
+}
+
+func (b *fakeBroker) produce(d *decoder, resp *encoder) {
+	_ = d.string() // transactional id
+	_ = d.int16()  // acks
+	_ = d.int32()  // timeout
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var code int16
+	if len(b.failures) > 0 {
+		code, b.failures = b.failures[0], b.failures[1:]
+	}
+
+	topics := d.array()
+	resp.int32(int32(topics))
+	for i := 0; i < topics; i++ {
+		topic := d.string()
+		resp.string(topic)
+
+		partitions := d.array()
+		resp.int32(int32(partitions))
+		for j := 0; j < partitions; j++ {
+			p := d.int32()
+			batch := d.take(int(d.int32()))
+
+			resp.int32(p)
+			resp.int16(code)
+			resp.int64(0)  // base offset
+			resp.int64(-1) // log append time
+
+			if code != errNone {
+				continue
+			}
+
+			if b.published[topic] == nil {
+				b.published[topic] = make(map[int32][]Message)
+			}
+			b.published[topic][p] = append(b.published[topic][p], b.records(topic, batch)...)
+		}
+	}
+	resp.int32(0) // throttle time
+}
+
+// records of uncompressed record batch v2
+func (b *fakeBroker) records(topic string, batch []byte) []Message {
+	d := &decoder{buf: batch}
+	_ = d.int64() // base offset
+	_ = d.int32() // length
+	_ = d.int32() // leader epoch
+	if magic := d.int8(); magic != recordBatchMagic {
+		b.t.Errorf("record batch magic %d", magic)
+	}
+	_ = d.int32() // crc
+	_ = d.int16() // attributes
+	_ = d.int32() // last offset delta
+	first := d.int64()
+	_ = d.int64() // max timestamp
+	_ = d.int64() // producer id
+	_ = d.int16() // producer epoch
+	_ = d.int32() // base sequence
+	count := int(d.int32())
+
+	// records are varint encoded, read with the decoder to keep bounds checks
+	varint := func() int64 {
+		v, n := binary.Varint(d.buf)
+		if n <= 0 {
+			d.err = io.ErrUnexpectedEOF
+			return 0
+		}
+		d.take(n)
+		return v
+	}
+	varBytes := func() []byte {
+		n := varint()
+		if n < 0 {
+			return nil
+		}
+		return d.take(int(n))
+	}
+
+	messages := make([]Message, 0, count)
+	for i := 0; i < count && d.err == nil; i++ {
+		_ = varint() // length
+		_ = d.int8() // attributes
+		delta := varint()
+		_ = varint() // offset delta
+		m := Message{Topic: topic, Key: varBytes(), Value: varBytes()}
+		m.Time = time.Unix(0, (first+delta)*int64(time.Millisecond))
+		_ = varint() // headers
+		messages = append(messages, m)
+	}
+
+	if d.err != nil {
+		b.t.Errorf("malformed record batch: %v", d.err)
+	}
+
+	return messages
+}
+
+func (b *fakeBroker) partition(topic string, p int32) []Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.published[topic][p]
+}
+
+func testClient(brokers ...string) *client {
+	return newClient(&Settings{
+		Brokers:     brokers,
+		ClientID:    "natlog-test",
+		Acks:        AcksAll,
+		Compression: CompressionNone,
+		Timeout:     time.Second,
+		DialTimeout: time.Second,
+	}, zap.NewNop())
+}
+
+func TestClientProducesToPartitionOfKey(t *testing.T) {
+	broker := newFakeBroker(t, 3)
+	c := testClient(broker.addr())
+	defer c.Close()
+
+	now := time.Now().Truncate(time.Millisecond)
+	messages := []Message{
+		{Topic: "natlog.JNat", Key: []byte("198.51.100.20"), Value: []byte(`{"a":1}`), Time: now},
+		{Topic: "natlog.JNat", Key: []byte("198.51.100.20"), Value: []byte(`{"a":2}`), Time: now.Add(time.Second)},
+		{Topic: "natlog.JNat", Key: []byte("203.0.113.9"), Value: []byte(`{"a":3}`), Time: now},
+	}
+
+	failed, err := c.Produce(context.Background(), messages)
+	if err != nil || len(failed) != 0 {
+		t.Fatalf("%d messages failed: %v", len(failed), err)
+	}
+
+	for _, m := range messages {
+		p := int32(partition(m.Key, 3))
+		var found bool
+		for _, got := range broker.partition(m.Topic, p) {
+			if string(got.Value) == string(m.Value) {
+				found = true
+				if string(got.Key) != string(m.Key) || !got.Time.Equal(m.Time) {
+					t.Errorf("message %s: key %q time %v", m.Value, got.Key, got.Time)
+				}
+			}
+		}
+		if !found {
+			t.Errorf("message %s is not in partition %d of its key", m.Value, p)
+		}
+	}
+}
+
+func TestClientRetriesRetriableErrors(t *testing.T) {
+	broker := newFakeBroker(t, 1)
+	broker.failures = []int16{errNotLeader}
+
+	c := testClient(broker.addr())
+	defer c.Close()
+
+	messages := []Message{{Topic: "natlog.JNat", Value: []byte("1"), Time: time.Now()}}
+	failed, err := c.Produce(context.Background(), messages)
+	if err != nil || len(failed) != 0 {
+		t.Fatalf("%d messages failed: %v", len(failed), err)
+	}
+
+	if n := len(broker.partition("natlog.JNat", 0)); n != 1 {
+		t.Fatalf("%d messages published, expected 1", n)
+	}
+
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	if broker.metadata != 2 {
+		t.Errorf("metadata requested %d times, expected refresh after not leader error", broker.metadata)
+	}
+}
+
+func TestClientReturnsMessagesOfUnavailableBrokers(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	_ = ln.Close()
+
+	c := testClient(addr)
+	defer c.Close()
+
+	messages := []Message{{Topic: "natlog.JNat", Value: []byte("1"), Time: time.Now()}}
+	failed, err := c.Produce(context.Background(), messages)
+	if err == nil || len(failed) != 1 {
+		t.Fatalf("%d messages failed: %v", len(failed), err)
+	}
+}
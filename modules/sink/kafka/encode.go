@@ -0,0 +1,122 @@
+package kafka
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"regexp"
+	"time"
+
+	"github.com/archaron/juniper-natlog/common"
+	"github.com/linkedin/goavro/v2"
+)
+
+type (
+	// encoder of converted rows into message values
+	valueEncoder interface {
+		Encode(values []interface{}) ([]byte, error)
+	}
+
+	jsonEncoder struct {
+		model *common.Model
+	}
+
+	// avroEncoder writes avro single object encoding: marker, schema fingerprint and binary datum
+	avroEncoder struct {
+		model *common.Model
+		codec *goavro.Codec
+	}
+)
+
+// readable converts addresses and timestamps of the row for consumers
+func readable(f common.ConvertableField, v interface{}) interface{} {
+	switch f.(type) {
+	case *common.IpToIntModelField:
+		if n, ok := v.(uint32); ok {
+			ip := make(net.IP, net.IPv4len)
+			binary.BigEndian.PutUint32(ip, n)
+			return ip.String()
+		}
+	case *common.IpModelField:
+		if ip, ok := v.(net.IP); ok {
+			return ip.String()
+		}
+	case *common.TimestampModelField:
+		if unix, ok := v.(int64); ok {
+			return time.Unix(unix, 0).UTC()
+		}
+	}
+	return v
+}
+
+func (e *jsonEncoder) Encode(values []interface{}) ([]byte, error) {
+	row := make(map[string]interface{}, len(values))
+	for i, f := range e.model.Fields {
+		row[f.GetName()] = readable(f, values[i])
+	}
+	return json.Marshal(row)
+}
+
+var avroName = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// avroType of model field, addresses are strings and timestamps timestamp-millis
+func avroType(f common.ConvertableField) interface{} {
+	switch f.(type) {
+	case *common.TimestampModelField:
+		return map[string]string{"type": "long", "logicalType": "timestamp-millis"}
+	case *common.IpToIntModelField, *common.IpModelField, *common.StringModelField:
+		return "string"
+	case *common.UInt32ModelField, *common.UInt64ModelField:
+		return "long"
+	default:
+		return "int"
+	}
+}
+
+func newAvroEncoder(rule string, model *common.Model) (*avroEncoder, string, error) {
+	fields := make([]map[string]interface{}, 0, len(model.Fields))
+	for _, f := range model.Fields {
+		fields = append(fields, map[string]interface{}{
+			"name": avroName.ReplaceAllString(f.GetName(), "_"),
+			"type": avroType(f),
+		})
+	}
+
+	schema, err := json.Marshal(map[string]interface{}{
+		"type":      "record",
+		"name":      avroName.ReplaceAllString(rule, "_"),
+		"namespace": "natlog",
+		"fields":    fields,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	codec, err := goavro.NewCodec(string(schema))
+	if err != nil {
+		return nil, "", err
+	}
+
+	return &avroEncoder{model: model, codec: codec}, codec.CanonicalSchema(), nil
+}
+
+func (e *avroEncoder) Encode(values []interface{}) ([]byte, error) {
+	record := make(map[string]interface{}, len(values))
+	for i, f := range e.model.Fields {
+		v := readable(f, values[i])
+		switch n := v.(type) {
+		case uint64:
+			v = int64(n)
+		case uint32:
+			v = int64(n)
+		case uint16:
+			v = int32(n)
+		case int16:
+			v = int32(n)
+		case int:
+			v = int32(n)
+		}
+		record[avroName.ReplaceAllString(f.GetName(), "_")] = v
+	}
+	return e.codec.SingleFromNative(nil, record)
+}
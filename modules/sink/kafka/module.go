@@ -0,0 +1,20 @@
+package kafka
+
+import (
+	"github.com/archaron/juniper-natlog/modules/sink"
+	"github.com/im-kulikov/helium/module"
+)
+
+// Module application
+var Module = module.Module{
+	{Constructor: newFactory},
+}
+
+func newFactory() sink.FactoryOut {
+	return sink.FactoryOut{
+		Factory: sink.Factory{
+			Type: "kafka",
+			New:  newSink,
+		},
+	}
+}
@@ -0,0 +1,269 @@
+package kafka
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"hash/crc32"
+	"time"
+
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+// kafka api keys and versions used by the client
+const (
+	apiProduce  = 0
+	apiMetadata = 3
+
+	produceVersion  = 3
+	metadataVersion = 1
+
+	recordBatchMagic = 2
+	codecGzip        = 1
+)
+
+// kafka error codes, retriable ones make client refresh metadata and retry
+const (
+	errNone                 = 0
+	errUnknownTopic         = 3
+	errLeaderNotAvailable   = 5
+	errNotLeader            = 6
+	errRequestTimedOut      = 7
+	errNetwork              = 13
+	errNotEnoughReplicas    = 19
+	errNotEnoughReplicasAck = 20
+)
+
+func retriable(code int16) bool {
+	switch code {
+	case errUnknownTopic, errLeaderNotAvailable, errNotLeader, errRequestTimedOut,
+		errNetwork, errNotEnoughReplicas, errNotEnoughReplicasAck:
+		return true
+	}
+	return false
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// encoder of kafka protocol primitives
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) int8(v int8) {
+	e.buf = append(e.buf, byte(v))
+}
+
+func (e *encoder) int16(v int16) {
+	e.buf = binary.BigEndian.AppendUint16(e.buf, uint16(v))
+}
+
+func (e *encoder) int32(v int32) {
+	e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(v))
+}
+
+func (e *encoder) int64(v int64) {
+	e.buf = binary.BigEndian.AppendUint64(e.buf, uint64(v))
+}
+
+func (e *encoder) varint(v int64) {
+	e.buf = binary.AppendVarint(e.buf, v)
+}
+
+func (e *encoder) string(v string) {
+	e.int16(int16(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+func (e *encoder) nullString() {
+	e.int16(-1)
+}
+
+func (e *encoder) bytes(v []byte) {
+	e.int32(int32(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+// varBytes - record key or value, nil is encoded as null
+func (e *encoder) varBytes(v []byte) {
+	if v == nil {
+		e.varint(-1)
+		return
+	}
+	e.varint(int64(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+// decoder of kafka protocol primitives, the first error sticks
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.buf) {
+		d.err = errors.New("malformed response")
+		return nil
+	}
+	v := d.buf[:n]
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) int8() int8 {
+	if v := d.take(1); v != nil {
+		return int8(v[0])
+	}
+	return 0
+}
+
+func (d *decoder) int16() int16 {
+	if v := d.take(2); v != nil {
+		return int16(binary.BigEndian.Uint16(v))
+	}
+	return 0
+}
+
+func (d *decoder) int32() int32 {
+	if v := d.take(4); v != nil {
+		return int32(binary.BigEndian.Uint32(v))
+	}
+	return 0
+}
+
+func (d *decoder) int64() int64 {
+	if v := d.take(8); v != nil {
+		return int64(binary.BigEndian.Uint64(v))
+	}
+	return 0
+}
+
+func (d *decoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.take(int(n)))
+}
+
+func (d *decoder) array() int {
+	n := int(d.int32())
+	if n < 0 {
+		return 0
+	}
+	if n > len(d.buf) {
+		d.err = errors.New("malformed response")
+		return 0
+	}
+	return n
+}
+
+// recordBatch encodes messages of one partition as record batch v2
+func recordBatch(messages []Message, compression string) ([]byte, error) {
+	first, last := messages[0].Time, messages[0].Time
+	for _, m := range messages {
+		if m.Time.Before(first) {
+			first = m.Time
+		}
+		if m.Time.After(last) {
+			last = m.Time
+		}
+	}
+
+	records := &encoder{}
+	for i, m := range messages {
+		record := &encoder{}
+		record.int8(0) // attributes
+		record.varint(m.Time.Sub(first).Milliseconds())
+		record.varint(int64(i))
+		record.varBytes(m.Key)
+		record.varBytes(m.Value)
+		record.varint(0) // headers
+
+		records.varint(int64(len(record.buf)))
+		records.buf = append(records.buf, record.buf...)
+	}
+
+	var attributes int16
+	if compression == CompressionGzip {
+		var out bytes.Buffer
+		gz := gzip.NewWriter(&out)
+		if _, err := gz.Write(records.buf); err != nil {
+			return nil, err
+		}
+		if err := gz.Close(); err != nil {
+			return nil, err
+		}
+		records.buf = out.Bytes()
+		attributes = codecGzip
+	}
+
+	// crc covers everything from attributes to the end
+	body := &encoder{}
+	body.int16(attributes)
+	body.int32(int32(len(messages) - 1))
+	body.int64(first.UnixNano() / int64(time.Millisecond))
+	body.int64(last.UnixNano() / int64(time.Millisecond))
+	body.int64(-1) // producer id
+	body.int16(-1) // producer epoch
+	body.int32(-1) // base sequence
+	body.int32(int32(len(messages)))
+	body.buf = append(body.buf, records.buf...)
+
+	batch := &encoder{}
+	batch.int64(0) // base offset
+	batch.int32(int32(4 + 1 + 4 + len(body.buf)))
+	batch.int32(-1) // partition leader epoch
+	batch.int8(recordBatchMagic)
+	batch.int32(int32(crc32.Checksum(body.buf, castagnoli)))
+	batch.buf = append(batch.buf, body.buf...)
+
+	return batch.buf, nil
+}
+
+// murmur2 - hash of the java client default partitioner, keeps partitions of keys compatible
+func murmur2(data []byte) int32 {
+	const (
+		seed = 0x9747b28c
+		m    = 0x5bd1e995
+		r    = 24
+	)
+
+	length := len(data)
+	h := uint32(seed) ^ uint32(length)
+
+	for i := 0; i+4 <= length; i += 4 {
+		k := binary.LittleEndian.Uint32(data[i:])
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+
+	tail := length &^ 3
+	switch length % 4 {
+	case 3:
+		h ^= uint32(data[tail+2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(data[tail+1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(data[tail])
+		h *= m
+	}
+
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+
+	return int32(h)
+}
+
+func partition(key []byte, partitions int) int {
+	return int(murmur2(key)&0x7fffffff) % partitions
+}
@@ -0,0 +1,401 @@
+package kafka
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/archaron/juniper-natlog/common"
+	"github.com/archaron/juniper-natlog/modules/sink"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+const (
+	FormatJSON = "json"
+	FormatAvro = "avro"
+
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+
+	AcksNone   = "none"
+	AcksLeader = "leader"
+	AcksAll    = "all"
+)
+
+type (
+	Settings struct {
+		Brokers  []string
+		ClientID string `mapstructure:"client_id"`
+		// Topic - template of rule topic, e.g. `natlog.{{.Rule}}`
+		Topic  string
+		Format string
+		// KeyField - rule field used as message key, public address by default
+		KeyField    string `mapstructure:"key_field"`
+		Acks        string
+		Compression string
+		Timeout     time.Duration
+		DialTimeout time.Duration `mapstructure:"dial_timeout"`
+		Spool       SpoolSettings
+
+		BatchSize    int           `mapstructure:"batch_size"`
+		BatchTimeout time.Duration `mapstructure:"batch_timeout"`
+		Batch        sink.BatchSettings
+		Retry        sink.RetrySettings
+		Queue        sink.QueueSettings
+	}
+
+	// SpoolSettings - batches not accepted by brokers are kept in Path and replayed, disabled when Path is empty
+	SpoolSettings struct {
+		Path           string
+		MaxBytes       int64         `mapstructure:"max_bytes"`
+		ReplayInterval time.Duration `mapstructure:"replay_interval"`
+	}
+
+	// Message to publish
+	Message struct {
+		Topic string
+		Key   []byte
+		Value []byte
+		Time  time.Time
+	}
+
+	// Producer publishes messages and returns ones not acknowledged,
+	// the built-in client can be replaced by a stand-in
+	Producer interface {
+		Produce(ctx context.Context, messages []Message) ([]Message, error)
+		Close() error
+	}
+
+	// Sink publishes every converted row as a message into the topic of its rule
+	Sink struct {
+		name     string
+		log      *zap.Logger
+		cfg      *Settings
+		producer Producer
+		spool    *spool
+
+		once   sync.Once
+		cancel context.CancelFunc
+
+		batcher  *sink.Batcher
+		models   map[string]*common.Model
+		topics   map[string]string
+		encoders map[string]valueEncoder
+
+		// mu guards spool order and last error
+		mu      sync.Mutex
+		lastErr error
+	}
+)
+
+func (s *Settings) acks() int16 {
+	switch s.Acks {
+	case AcksNone:
+		return 0
+	case AcksLeader:
+		return 1
+	default:
+		return -1
+	}
+}
+
+func newSettings(v *viper.Viper) (*Settings, error) {
+	v.SetDefault("client_id", "natlog")
+	v.SetDefault("topic", "natlog.{{.Rule}}")
+	v.SetDefault("format", FormatJSON)
+	v.SetDefault("key_field", "dst_ip")
+	v.SetDefault("acks", AcksAll)
+	v.SetDefault("compression", CompressionNone)
+	v.SetDefault("timeout", 10*time.Second)
+	v.SetDefault("dial_timeout", 5*time.Second)
+	v.SetDefault("spool.max_bytes", 1<<30)
+	v.SetDefault("spool.replay_interval", 10*time.Second)
+	v.SetDefault("batch_size", 10000)
+	v.SetDefault("batch_timeout", time.Second)
+
+	var cfg Settings
+	if err := v.Unmarshal(&cfg); err != nil {
+		return nil, err
+	}
+
+	if len(cfg.Brokers) == 0 {
+		return nil, errors.New("'brokers' is required")
+	}
+
+	switch cfg.Format {
+	case FormatJSON, FormatAvro:
+	default:
+		return nil, errors.Newf("unknown format %q", cfg.Format)
+	}
+
+	switch cfg.Acks {
+	case AcksNone, AcksLeader, AcksAll:
+	default:
+		return nil, errors.Newf("unknown acks %q", cfg.Acks)
+	}
+
+	switch cfg.Compression {
+	case CompressionNone, CompressionGzip:
+	default:
+		return nil, errors.Newf("unknown compression %q", cfg.Compression)
+	}
+
+	batch, err := sink.NewBatchSettings(v, "batch", cfg.BatchSize, cfg.BatchTimeout)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Batch = batch
+
+	retry, err := sink.NewRetrySettings(v, "retry")
+	if err != nil {
+		return nil, err
+	}
+	cfg.Retry = retry
+
+	queue, err := sink.NewQueueSettings(v, "queue")
+	if err != nil {
+		return nil, err
+	}
+	cfg.Queue = queue
+
+	return &cfg, nil
+}
+
+func newSink(name string, v *viper.Viper, log *zap.Logger) (sink.Sink, error) {
+	cfg, err := newSettings(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return New(name, cfg, newClient(cfg, log), log)
+}
+
+// New creates sink publishing with the producer
+func New(name string, cfg *Settings, producer Producer, log *zap.Logger) (*Sink, error) {
+	s := &Sink{
+		name:     name,
+		log:      log,
+		cfg:      cfg,
+		producer: producer,
+		cancel:   func() {},
+		models:   make(map[string]*common.Model),
+		topics:   make(map[string]string),
+		encoders: make(map[string]valueEncoder),
+	}
+
+	if cfg.Spool.Path != "" {
+		var err error
+		if s.spool, err = newSpool(cfg.Spool.Path, cfg.Spool.MaxBytes); err != nil {
+			return nil, errors.Notef(err, nil, "spool")
+		}
+	}
+
+	s.batcher = sink.NewBatcher(name, log, cfg.BatchSize, cfg.BatchTimeout, s.write)
+	s.batcher.SetLimits(cfg.Batch)
+	s.batcher.SetRetry(cfg.Retry)
+	if err := s.batcher.SetQueue(cfg.Queue); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *Sink) Name() string {
+	return s.name
+}
+
+func (s *Sink) RegisterModel(rule string, model *common.Model) error {
+	tpl, err := template.New("topic").Parse(s.cfg.Topic)
+	if err != nil {
+		return errors.Notef(err, nil, "topic template")
+	}
+
+	var topic strings.Builder
+	if err = tpl.Execute(&topic, struct{ Rule, Table string }{Rule: rule, Table: model.Table}); err != nil {
+		return errors.Notef(err, nil, "topic template")
+	}
+
+	switch s.cfg.Format {
+	case FormatAvro:
+		enc, schema, err := newAvroEncoder(rule, model)
+		if err != nil {
+			return errors.Notef(err, nil, "avro schema")
+		}
+		s.encoders[rule] = enc
+		s.log.Info("avro schema", zap.String("rule", rule), zap.String("schema", schema))
+	default:
+		s.encoders[rule] = &jsonEncoder{model: model}
+	}
+
+	s.models[rule] = model
+	s.topics[rule] = topic.String()
+	s.batcher.Register(rule)
+	return nil
+}
+
+func (s *Sink) Insert(message *common.FlowMessage) {
+	s.batcher.Insert(message)
+}
+
+// Flush pending batches of all rules
+func (s *Sink) Flush(ctx context.Context) error {
+	return s.batcher.Flush(ctx)
+}
+
+// Circuit state of batch writes
+func (s *Sink) Circuit() sink.CircuitState {
+	return s.batcher.Circuit()
+}
+
+// Health reports the last publishing error, rows are spooled meanwhile
+func (s *Sink) Health() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastErr
+}
+
+func (s *Sink) write(ctx context.Context, rule, _ string, items []common.FlowMessagePayload, reason string) error {
+	var (
+		now      = time.Now()
+		model    = s.models[rule]
+		enc      = s.encoders[rule]
+		messages = make([]Message, 0, len(items))
+	)
+
+	for _, item := range items {
+		values, err := model.Convert(item)
+		if err != nil {
+			s.log.Error("cannot convert field", zap.Error(err), zap.String("rule", rule), zap.String("reason", reason))
+			continue
+		}
+
+		value, err := enc.Encode(values)
+		if err != nil {
+			s.log.Error("cannot encode row", zap.Error(err), zap.String("rule", rule))
+			continue
+		}
+
+		m := Message{Topic: s.topics[rule], Value: value, Time: now}
+		if key, ok := item[s.cfg.KeyField]; ok {
+			m.Key = []byte(key)
+		}
+		messages = append(messages, m)
+	}
+
+	if len(messages) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// keep order: while spool is not empty new batches are spooled behind it
+	if s.spool != nil && s.spool.Len() > 0 {
+		return s.spool.Write(messages)
+	}
+
+	failed, err := s.producer.Produce(ctx, messages)
+	s.lastErr = err
+	if err == nil {
+		return nil
+	}
+
+	if s.spool == nil {
+		return errors.Notef(err, nil, "%d of %d messages not published", len(failed), len(messages))
+	}
+
+	s.log.Warn("brokers unavailable, spooling batch", zap.String("rule", rule), zap.Int("messages", len(failed)), zap.Error(err))
+	return s.spool.Write(failed)
+}
+
+// replay spooled batches oldest first until spool is empty or brokers fail,
+// unreadable batches are moved to quarantine, so they do not hold back later ones
+func (s *Sink) replay(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for ctx.Err() == nil {
+		name, messages, err := s.spool.Oldest()
+		if err != nil && name == "" {
+			s.log.Error("could not read spool", zap.Error(err))
+			return
+		}
+
+		if err != nil {
+			target, qerr := s.spool.Quarantine(name)
+			if qerr != nil {
+				s.log.Error("could not quarantine unreadable spool file", zap.String("file", name),
+					zap.Error(err), zap.NamedError("quarantine", qerr))
+				return
+			}
+
+			s.log.Error("unreadable spool file quarantined", zap.String("file", target), zap.Error(err))
+			continue
+		}
+
+		if name == "" {
+			return
+		}
+
+		if len(messages) > 0 {
+			failed, err := s.producer.Produce(ctx, messages)
+			s.lastErr = err
+			if err != nil {
+				s.log.Warn("spool replay failed", zap.Int("messages", len(failed)), zap.Error(err))
+				// published messages are not replayed again
+				if len(failed) < len(messages) {
+					if err = s.spool.Rewrite(name, failed); err != nil {
+						s.log.Error("could not rewrite spool file", zap.String("file", name), zap.Error(err))
+					}
+				}
+				return
+			}
+		}
+
+		if err = s.spool.Remove(name); err != nil {
+			s.log.Error("could not remove spool file", zap.String("file", name), zap.Error(err))
+			return
+		}
+
+		s.log.Info("spooled batch published", zap.String("file", name), zap.Int("messages", len(messages)))
+	}
+}
+
+func (s *Sink) replayer(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.Spool.ReplayInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.replay(ctx)
+		}
+	}
+}
+
+func (s *Sink) Start(ctx context.Context) error {
+	s.once.Do(func() {
+		ctx, s.cancel = context.WithCancel(ctx)
+		go s.batcher.Run(ctx)
+
+		if s.spool != nil {
+			go s.replayer(ctx)
+		}
+	})
+	return nil
+}
+
+// Stop publishes pending rows, they are spooled when brokers are unavailable
+func (s *Sink) Stop(ctx context.Context) error {
+	if err := s.batcher.Close(ctx); err != nil {
+		s.log.Error("could not write pending rows", zap.Error(err))
+	}
+	s.cancel()
+	return s.producer.Close()
+}
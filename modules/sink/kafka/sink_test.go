@@ -0,0 +1,199 @@
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/archaron/juniper-natlog/common"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+// fakeProducer records published messages, fails while down
+type fakeProducer struct {
+	mu        sync.Mutex
+	down      bool
+	published []Message
+}
+
+func (p *fakeProducer) Produce(_ context.Context, messages []Message) ([]Message, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.down {
+		return messages, errors.New("brokers are down")
+	}
+	p.published = append(p.published, messages...)
+	return nil, nil
+}
+
+func (p *fakeProducer) Close() error {
+	return nil
+}
+
+func (p *fakeProducer) setDown(down bool) {
+	p.mu.Lock()
+	p.down = down
+	p.mu.Unlock()
+}
+
+func (p *fakeProducer) messages() []Message {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]Message(nil), p.published...)
+}
+
+func testModel() *common.Model {
+	return &common.Model{
+		Table: "jnat_log",
+		Fields: []common.ConvertableField{
+			&common.StringModelField{ModelField: common.ModelField{Name: "event", Type: common.TypeString}},
+			&common.IpToIntModelField{ModelField: common.ModelField{Name: "dst_ip", Type: "ip2int"}},
+			&common.UInt16ModelField{ModelField: common.ModelField{Name: "start_port", Type: "uint16"}},
+		},
+	}
+}
+
+func testSink(t *testing.T, spool string, producer Producer) *Sink {
+	t.Helper()
+
+	v := viper.New()
+	v.Set("brokers", []string{"127.0.0.1:9092"})
+	v.Set("batch_timeout", 10*time.Millisecond)
+	v.Set("spool.path", spool)
+
+	cfg, err := newSettings(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := New("kafka", cfg, producer, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.RegisterModel("JNat", testModel()); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func row(port string) common.FlowMessagePayload {
+	return common.FlowMessagePayload{"event": "ALLOC", "dst_ip": "198.51.100.20", "start_port": port}
+}
+
+func TestSinkPublishesRows(t *testing.T) {
+	producer := &fakeProducer{}
+	s := testSink(t, "", producer)
+
+	ctx := context.Background()
+	if err := s.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Insert(&common.FlowMessage{Rule: "JNat", Fields: row("2048")})
+	if err := s.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	messages := producer.messages()
+	if len(messages) != 1 {
+		t.Fatalf("%d messages published, expected 1", len(messages))
+	}
+
+	m := messages[0]
+	if m.Topic != "natlog.JNat" {
+		t.Errorf("topic %q", m.Topic)
+	}
+	if string(m.Key) != "198.51.100.20" {
+		t.Errorf("key %q", m.Key)
+	}
+
+	var value map[string]interface{}
+	if err := json.Unmarshal(m.Value, &value); err != nil {
+		t.Fatal(err)
+	}
+	if value["dst_ip"] != "198.51.100.20" || value["start_port"] != float64(2048) || value["event"] != "ALLOC" {
+		t.Errorf("value %s", m.Value)
+	}
+}
+
+func TestSinkSpoolsAndReplaysInOrder(t *testing.T) {
+	producer := &fakeProducer{down: true}
+	s := testSink(t, t.TempDir(), producer)
+
+	for _, port := range []string{"1", "2"} {
+		if err := s.write(context.Background(), "JNat", "", []common.FlowMessagePayload{row(port)}, "test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := s.spool.Len(); n != 2 {
+		t.Fatalf("%d batches spooled, expected 2", n)
+	}
+
+	producer.setDown(false)
+
+	// spooled batches go first, the new one is spooled behind them
+	if err := s.write(context.Background(), "JNat", "", []common.FlowMessagePayload{row("3")}, "test"); err != nil {
+		t.Fatal(err)
+	}
+	s.replay(context.Background())
+
+	if n := s.spool.Len(); n != 0 {
+		t.Fatalf("%d batches left in spool", n)
+	}
+
+	messages := producer.messages()
+	if len(messages) != 3 {
+		t.Fatalf("%d messages published, expected 3", len(messages))
+	}
+
+	for i, m := range messages {
+		var value map[string]interface{}
+		if err := json.Unmarshal(m.Value, &value); err != nil {
+			t.Fatal(err)
+		}
+		if value["start_port"] != float64(i+1) {
+			t.Errorf("message %d: %s", i, m.Value)
+		}
+	}
+}
+
+func TestReplayQuarantinesUnreadableFile(t *testing.T) {
+	dir := t.TempDir()
+	producer := &fakeProducer{}
+	s := testSink(t, dir, producer)
+
+	// sorts before batches written now
+	broken := filepath.Join(dir, "00000000000000000001"+spoolExt)
+	if err := os.WriteFile(broken, []byte{0, 5, 'n', 'a'}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	producer.setDown(true)
+	if err := s.write(context.Background(), "JNat", "", []common.FlowMessagePayload{row("1")}, "test"); err != nil {
+		t.Fatal(err)
+	}
+	producer.setDown(false)
+
+	s.replay(context.Background())
+
+	if n := s.spool.Len(); n != 0 {
+		t.Fatalf("%d batches left in spool", n)
+	}
+
+	if n := len(producer.messages()); n != 1 {
+		t.Fatalf("%d messages published, expected 1", n)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, quarantine, filepath.Base(broken))); err != nil {
+		t.Fatalf("broken file is not quarantined: %v", err)
+	}
+}
@@ -0,0 +1,231 @@
+package kafka
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+const (
+	spoolExt  = ".spool"
+	tmpSuffix = ".tmp"
+	// quarantine - subdirectory of unreadable spool files, they are not replayed
+	quarantine = "quarantine"
+	// maxRecordBytes - longer key or value lengths mean the spool file is corrupted
+	maxRecordBytes = 64 << 20
+)
+
+// spool keeps messages not accepted by brokers on disk, one file per batch, replayed oldest first
+type spool struct {
+	dir      string
+	maxBytes int64
+}
+
+func newSpool(dir string, maxBytes int64) (*spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	// batches being written on unclean shutdown are incomplete
+	tmps, err := filepath.Glob(filepath.Join(dir, "*"+spoolExt+tmpSuffix))
+	if err != nil {
+		return nil, err
+	}
+	for _, tmp := range tmps {
+		if err = os.Remove(tmp); err != nil {
+			return nil, err
+		}
+	}
+
+	return &spool{dir: dir, maxBytes: maxBytes}, nil
+}
+
+// files of spooled batches, oldest first
+func (s *spool) files() ([]string, int64, error) {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*"+spoolExt))
+	if err != nil {
+		return nil, 0, err
+	}
+	sort.Strings(files)
+
+	var size int64
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			return nil, 0, err
+		}
+		size += info.Size()
+	}
+
+	return files, size, nil
+}
+
+// Len - number of spooled batches
+func (s *spool) Len() int {
+	files, _, _ := s.files()
+	return len(files)
+}
+
+// Write batch of messages into the spool
+func (s *spool) Write(messages []Message) error {
+	_, size, err := s.files()
+	if err != nil {
+		return err
+	}
+
+	if s.maxBytes > 0 && size >= s.maxBytes {
+		return errors.Newf("spool is full: %d bytes", size)
+	}
+
+	return s.Rewrite(filepath.Join(s.dir, fmt.Sprintf("%020d%s", time.Now().UnixNano(), spoolExt)), messages)
+}
+
+// Rewrite spool file with messages, file is replaced atomically
+func (s *spool) Rewrite(name string, messages []Message) error {
+	f, err := os.Create(name + tmpSuffix)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	for _, m := range messages {
+		if err = writeMessage(w, m); err != nil {
+			_ = f.Close()
+			return err
+		}
+	}
+
+	if err = w.Flush(); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	if err = f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(name+tmpSuffix, name)
+}
+
+// Oldest batch of the spool, empty name when spool is empty. Name is returned with the error when the file
+// is unreadable, so it can be quarantined.
+func (s *spool) Oldest() (string, []Message, error) {
+	files, _, err := s.files()
+	if err != nil || len(files) == 0 {
+		return "", nil, err
+	}
+
+	f, err := os.Open(files[0])
+	if err != nil {
+		return files[0], nil, err
+	}
+	defer f.Close()
+
+	var messages []Message
+	r := bufio.NewReader(f)
+	for {
+		m, err := readMessage(r)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return files[0], nil, errors.Notef(err, nil, "spool file %q", files[0])
+		}
+		messages = append(messages, m)
+	}
+
+	return files[0], messages, nil
+}
+
+// Remove replayed batch
+func (s *spool) Remove(name string) error {
+	return os.Remove(name)
+}
+
+// Quarantine moves unreadable batch out of the replay order, returns its new name
+func (s *spool) Quarantine(name string) (string, error) {
+	dir := filepath.Join(s.dir, quarantine)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	target := filepath.Join(dir, filepath.Base(name))
+	return target, os.Rename(name, target)
+}
+
+// record: topic length, topic, key length (-1 for nil), key, value length, value, unix milliseconds
+func writeMessage(w io.Writer, m Message) error {
+	e := &encoder{}
+	e.string(m.Topic)
+	if m.Key == nil {
+		e.int32(-1)
+	} else {
+		e.bytes(m.Key)
+	}
+	e.bytes(m.Value)
+	e.int64(m.Time.UnixNano() / int64(time.Millisecond))
+
+	_, err := w.Write(e.buf)
+	return err
+}
+
+func readMessage(r io.Reader) (Message, error) {
+	var m Message
+
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:2]); err != nil {
+		return m, err
+	}
+
+	topic := make([]byte, binary.BigEndian.Uint16(size[:2]))
+	if _, err := io.ReadFull(r, topic); err != nil {
+		return m, io.ErrUnexpectedEOF
+	}
+	m.Topic = string(topic)
+
+	readBytes := func() ([]byte, error) {
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		n := int32(binary.BigEndian.Uint32(size[:]))
+		if n < 0 {
+			return nil, nil
+		}
+		if n > maxRecordBytes {
+			return nil, errors.Newf("record of %d bytes", n)
+		}
+		data := make([]byte, n)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return data, nil
+	}
+
+	var err error
+	if m.Key, err = readBytes(); err != nil {
+		return m, err
+	}
+
+	if m.Value, err = readBytes(); err != nil {
+		return m, err
+	}
+
+	var ts [8]byte
+	if _, err = io.ReadFull(r, ts[:]); err != nil {
+		return m, io.ErrUnexpectedEOF
+	}
+	m.Time = time.Unix(0, int64(binary.BigEndian.Uint64(ts[:]))*int64(time.Millisecond))
+
+	return m, nil
+}
@@ -0,0 +1,137 @@
+package sink
+
+import (
+	"strings"
+	"time"
+
+	"github.com/archaron/juniper-natlog/common"
+	"github.com/spf13/viper"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+type (
+	// BatchLimits - batch of a rule is written when any limit is reached, zero MaxBytes is unlimited
+	BatchLimits struct {
+		MaxRows  int           `mapstructure:"max_rows"`
+		MaxBytes int           `mapstructure:"max_bytes"`
+		MaxAge   time.Duration `mapstructure:"max_age"`
+	}
+
+	// RuleBatchLimits - override of a rule, or of a device route `<rule>.<device>`
+	RuleBatchLimits struct {
+		Rule        string `mapstructure:"rule"`
+		BatchLimits `mapstructure:",squash"`
+	}
+
+	// BatchSettings - limits of the sink and overrides of rules by lowercase rule name, zero override fields
+	// are inherited
+	BatchSettings struct {
+		BatchLimits
+		Rules map[string]BatchLimits
+	}
+)
+
+// NewBatchSettings reads batch limits from the `<key>` section, legacy batch size and timeout of the sink
+// are defaults of max_rows and max_age
+func NewBatchSettings(v *viper.Viper, key string, size int, timeout time.Duration) (BatchSettings, error) {
+	v.SetDefault(key+".max_rows", size)
+	v.SetDefault(key+".max_age", timeout)
+
+	b := BatchSettings{
+		BatchLimits: BatchLimits{
+			MaxRows:  v.GetInt(key + ".max_rows"),
+			MaxBytes: v.GetInt(key + ".max_bytes"),
+			MaxAge:   v.GetDuration(key + ".max_age"),
+		},
+	}
+
+	// a list, as viper lowercases keys and device routes contain dots
+	var overrides []RuleBatchLimits
+	if err := v.UnmarshalKey(key+".rules", &overrides); err != nil {
+		return b, errors.Notef(err, nil, "%s.rules", key)
+	}
+
+	if err := b.BatchLimits.validate(); err != nil {
+		return b, errors.Notef(err, nil, "%s", key)
+	}
+
+	b.Rules = make(map[string]BatchLimits, len(overrides))
+	for i, o := range overrides {
+		if o.Rule == "" {
+			return b, errors.Newf("%s.rules %d: 'rule' is required", key, i)
+		}
+
+		name := strings.ToLower(o.Rule)
+		if _, ok := b.Rules[name]; ok {
+			return b, errors.Newf("%s.rules: duplicate rule %q", key, o.Rule)
+		}
+		b.Rules[name] = o.BatchLimits
+
+		if err := b.Limits(o.Rule).validate(); err != nil {
+			return b, errors.Notef(err, nil, "%s.rules: %s", key, o.Rule)
+		}
+	}
+
+	return b, nil
+}
+
+// Limits of the rule, overrides are matched case-insensitively
+func (b BatchSettings) Limits(rule string) BatchLimits {
+	limits := b.BatchLimits
+	override, ok := b.Rules[strings.ToLower(rule)]
+	if !ok {
+		return limits
+	}
+
+	if override.MaxRows != 0 {
+		limits.MaxRows = override.MaxRows
+	}
+
+	if override.MaxBytes != 0 {
+		limits.MaxBytes = override.MaxBytes
+	}
+
+	if override.MaxAge != 0 {
+		limits.MaxAge = override.MaxAge
+	}
+
+	return limits
+}
+
+func (l BatchLimits) validate() error {
+	if l.MaxRows < 1 {
+		return errors.New("'max_rows' must be positive")
+	}
+
+	if l.MaxBytes < 0 {
+		return errors.New("'max_bytes' must not be negative")
+	}
+
+	if l.MaxAge <= 0 {
+		return errors.New("'max_age' must be positive")
+	}
+
+	return nil
+}
+
+// filled reports whether the batch reached rows or bytes limit
+func (l BatchLimits) filled(item *common.PoolItem) bool {
+	return item.Size >= l.MaxRows || (l.MaxBytes > 0 && item.Bytes >= l.MaxBytes)
+}
+
+// prealloc - capacity of new batch slices, huge limits are grown on demand
+func (l BatchLimits) prealloc() int {
+	if l.MaxRows > 10000 {
+		return 10000
+	}
+	return l.MaxRows
+}
+
+// payloadBytes - estimated memory of row fields
+func payloadBytes(fields common.FlowMessagePayload) int {
+	n := 0
+	for k, v := range fields {
+		n += len(k) + len(v)
+	}
+	return n
+}
@@ -0,0 +1,33 @@
+package sink
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// DropQueueFull - queue policy dropped the row
+	DropQueueFull = "queue_full"
+	// DropSpillFailed - queue was full and the row could not be spilled to disk
+	DropSpillFailed = "spill_failed"
+	// DropPermanent - batch was rejected with a permanent error
+	DropPermanent = "permanent"
+	// DropShutdown - row was not written on shutdown and could not be spilled
+	DropShutdown = "shutdown"
+)
+
+var (
+	sinkDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "natlog",
+		Subsystem: "sink",
+		Name:      "dropped_total",
+		Help:      "Rows dropped before written to the sink",
+	}, []string{"sink", "rule", "reason"})
+
+	sinkSpilled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "natlog",
+		Subsystem: "sink",
+		Name:      "spilled_total",
+		Help:      "Rows spilled to disk because queue of the sink was full or they were not written on shutdown",
+	}, []string{"sink", "rule"})
+)
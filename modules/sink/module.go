@@ -0,0 +1,8 @@
+package sink
+
+import "github.com/im-kulikov/helium/module"
+
+// Module application
+var Module = module.Module{
+	{Constructor: newRegistry},
+}
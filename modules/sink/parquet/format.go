@@ -0,0 +1,393 @@
+package parquet
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"net"
+	"os"
+
+	"github.com/archaron/juniper-natlog/common"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+const magic = "PAR1"
+
+// parquet physical types
+const (
+	typeInt32     = 1
+	typeInt64     = 2
+	typeByteArray = 6
+	typeFixed     = 7
+)
+
+// parquet converted types
+const (
+	convertedNone            = -1
+	convertedUTF8            = 0
+	convertedTimestampMillis = 9
+	convertedUint16          = 12
+	convertedUint32          = 13
+	convertedUint64          = 14
+	convertedInt16           = 16
+)
+
+// parquet compression codecs
+var codecs = map[string]int32{
+	CompressionNone:   0,
+	CompressionSnappy: 1,
+	CompressionGzip:   2,
+	CompressionZstd:   6,
+}
+
+const (
+	encodingPlain  = 0
+	encodingRLE    = 3
+	pageData       = 0
+	repetitionReq  = 0
+	createdBy      = "juniper-natlog"
+	formatVersion  = 1
+	ipv6FixedWidth = 16
+)
+
+type (
+	// column of flat parquet schema, all columns are required and PLAIN encoded
+	column struct {
+		name      string
+		typ       int32
+		converted int32
+		length    int32
+		// stats - min and max are kept for timestamps to allow pruning by time
+		stats bool
+	}
+
+	columnChunk struct {
+		offset       int64
+		values       int64
+		uncompressed int64
+		compressed   int64
+		min, max     int64
+		hasStats     bool
+	}
+
+	rowGroup struct {
+		rows    int64
+		size    int64
+		columns []columnChunk
+	}
+
+	// fileWriter writes row groups into parquet file and the footer on close
+	fileWriter struct {
+		file   *os.File
+		buf    *bufio.Writer
+		offset int64
+		codec  int32
+		zstd   *zstd.Encoder
+
+		columns []column
+		groups  []rowGroup
+		rows    int64
+	}
+)
+
+// newColumns maps model field types onto parquet columns
+func newColumns(model *common.Model) ([]column, error) {
+	columns := make([]column, 0, len(model.Fields))
+	for _, f := range model.Fields {
+		col := column{name: f.GetName(), converted: convertedNone}
+		switch f.(type) {
+		case *common.StringModelField:
+			col.typ, col.converted = typeByteArray, convertedUTF8
+		case *common.TimestampModelField:
+			col.typ, col.converted, col.stats = typeInt64, convertedTimestampMillis, true
+		case *common.ListModelField:
+			col.typ = typeInt32
+		case *common.Int16ModelField:
+			col.typ, col.converted = typeInt32, convertedInt16
+		case *common.UInt16ModelField:
+			col.typ, col.converted = typeInt32, convertedUint16
+		case *common.IpToIntModelField, *common.UInt32ModelField:
+			col.typ, col.converted = typeInt32, convertedUint32
+		case *common.UInt64ModelField:
+			col.typ, col.converted = typeInt64, convertedUint64
+		case *common.IpModelField:
+			col.typ, col.length = typeFixed, ipv6FixedWidth
+		default:
+			return nil, errors.Newf("field %q: unsupported type %T", col.name, f)
+		}
+		columns = append(columns, col)
+	}
+	return columns, nil
+}
+
+func newFileWriter(name string, columns []column, compression string) (*fileWriter, error) {
+	codec, ok := codecs[compression]
+	if !ok {
+		return nil, errors.Newf("unknown compression %q", compression)
+	}
+
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &fileWriter{
+		file:    file,
+		buf:     bufio.NewWriter(file),
+		codec:   codec,
+		columns: columns,
+	}
+
+	if compression == CompressionZstd {
+		if w.zstd, err = zstd.NewWriter(nil); err != nil {
+			_ = file.Close()
+			return nil, err
+		}
+	}
+
+	if err = w.write([]byte(magic)); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func (w *fileWriter) write(data []byte) error {
+	n, err := w.buf.Write(data)
+	w.offset += int64(n)
+	return err
+}
+
+// encode column values with PLAIN encoding
+func (w *fileWriter) encode(col int, rows [][]interface{}) ([]byte, columnChunk, error) {
+	var (
+		c     = w.columns[col]
+		data  []byte
+		chunk = columnChunk{values: int64(len(rows)), hasStats: c.stats}
+	)
+
+	for i, row := range rows {
+		switch v := row[col].(type) {
+		case string:
+			data = binary.LittleEndian.AppendUint32(data, uint32(len(v)))
+			data = append(data, v...)
+		case net.IP:
+			if len(v) != int(c.length) {
+				return nil, chunk, errors.Newf("column %q: expected %d bytes, got %d", c.name, c.length, len(v))
+			}
+			data = append(data, v...)
+		case int64:
+			if c.stats {
+				// model converts timestamps into unix seconds, column keeps milliseconds
+				v *= 1000
+				if i == 0 || v < chunk.min {
+					chunk.min = v
+				}
+				if i == 0 || v > chunk.max {
+					chunk.max = v
+				}
+			}
+			data = binary.LittleEndian.AppendUint64(data, uint64(v))
+		case uint64:
+			data = binary.LittleEndian.AppendUint64(data, v)
+		case int:
+			data = binary.LittleEndian.AppendUint32(data, uint32(int32(v)))
+		case int16:
+			data = binary.LittleEndian.AppendUint32(data, uint32(int32(v)))
+		case uint16:
+			data = binary.LittleEndian.AppendUint32(data, uint32(v))
+		case uint32:
+			data = binary.LittleEndian.AppendUint32(data, v)
+		default:
+			return nil, chunk, errors.Newf("column %q: unsupported value %T", c.name, v)
+		}
+	}
+
+	return data, chunk, nil
+}
+
+func (w *fileWriter) compress(data []byte) ([]byte, error) {
+	switch w.codec {
+	case codecs[CompressionSnappy]:
+		return snappy.Encode(nil, data), nil
+	case codecs[CompressionGzip]:
+		var out bytes.Buffer
+		gz := gzip.NewWriter(&out)
+		if _, err := gz.Write(data); err != nil {
+			return nil, err
+		}
+		if err := gz.Close(); err != nil {
+			return nil, err
+		}
+		return out.Bytes(), nil
+	case codecs[CompressionZstd]:
+		return w.zstd.EncodeAll(data, nil), nil
+	default:
+		return data, nil
+	}
+}
+
+// WriteRowGroup writes converted rows as one row group with single data page per column
+func (w *fileWriter) WriteRowGroup(rows [][]interface{}) error {
+	if len(rows) == 0 {
+		return nil
+	}
+
+	group := rowGroup{rows: int64(len(rows)), columns: make([]columnChunk, 0, len(w.columns))}
+	for col := range w.columns {
+		data, chunk, err := w.encode(col, rows)
+		if err != nil {
+			return err
+		}
+
+		page, err := w.compress(data)
+		if err != nil {
+			return err
+		}
+
+		header := newCompact()
+		header.Begin()
+		header.I32(1, pageData)
+		header.I32(2, int32(len(data)))
+		header.I32(3, int32(len(page)))
+		header.Struct(5)
+		header.I32(1, int32(len(rows)))
+		header.I32(2, encodingPlain)
+		header.I32(3, encodingRLE)
+		header.I32(4, encodingRLE)
+		header.End()
+		header.End()
+
+		chunk.offset = w.offset
+		chunk.uncompressed = int64(len(header.Bytes()) + len(data))
+		chunk.compressed = int64(len(header.Bytes()) + len(page))
+
+		if err = w.write(header.Bytes()); err != nil {
+			return err
+		}
+
+		if err = w.write(page); err != nil {
+			return err
+		}
+
+		group.size += chunk.uncompressed
+		group.columns = append(group.columns, chunk)
+	}
+
+	w.groups = append(w.groups, group)
+	w.rows += group.rows
+
+	return w.buf.Flush()
+}
+
+func (w *fileWriter) footer() []byte {
+	meta := newCompact()
+	meta.Begin()
+	meta.I32(1, formatVersion)
+
+	// schema root and one element per column
+	meta.List(2, thriftStruct, len(w.columns)+1)
+	meta.Begin()
+	meta.String(4, "schema")
+	meta.I32(5, int32(len(w.columns)))
+	meta.End()
+	for _, c := range w.columns {
+		meta.Begin()
+		meta.I32(1, c.typ)
+		if c.length > 0 {
+			meta.I32(2, c.length)
+		}
+		meta.I32(3, repetitionReq)
+		meta.String(4, c.name)
+		if c.converted != convertedNone {
+			meta.I32(6, c.converted)
+		}
+		meta.End()
+	}
+
+	meta.I64(3, w.rows)
+
+	meta.List(4, thriftStruct, len(w.groups))
+	for _, g := range w.groups {
+		meta.Begin()
+		meta.List(1, thriftStruct, len(g.columns))
+		for i, chunk := range g.columns {
+			c := w.columns[i]
+
+			meta.Begin()
+			meta.I64(2, chunk.offset)
+			meta.Struct(3)
+			meta.I32(1, c.typ)
+			meta.List(2, thriftI32, 2)
+			meta.ListI32(encodingPlain)
+			meta.ListI32(encodingRLE)
+			meta.List(3, thriftBinary, 1)
+			meta.ListString(c.name)
+			meta.I32(4, w.codec)
+			meta.I64(5, chunk.values)
+			meta.I64(6, chunk.uncompressed)
+			meta.I64(7, chunk.compressed)
+			meta.I64(9, chunk.offset)
+			if chunk.hasStats {
+				lo := binary.LittleEndian.AppendUint64(nil, uint64(chunk.min))
+				hi := binary.LittleEndian.AppendUint64(nil, uint64(chunk.max))
+				meta.Struct(12)
+				meta.Binary(1, hi)
+				meta.Binary(2, lo)
+				meta.Binary(5, hi)
+				meta.Binary(6, lo)
+				meta.End()
+			}
+			meta.End()
+			meta.End()
+		}
+		meta.I64(2, g.size)
+		meta.I64(3, g.rows)
+		meta.End()
+	}
+
+	meta.String(6, createdBy)
+	meta.End()
+
+	return meta.Bytes()
+}
+
+// Close writes the footer and closes the file
+func (w *fileWriter) Close() error {
+	footer := w.footer()
+	footer = binary.LittleEndian.AppendUint32(footer, uint32(len(footer)))
+	footer = append(footer, magic...)
+
+	if err := w.write(footer); err != nil {
+		_ = w.file.Close()
+		return err
+	}
+
+	if err := w.buf.Flush(); err != nil {
+		_ = w.file.Close()
+		return err
+	}
+
+	if err := w.file.Sync(); err != nil {
+		_ = w.file.Close()
+		return err
+	}
+
+	if w.zstd != nil {
+		_ = w.zstd.Close()
+	}
+
+	return w.file.Close()
+}
+
+// Abort closes the file without the footer
+func (w *fileWriter) Abort() error {
+	if w.zstd != nil {
+		_ = w.zstd.Close()
+	}
+	return w.file.Close()
+}
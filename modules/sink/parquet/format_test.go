@@ -0,0 +1,235 @@
+package parquet
+
+import (
+	"encoding/binary"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/archaron/juniper-natlog/common"
+	"github.com/xitongsys/parquet-go-source/local"
+	pq "github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+// testModel has a field of every supported type
+func testModel() *common.Model {
+	def := 0
+	return &common.Model{
+		Table: "jnat_log",
+		Fields: []common.ConvertableField{
+			&common.TimestampModelField{Layout: "2006-01-02 15:04:05", ModelField: common.ModelField{Name: "timestamp"}},
+			&common.StringModelField{ModelField: common.ModelField{Name: "event"}},
+			&common.ListModelField{Values: map[string]int{"ALLOC": 1, "RELEASE": 2}, Default: &def,
+				ModelField: common.ModelField{Name: "kind"}},
+			&common.Int16ModelField{ModelField: common.ModelField{Name: "offset"}},
+			&common.UInt16ModelField{ModelField: common.ModelField{Name: "start_port"}},
+			&common.UInt32ModelField{ModelField: common.ModelField{Name: "session"}},
+			&common.IpToIntModelField{ModelField: common.ModelField{Name: "dst_ip"}},
+			&common.UInt64ModelField{ModelField: common.ModelField{Name: "bytes"}},
+			&common.IpModelField{ModelField: common.ModelField{Name: "src_ip6"}},
+		},
+	}
+}
+
+var testRows = [][]common.FlowMessagePayload{
+	{
+		{"timestamp": "2024-03-01 10:00:05", "event": "ALLOC", "kind": "ALLOC", "offset": "-32768", "start_port": "1024",
+			"session": "0", "dst_ip": "198.51.100.20", "bytes": "0", "src_ip6": "2001:db8::1"},
+		{"timestamp": "2024-03-01 10:00:01", "event": "освобождение", "kind": "RELEASE", "offset": "32767", "start_port": "65535",
+			"session": "4294967295", "dst_ip": "255.255.255.255", "bytes": "18446744073709551615", "src_ip6": "100.64.0.7"},
+	},
+	{
+		{"timestamp": "2024-03-01 11:59:59", "event": "", "kind": "OTHER", "offset": "0", "start_port": "0",
+			"session": "7", "dst_ip": "0.0.0.0", "bytes": "42", "src_ip6": "::"},
+	},
+}
+
+type expectColumn struct {
+	typ       pq.Type
+	converted *pq.ConvertedType
+	length    int32
+	// values read by the reader, in rows order
+	values []interface{}
+}
+
+func converted(t pq.ConvertedType) *pq.ConvertedType {
+	return &t
+}
+
+func millis(value string) int64 {
+	t, err := time.Parse("2006-01-02 15:04:05", value)
+	if err != nil {
+		panic(err)
+	}
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func fixed(ip string) string {
+	return string(net.ParseIP(ip).To16())
+}
+
+var expectColumns = []expectColumn{
+	{typ: pq.Type_INT64, converted: converted(pq.ConvertedType_TIMESTAMP_MILLIS), values: []interface{}{
+		millis("2024-03-01 10:00:05"), millis("2024-03-01 10:00:01"), millis("2024-03-01 11:59:59")}},
+	{typ: pq.Type_BYTE_ARRAY, converted: converted(pq.ConvertedType_UTF8), values: []interface{}{
+		"ALLOC", "освобождение", ""}},
+	{typ: pq.Type_INT32, values: []interface{}{int32(1), int32(2), int32(0)}},
+	{typ: pq.Type_INT32, converted: converted(pq.ConvertedType_INT_16), values: []interface{}{
+		int32(-32768), int32(32767), int32(0)}},
+	{typ: pq.Type_INT32, converted: converted(pq.ConvertedType_UINT_16), values: []interface{}{
+		int32(1024), int32(65535), int32(0)}},
+	// unsigned values are stored in signed physical types bit for bit
+	{typ: pq.Type_INT32, converted: converted(pq.ConvertedType_UINT_32), values: []interface{}{
+		int32(0), int32(-1), int32(7)}},
+	{typ: pq.Type_INT32, converted: converted(pq.ConvertedType_UINT_32), values: []interface{}{
+		int32(-969710572), int32(-1), int32(0)}},
+	{typ: pq.Type_INT64, converted: converted(pq.ConvertedType_UINT_64), values: []interface{}{
+		int64(0), int64(-1), int64(42)}},
+	{typ: pq.Type_FIXED_LEN_BYTE_ARRAY, length: 16, values: []interface{}{
+		fixed("2001:db8::1"), fixed("100.64.0.7"), fixed("::")}},
+}
+
+// TestFilesAreReadable writes files with every column type and codec, reads them back with an independent reader
+func TestFilesAreReadable(t *testing.T) {
+	model := testModel()
+	for _, compression := range []string{CompressionNone, CompressionSnappy, CompressionGzip, CompressionZstd} {
+		t.Run(compression, func(t *testing.T) {
+			name := filepath.Join(t.TempDir(), "jnat_log"+fileExt)
+			writeFile(t, name, model, compression)
+			checkFile(t, name, model, compression)
+		})
+	}
+}
+
+func writeFile(t *testing.T, name string, model *common.Model, compression string) {
+	t.Helper()
+
+	columns, err := newColumns(model)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := newFileWriter(name, columns, compression)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, group := range testRows {
+		rows := make([][]interface{}, 0, len(group))
+		for _, item := range group {
+			values, err := model.Convert(item)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rows = append(rows, values)
+		}
+
+		if err = w.WriteRowGroup(rows); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkFile(t *testing.T, name string, model *common.Model, compression string) {
+	t.Helper()
+
+	f, err := local.NewLocalFileReader(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	r, err := reader.NewParquetColumnReader(f, 1)
+	if err != nil {
+		t.Fatalf("cannot open file: %v", err)
+	}
+	defer r.ReadStop()
+
+	footer := r.Footer
+	if footer.NumRows != 3 || len(footer.RowGroups) != len(testRows) {
+		t.Fatalf("%d rows in %d row groups", footer.NumRows, len(footer.RowGroups))
+	}
+
+	schema := footer.Schema[1:]
+	if len(schema) != len(expectColumns) {
+		t.Fatalf("%d schema columns", len(schema))
+	}
+
+	for i, expect := range expectColumns {
+		// the reader renames footer schema in place, names as written are kept by its schema handler
+		element := schema[i]
+		if r.SchemaHandler.GetExName(i+1) != model.Fields[i].GetName() || element.GetType() != expect.typ ||
+			element.GetRepetitionType() != pq.FieldRepetitionType_REQUIRED || element.GetTypeLength() != expect.length {
+			t.Errorf("column %d: schema %s", i, element)
+		}
+
+		if (element.ConvertedType == nil) != (expect.converted == nil) ||
+			(expect.converted != nil && *element.ConvertedType != *expect.converted) {
+			t.Errorf("column %q: converted type %v", element.GetName(), element.ConvertedType)
+		}
+
+		for g := range footer.RowGroups {
+			if codec := footer.RowGroups[g].Columns[i].MetaData.Codec.String(); codec != codecName(compression) {
+				t.Errorf("column %q: codec %s", element.GetName(), codec)
+			}
+		}
+
+		values, _, _, err := r.ReadColumnByIndex(int64(i), footer.NumRows)
+		if err != nil {
+			t.Fatalf("column %q: %v", element.GetName(), err)
+		}
+
+		if len(values) != len(expect.values) {
+			t.Fatalf("column %q: %d values", element.GetName(), len(values))
+		}
+
+		for j := range values {
+			if values[j] != expect.values[j] {
+				t.Errorf("column %q row %d: %#v, expected %#v", element.GetName(), j, values[j], expect.values[j])
+			}
+		}
+	}
+
+	// timestamps of the row groups: 10:00:01-10:00:05 and 11:59:59
+	bounds := [][2]int64{
+		{millis("2024-03-01 10:00:01"), millis("2024-03-01 10:00:05")},
+		{millis("2024-03-01 11:59:59"), millis("2024-03-01 11:59:59")},
+	}
+	for g, group := range footer.RowGroups {
+		stats := group.Columns[0].MetaData.Statistics
+		if stats == nil {
+			t.Fatalf("row group %d: no timestamp statistics", g)
+		}
+
+		for _, v := range []struct {
+			name   string
+			value  []byte
+			expect int64
+		}{
+			{"min_value", stats.MinValue, bounds[g][0]},
+			{"max_value", stats.MaxValue, bounds[g][1]},
+			{"min", stats.Min, bounds[g][0]},
+			{"max", stats.Max, bounds[g][1]},
+		} {
+			if len(v.value) != 8 || int64(binary.LittleEndian.Uint64(v.value)) != v.expect {
+				t.Errorf("row group %d: %s %x, expected %d", g, v.name, v.value, v.expect)
+			}
+		}
+
+		for i := 1; i < len(group.Columns); i++ {
+			if group.Columns[i].MetaData.Statistics != nil {
+				t.Errorf("row group %d: statistics of column %d", g, i)
+			}
+		}
+	}
+}
+
+func codecName(compression string) string {
+	return pq.CompressionCodec(codecs[compression]).String()
+}
@@ -0,0 +1,106 @@
+package parquet
+
+import (
+	"encoding/binary"
+)
+
+// thrift compact protocol types
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// compact writes thrift compact protocol, enough for parquet page headers and footer
+type compact struct {
+	buf  []byte
+	last []int16
+}
+
+func newCompact() *compact {
+	return &compact{}
+}
+
+func (c *compact) Bytes() []byte {
+	return c.buf
+}
+
+func (c *compact) varint(v uint64) {
+	c.buf = binary.AppendUvarint(c.buf, v)
+}
+
+func (c *compact) zigzag(v int64) {
+	c.varint(uint64((v << 1) ^ (v >> 63)))
+}
+
+func (c *compact) field(id int16, typ byte) {
+	last := &c.last[len(c.last)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		c.buf = append(c.buf, byte(delta)<<4|typ)
+	} else {
+		c.buf = append(c.buf, typ)
+		c.zigzag(int64(id))
+	}
+	*last = id
+}
+
+func (c *compact) I32(id int16, v int32) {
+	c.field(id, thriftI32)
+	c.zigzag(int64(v))
+}
+
+func (c *compact) I64(id int16, v int64) {
+	c.field(id, thriftI64)
+	c.zigzag(v)
+}
+
+func (c *compact) Binary(id int16, v []byte) {
+	c.field(id, thriftBinary)
+	c.binary(v)
+}
+
+func (c *compact) String(id int16, v string) {
+	c.Binary(id, []byte(v))
+}
+
+func (c *compact) binary(v []byte) {
+	c.varint(uint64(len(v)))
+	c.buf = append(c.buf, v...)
+}
+
+// List writes list header, elements are written by the caller
+func (c *compact) List(id int16, typ byte, size int) {
+	c.field(id, thriftList)
+	if size < 15 {
+		c.buf = append(c.buf, byte(size)<<4|typ)
+		return
+	}
+	c.buf = append(c.buf, 0xf0|typ)
+	c.varint(uint64(size))
+}
+
+func (c *compact) ListI32(v int32) {
+	c.zigzag(int64(v))
+}
+
+func (c *compact) ListString(v string) {
+	c.binary([]byte(v))
+}
+
+// Struct starts struct field, must be closed with End
+func (c *compact) Struct(id int16) {
+	c.field(id, thriftStruct)
+	c.Begin()
+}
+
+// Begin starts struct, used for list elements and top level structs
+func (c *compact) Begin() {
+	c.last = append(c.last, 0)
+}
+
+func (c *compact) End() {
+	c.buf = append(c.buf, 0)
+	c.last = c.last[:len(c.last)-1]
+}
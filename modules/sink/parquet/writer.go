@@ -0,0 +1,189 @@
+package parquet
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/archaron/juniper-natlog/common"
+	"go.uber.org/zap"
+)
+
+const (
+	fileExt   = ".parquet"
+	tmpSuffix = ".tmp"
+	// partialSuffix - files without footer left by unclean shutdown, cannot be read as parquet
+	partialSuffix = ".partial"
+)
+
+// writer keeps rows of one rule for the current partition, rows are written as row groups
+// into a temporary file, which gets the footer and its final name when the partition is over
+type writer struct {
+	cfg     *Settings
+	rule    string
+	model   *common.Model
+	columns []column
+	log     *zap.Logger
+	dir     string
+
+	period  time.Time
+	file    *fileWriter
+	tmp     string
+	name    string
+	pending [][]interface{}
+}
+
+func newWriter(cfg *Settings, rule string, model *common.Model, log *zap.Logger) (*writer, error) {
+	columns, err := newColumns(model)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &writer{
+		cfg:     cfg,
+		rule:    rule,
+		model:   model,
+		columns: columns,
+		log:     log,
+		dir:     filepath.Join(cfg.Path, rule),
+	}
+
+	if err = os.MkdirAll(w.dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return w, w.recover()
+}
+
+// recover renames files left by unclean shutdown, so they are never taken for complete ones
+func (w *writer) recover() error {
+	return filepath.Walk(w.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !strings.HasSuffix(path, fileExt+tmpSuffix) {
+			return err
+		}
+
+		partial := strings.TrimSuffix(path, tmpSuffix) + partialSuffix
+		w.log.Warn("unfinished parquet file", zap.String("file", partial))
+		return os.Rename(path, partial)
+	})
+}
+
+func (w *writer) periodStart(t time.Time) time.Time {
+	t = t.UTC()
+	if w.cfg.Partition == PartitionDaily {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+	return t.Truncate(time.Hour)
+}
+
+// partition returns hive style directory of the period, e.g. `date=2020-01-02/hour=15`
+func (w *writer) partition() (string, string) {
+	dir := filepath.Join(w.dir, "date="+w.period.Format("2006-01-02"))
+	if w.cfg.Partition == PartitionDaily {
+		return dir, w.period.Format("20060102")
+	}
+	return filepath.Join(dir, "hour="+w.period.Format("15")), w.period.Format("20060102T15")
+}
+
+func (w *writer) write(items []common.FlowMessagePayload, now time.Time) error {
+	if err := w.rotate(now); err != nil {
+		return err
+	}
+
+	if w.file == nil && len(w.pending) == 0 {
+		w.period = w.periodStart(now)
+	}
+
+	for _, item := range items {
+		values, err := w.model.Convert(item)
+		if err != nil {
+			w.log.Error("cannot convert field", zap.Error(err))
+			continue
+		}
+
+		w.pending = append(w.pending, values)
+		if len(w.pending) >= w.cfg.RowGroupSize {
+			if err = w.flushGroup(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (w *writer) open() error {
+	dir, stamp := w.partition()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	// file of the same partition may exist after restart
+	w.name = filepath.Join(dir, w.rule+"-"+stamp+fileExt)
+	for seq := 1; ; seq++ {
+		if _, err := os.Stat(w.name); os.IsNotExist(err) {
+			break
+		}
+		w.name = filepath.Join(dir, fmt.Sprintf("%s-%s-%d%s", w.rule, stamp, seq, fileExt))
+	}
+	w.tmp = w.name + tmpSuffix
+
+	var err error
+	w.file, err = newFileWriter(w.tmp, w.columns, w.cfg.Compression)
+	return err
+}
+
+// flushGroup writes pending rows as a row group, rows are kept on error
+func (w *writer) flushGroup() error {
+	if len(w.pending) == 0 {
+		return nil
+	}
+
+	if w.file == nil {
+		if err := w.open(); err != nil {
+			return err
+		}
+	}
+
+	if err := w.file.WriteRowGroup(w.pending); err != nil {
+		return err
+	}
+
+	w.pending = w.pending[:0]
+	return nil
+}
+
+// rotate closes file of the finished partition
+func (w *writer) rotate(now time.Time) error {
+	if (w.file == nil && len(w.pending) == 0) || w.periodStart(now).Equal(w.period) {
+		return nil
+	}
+
+	return w.close()
+}
+
+// close writes pending rows and the footer, then renames file to its final name
+func (w *writer) close() error {
+	if err := w.flushGroup(); err != nil {
+		return err
+	}
+
+	if w.file == nil {
+		return nil
+	}
+
+	rows := w.file.rows
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	w.file = nil
+
+	if err := os.Rename(w.tmp, w.name); err != nil {
+		return err
+	}
+
+	w.log.Debug("parquet file closed", zap.String("file", w.name), zap.Int64("rows", rows))
+	return nil
+}
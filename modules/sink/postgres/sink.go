@@ -0,0 +1,400 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/archaron/juniper-natlog/common"
+	"github.com/archaron/juniper-natlog/modules/sink"
+	"github.com/lib/pq"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+type (
+	Settings struct {
+		DSN    string
+		Schema string
+		// CreateTables - generate tables from rule fields on model registration
+		CreateTables bool `mapstructure:"create_tables"`
+		// Ranges - int4range columns built from pairs of start and end fields, e.g. `ports: [start_port, end_port]`
+		Ranges     map[string][]string
+		Hypertable Hypertable
+
+		BatchSize    int           `mapstructure:"batch_size"`
+		BatchTimeout time.Duration `mapstructure:"batch_timeout"`
+		Batch        sink.BatchSettings
+		Retry        sink.RetrySettings
+		Queue        sink.QueueSettings
+	}
+
+	// Hypertable - TimescaleDB partitioning of created tables, extension must be installed
+	Hypertable struct {
+		Enabled       bool
+		TimeField     string `mapstructure:"time_field"`
+		ChunkInterval string `mapstructure:"chunk_interval"`
+	}
+
+	// rangeColumn of table built from two model fields
+	rangeColumn struct {
+		name       string
+		start, end int
+	}
+
+	table struct {
+		schema, name string
+		columns      []string
+		ranges       []rangeColumn
+	}
+
+	// Sink copies rows of every rule into PostgreSQL tables
+	Sink struct {
+		name string
+		con  *sql.DB
+		log  *zap.Logger
+		cfg  *Settings
+
+		once   sync.Once
+		cancel context.CancelFunc
+
+		batcher *sink.Batcher
+		models  map[string]*common.Model
+		tables  map[string]*table
+	}
+)
+
+func newSettings(v *viper.Viper) (*Settings, error) {
+	v.SetDefault("schema", "public")
+	v.SetDefault("create_tables", true)
+	v.SetDefault("hypertable.time_field", "timestamp")
+	v.SetDefault("hypertable.chunk_interval", "1 day")
+	v.SetDefault("batch_size", 10000)
+	v.SetDefault("batch_timeout", 10*time.Second)
+
+	var cfg Settings
+	if err := v.Unmarshal(&cfg); err != nil {
+		return nil, err
+	}
+
+	if cfg.DSN == "" {
+		return nil, errors.New("'dsn' is required")
+	}
+
+	for name, fields := range cfg.Ranges {
+		if len(fields) != 2 {
+			return nil, errors.Newf("range %q: start and end fields expected", name)
+		}
+	}
+
+	batch, err := sink.NewBatchSettings(v, "batch", cfg.BatchSize, cfg.BatchTimeout)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Batch = batch
+
+	retry, err := sink.NewRetrySettings(v, "retry")
+	if err != nil {
+		return nil, err
+	}
+	cfg.Retry = retry
+
+	queue, err := sink.NewQueueSettings(v, "queue")
+	if err != nil {
+		return nil, err
+	}
+	cfg.Queue = queue
+
+	return &cfg, nil
+}
+
+func newSink(name string, v *viper.Viper, log *zap.Logger) (sink.Sink, error) {
+	cfg, err := newSettings(v)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Sink{
+		name:   name,
+		log:    log,
+		cfg:    cfg,
+		cancel: func() {},
+		models: make(map[string]*common.Model),
+		tables: make(map[string]*table),
+	}
+
+	if s.con, err = sql.Open("postgres", cfg.DSN); err != nil {
+		return nil, err
+	}
+
+	if err = s.con.Ping(); err != nil {
+		_ = s.con.Close()
+		return nil, err
+	}
+
+	s.batcher = sink.NewBatcher(name, log, cfg.BatchSize, cfg.BatchTimeout, s.insertBatch)
+	s.batcher.SetLimits(cfg.Batch)
+	s.batcher.SetRetry(cfg.Retry)
+	if err = s.batcher.SetQueue(cfg.Queue); err != nil {
+		_ = s.con.Close()
+		return nil, err
+	}
+
+	log.Info("postgres connected")
+
+	return s, nil
+}
+
+func (s *Sink) Name() string {
+	return s.name
+}
+
+// Circuit state of batch writes
+func (s *Sink) Circuit() sink.CircuitState {
+	return s.batcher.Circuit()
+}
+
+func (s *Sink) Health() error {
+	return s.con.Ping()
+}
+
+func columnType(f common.ConvertableField) string {
+	switch f.(type) {
+	case *common.TimestampModelField:
+		return "timestamptz"
+	case *common.IpToIntModelField, *common.IpModelField:
+		return "inet"
+	case *common.Int16ModelField:
+		return "smallint"
+	case *common.ListModelField, *common.UInt16ModelField:
+		return "integer"
+	case *common.UInt32ModelField:
+		return "bigint"
+	case *common.UInt64ModelField:
+		return "numeric(20)"
+	default:
+		return "text"
+	}
+}
+
+// newTable resolves columns of the model, `schema.table` names override configured schema
+func (s *Sink) newTable(model *common.Model) *table {
+	t := &table{schema: s.cfg.Schema, name: model.Table}
+	if i := strings.IndexByte(model.Table, '.'); i >= 0 {
+		t.schema, t.name = model.Table[:i], model.Table[i+1:]
+	}
+
+	index := make(map[string]int, len(model.Fields))
+	for i, f := range model.Fields {
+		index[f.GetName()] = i
+		t.columns = append(t.columns, f.GetName())
+	}
+
+	names := make([]string, 0, len(s.cfg.Ranges))
+	for name := range s.cfg.Ranges {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fields := s.cfg.Ranges[name]
+		start, ok := index[fields[0]]
+		if !ok {
+			continue
+		}
+
+		end, ok := index[fields[1]]
+		if !ok {
+			continue
+		}
+
+		t.ranges = append(t.ranges, rangeColumn{name: name, start: start, end: end})
+		t.columns = append(t.columns, name)
+	}
+
+	return t
+}
+
+func (t *table) identifier() string {
+	return pq.QuoteIdentifier(t.schema) + "." + pq.QuoteIdentifier(t.name)
+}
+
+// DDL generates table of the model with range columns
+func (t *table) DDL(model *common.Model) string {
+	columns := make([]string, 0, len(t.columns))
+	for _, f := range model.Fields {
+		columns = append(columns, pq.QuoteIdentifier(f.GetName())+" "+columnType(f)+" NOT NULL")
+	}
+
+	for _, r := range t.ranges {
+		columns = append(columns, pq.QuoteIdentifier(r.name)+" int4range NOT NULL")
+	}
+
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", t.identifier(), strings.Join(columns, ", "))
+}
+
+func (s *Sink) createTable(t *table, model *common.Model) error {
+	if _, err := s.con.Exec(t.DDL(model)); err != nil {
+		return err
+	}
+
+	for _, r := range t.ranges {
+		statement := fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s USING gist (%s)",
+			pq.QuoteIdentifier(t.name+"_"+r.name), t.identifier(), pq.QuoteIdentifier(r.name))
+		if _, err := s.con.Exec(statement); err != nil {
+			return err
+		}
+	}
+
+	if !s.cfg.Hypertable.Enabled {
+		return nil
+	}
+
+	if _, err := s.con.Exec("SELECT create_hypertable($1, $2, chunk_time_interval => $3::interval, if_not_exists => TRUE)",
+		t.identifier(), s.cfg.Hypertable.TimeField, s.cfg.Hypertable.ChunkInterval); err != nil {
+		return errors.Notef(err, nil, "cannot create hypertable")
+	}
+
+	return nil
+}
+
+func (s *Sink) RegisterModel(rule string, model *common.Model) error {
+	s.log.Debug("register model", zap.String("rule", rule))
+
+	t, ok := s.tables[model.Table]
+	if !ok {
+		t = s.newTable(model)
+		if s.cfg.CreateTables {
+			if err := s.createTable(t, model); err != nil {
+				return errors.Notef(err, nil, "cannot create table %q", model.Table)
+			}
+		}
+		s.tables[model.Table] = t
+	}
+
+	s.models[rule] = model
+	s.batcher.Register(rule)
+	return nil
+}
+
+func (s *Sink) Insert(message *common.FlowMessage) {
+	s.batcher.Insert(message)
+}
+
+// Flush pending batches of all rules
+func (s *Sink) Flush(ctx context.Context) error {
+	return s.batcher.Flush(ctx)
+}
+
+// value converts model value into COPY value of the column type
+func value(v interface{}, f common.ConvertableField) interface{} {
+	switch f.(type) {
+	case *common.TimestampModelField:
+		if unix, ok := v.(int64); ok {
+			return time.Unix(unix, 0).UTC()
+		}
+	case *common.IpToIntModelField:
+		if n, ok := v.(uint32); ok {
+			ip := make(net.IP, net.IPv4len)
+			binary.BigEndian.PutUint32(ip, n)
+			return ip.String()
+		}
+	case *common.IpModelField:
+		if ip, ok := v.(net.IP); ok {
+			return ip.String()
+		}
+	case *common.UInt64ModelField:
+		if n, ok := v.(uint64); ok {
+			return strconv.FormatUint(n, 10)
+		}
+	}
+	return v
+}
+
+// insertBatch copies rule rows in one transaction, rows with unconvertible fields are skipped
+func (s *Sink) insertBatch(ctx context.Context, rule, _ string, items []common.FlowMessagePayload, reason string) error {
+	model := s.models[rule]
+	t := s.tables[model.Table]
+
+	tx, err := s.con.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Notef(err, nil, "could not begin transaction")
+	}
+
+	stmt, err := tx.PrepareContext(ctx, pq.CopyInSchema(t.schema, t.name, t.columns...))
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			s.log.Error("transaction rollback error", zap.Error(rbErr))
+		}
+		return errors.Notef(err, nil, "could not prepare copy statement")
+	}
+
+	row := make([]interface{}, len(t.columns))
+	for _, msg := range items {
+		values, err := model.Convert(msg)
+		if err != nil {
+			s.log.Error("cannot convert field", zap.Error(err), zap.String("rule", rule), zap.String("reason", reason))
+			continue
+		}
+
+		for i, f := range model.Fields {
+			row[i] = value(values[i], f)
+		}
+
+		for i, r := range t.ranges {
+			row[len(model.Fields)+i] = fmt.Sprintf("[%v,%v]", values[r.start], values[r.end])
+		}
+
+		if _, err = stmt.ExecContext(ctx, row...); err != nil {
+			_ = stmt.Close()
+			if rbErr := tx.Rollback(); rbErr != nil {
+				s.log.Error("transaction rollback error", zap.Error(rbErr))
+			}
+			return errors.Notef(err, nil, "could not copy row")
+		}
+	}
+
+	// empty exec flushes buffered rows
+	if _, err = stmt.ExecContext(ctx); err != nil {
+		_ = stmt.Close()
+		if rbErr := tx.Rollback(); rbErr != nil {
+			s.log.Error("transaction rollback error", zap.Error(rbErr))
+		}
+		return errors.Notef(err, nil, "could not finish copy")
+	}
+
+	if err = stmt.Close(); err != nil {
+		s.log.Error("could not close statement", zap.Error(err))
+	}
+
+	if err = tx.Commit(); err != nil {
+		return errors.Notef(err, nil, "could not commit transaction")
+	}
+
+	return nil
+}
+
+func (s *Sink) Start(ctx context.Context) error {
+	s.once.Do(func() {
+		ctx, s.cancel = context.WithCancel(ctx)
+		go s.batcher.Run(ctx)
+	})
+	return nil
+}
+
+// Stop writes pending rows and closes the database
+func (s *Sink) Stop(ctx context.Context) error {
+	if err := s.batcher.Close(ctx); err != nil {
+		s.log.Error("could not write pending rows", zap.Error(err))
+	}
+	s.cancel()
+	return s.con.Close()
+}
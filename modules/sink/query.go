@@ -0,0 +1,164 @@
+package sink
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/archaron/juniper-natlog/common"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+type (
+	// Querier is a sink able to answer attribution queries
+	Querier interface {
+		Sink
+		// Attribute returns the latest row of the rule that covers the query, nil when nothing found
+		Attribute(ctx context.Context, rule string, q *AttributionQuery) (map[string]interface{}, error)
+	}
+
+	// AttributionFields - names of rule fields used to look up port block rows
+	AttributionFields struct {
+		IP        string
+		StartPort string `mapstructure:"start_port"`
+		EndPort   string `mapstructure:"end_port"`
+		Time      string
+	}
+
+	// AttributionQuery - who used public IP and port at the moment, rows between From and Time are searched
+	AttributionQuery struct {
+		IP     string
+		Port   string
+		Time   time.Time
+		From   time.Time
+		Fields AttributionFields
+	}
+)
+
+// Statement builds attribution select of the model with ip and port arguments converted by model fields,
+// the last two placeholders are lower and upper time bounds, backend appends them in its own type.
+// Table and column names are quoted by the backend quote, kept as is when it is nil.
+func (q *AttributionQuery) Statement(model *common.Model, quote func(name string) string) (string, []interface{}, error) {
+	if quote == nil {
+		quote = func(name string) string { return name }
+	}
+
+	fields := make(map[string]common.ConvertableField, len(model.Fields))
+	columns := make([]string, 0, len(model.Fields))
+	for _, f := range model.Fields {
+		fields[f.GetName()] = f
+		columns = append(columns, quote(f.GetName()))
+	}
+
+	for _, name := range []string{q.Fields.IP, q.Fields.StartPort, q.Fields.EndPort, q.Fields.Time} {
+		if _, ok := fields[name]; !ok {
+			return "", nil, errors.Newf("table %q has no field %q", model.Table, name)
+		}
+	}
+
+	ip, err := fields[q.Fields.IP].Convert(q.IP)
+	if err != nil {
+		return "", nil, errors.Notef(err, nil, "ip")
+	}
+
+	port, err := fields[q.Fields.StartPort].Convert(q.Port)
+	if err != nil {
+		return "", nil, errors.Notef(err, nil, "port")
+	}
+
+	statement := fmt.Sprintf("SELECT %s FROM %s WHERE %s = ? AND %s <= ? AND %s >= ? AND %s >= ? AND %s <= ? ORDER BY %s DESC LIMIT 1",
+		strings.Join(columns, ", "), quote(model.Table), quote(q.Fields.IP), quote(q.Fields.StartPort),
+		quote(q.Fields.EndPort), quote(q.Fields.Time), quote(q.Fields.Time), quote(q.Fields.Time))
+
+	return statement, []interface{}{ip, port, port}, nil
+}
+
+// ScanRow reads the first row in model fields order, addresses and timestamps are returned readable
+func ScanRow(model *common.Model, rows *sql.Rows) (map[string]interface{}, error) {
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+
+	values := make([]interface{}, len(model.Fields))
+	pointers := make([]interface{}, len(model.Fields))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+
+	if err := rows.Scan(pointers...); err != nil {
+		return nil, err
+	}
+
+	row := make(map[string]interface{}, len(model.Fields))
+	for i, f := range model.Fields {
+		row[f.GetName()] = formatValue(f, values[i])
+	}
+
+	return row, rows.Err()
+}
+
+func formatValue(f common.ConvertableField, value interface{}) interface{} {
+	switch f.(type) {
+	case *common.IpToIntModelField:
+		var ip [4]byte
+		switch v := value.(type) {
+		case uint32:
+			binary.BigEndian.PutUint32(ip[:], v)
+		case int64:
+			binary.BigEndian.PutUint32(ip[:], uint32(v))
+		default:
+			return value
+		}
+		return net.IP(ip[:]).String()
+	case *common.IpModelField:
+		switch v := value.(type) {
+		case net.IP:
+			return v.String()
+		case []byte:
+			return net.IP(v).String()
+		}
+	case *common.TimestampModelField:
+		switch v := value.(type) {
+		case time.Time:
+			return v.UTC()
+		case int64:
+			return time.Unix(v, 0).UTC()
+		}
+	}
+
+	if v, ok := value.([]byte); ok {
+		return string(v)
+	}
+
+	return value
+}
+
+// Querier returns sink by name able to answer attribution queries, the first one of all sinks when name is empty
+func (r *Registry) Querier(name string) (Querier, error) {
+	if name != "" {
+		s, ok := r.sinks[name]
+		if !ok {
+			return nil, errors.Newf("unknown sink %q", name)
+		}
+
+		q, ok := s.(Querier)
+		if !ok {
+			return nil, errors.Newf("sink %q does not support queries", name)
+		}
+		return q, nil
+	}
+
+	for _, name := range r.names {
+		if q, ok := r.sinks[name].(Querier); ok {
+			return q, nil
+		}
+	}
+
+	return nil, errors.New("no sink supports queries")
+}
@@ -0,0 +1,268 @@
+package sink
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/archaron/juniper-natlog/common"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+const (
+	// QueueBlock - insert waits for room in the queue, stalling the syslog listener
+	QueueBlock = "block"
+	// QueueDropNewest - row inserted into the full queue is dropped
+	QueueDropNewest = "drop_newest"
+	// QueueDropOldest - the oldest queued row is dropped to make room
+	QueueDropOldest = "drop_oldest"
+	// QueueSpill - rows not fitting into the queue are appended to a file on disk and written later
+	QueueSpill = "spill"
+)
+
+type (
+	// QueueSettings of rows inserted into the sink and not batched yet
+	QueueSettings struct {
+		Policy   string
+		Capacity int
+		// SpillPath - directory of spill files, <path>/<sink>.jsonl
+		SpillPath string `mapstructure:"spill_path"`
+	}
+
+	// spill keeps rows in a JSON lines file, rows are appended to the file and read back from its renamed copy
+	spill struct {
+		path string
+		log  *zap.Logger
+
+		mu   sync.Mutex
+		file *os.File
+		size int64
+
+		// replay file is read by the worker only, finished when read to the end and kept until its rows are written
+		replay   *os.File
+		reader   *bufio.Reader
+		finished bool
+	}
+
+	// spilledRow - Batch is id of the batch which failed to be written, rows of a batch are replayed together
+	spilledRow struct {
+		Rule   string                    `json:"rule"`
+		Batch  string                    `json:"batch,omitempty"`
+		Fields common.FlowMessagePayload `json:"fields"`
+	}
+)
+
+// NewQueueSettings reads queue settings from the `<key>` section
+func NewQueueSettings(v *viper.Viper, key string) (QueueSettings, error) {
+	v.SetDefault(key+".policy", QueueBlock)
+	v.SetDefault(key+".capacity", 10000)
+
+	q := QueueSettings{
+		Policy:    v.GetString(key + ".policy"),
+		Capacity:  v.GetInt(key + ".capacity"),
+		SpillPath: v.GetString(key + ".spill_path"),
+	}
+
+	switch q.Policy {
+	case QueueBlock, QueueDropNewest, QueueDropOldest:
+	case QueueSpill:
+		if q.SpillPath == "" {
+			return q, errors.Newf("%s: 'spill_path' is required by %s policy", key, QueueSpill)
+		}
+	default:
+		return q, errors.Newf("%s: unknown policy %q", key, q.Policy)
+	}
+
+	if q.Capacity < 1 {
+		return q, errors.Newf("%s: 'capacity' must be positive", key)
+	}
+
+	return q, nil
+}
+
+func openSpill(path string, log *zap.Logger) (*spill, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	if info.Size() > 0 {
+		log.Info("rows spilled before restart will be written", zap.String("path", path), zap.Int64("bytes", info.Size()))
+	}
+
+	return &spill{
+		path: path,
+		log:  log,
+		file: f,
+		size: info.Size(),
+	}, nil
+}
+
+func (s *spill) write(row spilledRow) error {
+	line, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return errors.New("spill is closed")
+	}
+
+	n, err := s.file.Write(append(line, '\n'))
+	s.size += int64(n)
+	return err
+}
+
+// next reads up to limit spilled rows, rows spilled meanwhile are read after the current file is removed
+func (s *spill) next(limit int) ([]spilledRow, error) {
+	if s.finished {
+		return nil, nil
+	}
+
+	if s.reader == nil {
+		if err := s.rotate(); err != nil || s.reader == nil {
+			return nil, err
+		}
+	}
+
+	result := make([]spilledRow, 0, limit)
+	for len(result) < limit {
+		line, err := s.reader.ReadBytes('\n')
+		if err == io.EOF {
+			// a partial line is left by unclean shutdown only
+			s.finish()
+			return result, nil
+		} else if err != nil {
+			return result, err
+		}
+
+		var row spilledRow
+		if err = json.Unmarshal(line, &row); err != nil {
+			s.log.Error("skip broken spilled row", zap.String("path", s.replay.Name()), zap.Error(err))
+			continue
+		}
+
+		result = append(result, row)
+	}
+
+	return result, nil
+}
+
+// rotate renames the spill file to be replayed, unless there is one left from the previous run
+func (s *spill) rotate() error {
+	replay := s.path + ".replay"
+	if _, err := os.Stat(replay); os.IsNotExist(err) {
+		s.mu.Lock()
+		if s.size == 0 || s.file == nil {
+			s.mu.Unlock()
+			return nil
+		}
+
+		err = s.reopen(replay)
+		s.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	f, err := os.Open(replay)
+	if err != nil {
+		return err
+	}
+
+	s.replay = f
+	s.reader = bufio.NewReader(f)
+	return nil
+}
+
+// reopen moves written rows to replay path and starts new file, must be called under lock
+func (s *spill) reopen(replay string) error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(s.path, replay); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		s.file = nil
+		return err
+	}
+
+	s.file = f
+	s.size = 0
+	return nil
+}
+
+func (s *spill) finish() {
+	_ = s.replay.Close()
+	s.replay, s.reader = nil, nil
+	s.finished = true
+}
+
+// done removes the finished replay file, once rows read from it are written or spilled again
+func (s *spill) done() error {
+	if !s.finished {
+		return nil
+	}
+
+	s.finished = false
+	return os.Remove(s.path + ".replay")
+}
+
+// pending reports whether there are rows to read, none until the finished replay file is removed
+func (s *spill) pending() bool {
+	if s.reader != nil {
+		return true
+	}
+
+	if s.finished {
+		return false
+	}
+
+	if _, err := os.Stat(s.path + ".replay"); err == nil {
+		return true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size > 0
+}
+
+func (s *spill) close() error {
+	if s.replay != nil {
+		_ = s.replay.Close()
+		s.replay, s.reader = nil, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
@@ -0,0 +1,221 @@
+package sink
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/spf13/viper"
+	"go.uber.org/dig"
+	"go.uber.org/zap"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+type (
+	registryParams struct {
+		dig.In
+
+		Viper     *viper.Viper
+		Logger    *zap.Logger
+		Sinks     []Sink    `group:"sinks"`
+		Factories []Factory `group:"sink_factories"`
+	}
+
+	// Registry holds all sinks by name: provided by modules (e.g. clickhouse) and created from `sinks` config section.
+	// Registry runs sinks, it is started and stopped by the syslog listener, so rows are written after it stops.
+	Registry struct {
+		log   *zap.Logger
+		sinks map[string]Sink
+		names []string
+		// defaults - sinks of rules without sinks, all except relays
+		defaults []string
+		relays   []Relay
+	}
+)
+
+func newRegistry(p registryParams) (*Registry, error) {
+	r := &Registry{
+		log:   p.Logger,
+		sinks: make(map[string]Sink),
+	}
+
+	for i, s := range p.Sinks {
+		if s == nil {
+			p.Logger.Debug("ignore nil sink", zap.Int("position", i))
+			continue
+		}
+
+		if err := r.add(s); err != nil {
+			return nil, err
+		}
+	}
+
+	factories := make(map[string]Factory, len(p.Factories))
+	for _, f := range p.Factories {
+		factories[f.Type] = f
+	}
+
+	for name := range p.Viper.GetStringMap("sinks") {
+		v := p.Viper.Sub("sinks." + name)
+		if v == nil {
+			return nil, errors.Newf("sink %q: config section must be a map", name)
+		}
+
+		if v.GetBool("disabled") {
+			continue
+		}
+
+		f, ok := factories[v.GetString("type")]
+		if !ok {
+			return nil, errors.Newf("sink %q: unknown type %q", name, v.GetString("type"))
+		}
+
+		s, err := f.New(name, v, p.Logger.With(zap.String("sink", name)))
+		if err != nil {
+			return nil, errors.Notef(err, nil, "sink %q", name)
+		}
+
+		if err = r.add(s); err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Strings(r.names)
+	sort.Strings(r.defaults)
+
+	return r, nil
+}
+
+func (r *Registry) add(s Sink) error {
+	if _, ok := r.sinks[s.Name()]; ok {
+		return errors.Newf("duplicate sink name %q", s.Name())
+	}
+
+	r.log.Info("add sink", zap.String("name", s.Name()))
+	r.sinks[s.Name()] = s
+	r.names = append(r.names, s.Name())
+
+	if relay, ok := s.(Relay); ok {
+		r.relays = append(r.relays, relay)
+	} else {
+		r.defaults = append(r.defaults, s.Name())
+	}
+	return nil
+}
+
+// Names of all sinks, sorted
+func (r *Registry) Names() []string {
+	return r.names
+}
+
+// Get sink by name
+func (r *Registry) Get(name string) (Sink, bool) {
+	s, ok := r.sinks[name]
+	return s, ok
+}
+
+// Relays - sinks receiving raw messages
+func (r *Registry) Relays() []Relay {
+	return r.relays
+}
+
+// Route resolves sink names of the rule, empty names mean all sinks except relays
+func (r *Registry) Route(names []string) ([]Sink, error) {
+	if len(names) == 0 {
+		names = r.defaults
+	}
+
+	result := make([]Sink, 0, len(names))
+	for _, name := range names {
+		s, ok := r.sinks[name]
+		if !ok {
+			return nil, errors.Newf("unknown sink %q", name)
+		}
+
+		if _, ok = s.(Relay); ok {
+			return nil, errors.Newf("sink %q is a relay, it is filtered by its own 'rules'", name)
+		}
+		result = append(result, s)
+	}
+
+	if len(result) == 0 {
+		return nil, errors.New("no sinks configured")
+	}
+
+	return result, nil
+}
+
+// Health of every sink by name, nil means healthy
+func (r *Registry) Health() map[string]error {
+	result := make(map[string]error, len(r.sinks))
+	for name, s := range r.sinks {
+		result[name] = s.Health()
+	}
+	return result
+}
+
+// Circuits - circuit breaker state of sinks writing with the batcher, by name
+func (r *Registry) Circuits() map[string]CircuitState {
+	result := make(map[string]CircuitState, len(r.sinks))
+	for name, s := range r.sinks {
+		if c, ok := s.(Circuit); ok {
+			result[name] = c.Circuit()
+		}
+	}
+	return result
+}
+
+// Flush all sinks
+func (r *Registry) Flush(ctx context.Context) error {
+	var lastError error
+	for _, name := range r.names {
+		if err := r.sinks[name].Flush(ctx); err != nil {
+			r.log.Error("sink flush failed", zap.String("sink", name), zap.Error(err))
+			lastError = err
+		}
+	}
+	return lastError
+}
+
+// Start sinks with background workers, they run until stopped
+func (r *Registry) Start(ctx context.Context) error {
+	for _, name := range r.names {
+		if svc, ok := r.sinks[name].(Service); ok {
+			if err := svc.Start(ctx); err != nil {
+				return errors.Notef(err, nil, "sink %q", name)
+			}
+		}
+	}
+	return nil
+}
+
+// Stop sinks concurrently, pending rows are written or spilled until context is done
+func (r *Registry) Stop(ctx context.Context) error {
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		lastError error
+	)
+
+	for _, name := range r.names {
+		svc, ok := r.sinks[name].(Service)
+		if !ok {
+			continue
+		}
+
+		wg.Add(1)
+		go func(name string, svc Service) {
+			defer wg.Done()
+
+			if err := svc.Stop(ctx); err != nil {
+				r.log.Error("sink stop failed", zap.String("sink", name), zap.Error(err))
+				mu.Lock()
+				lastError = err
+				mu.Unlock()
+			}
+		}(name, svc)
+	}
+
+	wg.Wait()
+	return lastError
+}
@@ -0,0 +1,216 @@
+package relay
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/archaron/juniper-natlog/common"
+	"github.com/archaron/juniper-natlog/modules/sink"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+const (
+	ProtocolUDP = "udp"
+	ProtocolTCP = "tcp"
+	ProtocolTLS = "tls"
+
+	// FramingNewline - messages are terminated by LF (RFC6587 non-transparent framing)
+	FramingNewline = "newline"
+	// FramingOctet - messages are prefixed by their length (RFC6587 octet counting)
+	FramingOctet = "octet"
+)
+
+type (
+	Settings struct {
+		// Rules - relay messages matched by any of these rules, all messages when empty
+		Rules   []string
+		Targets []TargetSettings
+	}
+
+	TargetSettings struct {
+		Address  string
+		Protocol string
+		// Framing of tcp and tls streams
+		Framing string
+		// QueueSize - messages waiting for the target, newer messages are dropped when queue is full
+		QueueSize         int           `mapstructure:"queue_size"`
+		DialTimeout       time.Duration `mapstructure:"dial_timeout"`
+		WriteTimeout      time.Duration `mapstructure:"write_timeout"`
+		ReconnectInterval time.Duration `mapstructure:"reconnect_interval"`
+		TLS               common.TLSSettings
+	}
+
+	// Sink re-emits raw syslog messages to every target, each target has its own queue and connection
+	Sink struct {
+		name    string
+		log     *zap.Logger
+		rules   map[string]bool
+		targets []*target
+
+		once   sync.Once
+		cancel context.CancelFunc
+	}
+)
+
+func newSettings(v *viper.Viper) (*Settings, error) {
+	var cfg Settings
+	if err := v.Unmarshal(&cfg); err != nil {
+		return nil, err
+	}
+
+	if len(cfg.Targets) == 0 {
+		return nil, errors.New("'targets' is required")
+	}
+
+	for i := range cfg.Targets {
+		t := &cfg.Targets[i]
+		if t.Address == "" {
+			return nil, errors.Newf("target %d: 'address' is required", i)
+		}
+
+		if t.Protocol == "" {
+			t.Protocol = ProtocolUDP
+		}
+
+		switch t.Protocol {
+		case ProtocolUDP, ProtocolTCP, ProtocolTLS:
+		default:
+			return nil, errors.Newf("target %q: unknown protocol %q", t.Address, t.Protocol)
+		}
+
+		if t.Framing == "" {
+			t.Framing = FramingNewline
+		}
+
+		switch t.Framing {
+		case FramingNewline, FramingOctet:
+		default:
+			return nil, errors.Newf("target %q: unknown framing %q", t.Address, t.Framing)
+		}
+
+		if t.QueueSize <= 0 {
+			t.QueueSize = 10000
+		}
+
+		if t.DialTimeout <= 0 {
+			t.DialTimeout = 5 * time.Second
+		}
+
+		if t.WriteTimeout <= 0 {
+			t.WriteTimeout = 5 * time.Second
+		}
+
+		if t.ReconnectInterval <= 0 {
+			t.ReconnectInterval = time.Second
+		}
+	}
+
+	return &cfg, nil
+}
+
+func newSink(name string, v *viper.Viper, log *zap.Logger) (sink.Sink, error) {
+	cfg, err := newSettings(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return New(name, cfg, log)
+}
+
+// New creates relay to targets of the settings
+func New(name string, cfg *Settings, log *zap.Logger) (*Sink, error) {
+	s := &Sink{
+		name:   name,
+		log:    log,
+		cancel: func() {},
+	}
+
+	if len(cfg.Rules) > 0 {
+		s.rules = make(map[string]bool, len(cfg.Rules))
+		for _, rule := range cfg.Rules {
+			s.rules[rule] = true
+		}
+	}
+
+	for _, tc := range cfg.Targets {
+		t, err := newTarget(name, tc, log.With(zap.String("target", tc.Address)))
+		if err != nil {
+			return nil, errors.Notef(err, nil, "target %q", tc.Address)
+		}
+		s.targets = append(s.targets, t)
+	}
+
+	return s, nil
+}
+
+func (s *Sink) Name() string {
+	return s.name
+}
+
+// RegisterModel - relay does not store rows
+func (s *Sink) RegisterModel(string, *common.Model) error {
+	return nil
+}
+
+// Insert - relay does not store rows
+func (s *Sink) Insert(*common.FlowMessage) {}
+
+// Relay queues the message to every target, when it matched any of relayed rules or rules are not set
+func (s *Sink) Relay(raw string, rules []string) {
+	if s.rules != nil && !s.match(rules) {
+		return
+	}
+
+	for _, t := range s.targets {
+		t.enqueue(raw)
+	}
+}
+
+func (s *Sink) match(rules []string) bool {
+	for _, rule := range rules {
+		if s.rules[rule] {
+			return true
+		}
+	}
+	return false
+}
+
+// Flush waits until queues of all targets are sent
+func (s *Sink) Flush(ctx context.Context) error {
+	for _, t := range s.targets {
+		if err := t.wait(ctx); err != nil {
+			return errors.Notef(err, nil, "target %q", t.cfg.Address)
+		}
+	}
+	return nil
+}
+
+// Health reports the first target failing to send
+func (s *Sink) Health() error {
+	for _, t := range s.targets {
+		if err := t.health(); err != nil {
+			return errors.Notef(err, nil, "target %q", t.cfg.Address)
+		}
+	}
+	return nil
+}
+
+func (s *Sink) Start(ctx context.Context) error {
+	s.once.Do(func() {
+		ctx, s.cancel = context.WithCancel(ctx)
+		for _, t := range s.targets {
+			go t.run(ctx)
+		}
+	})
+	return nil
+}
+
+// Stop sends queued messages until context is done
+func (s *Sink) Stop(ctx context.Context) error {
+	err := s.Flush(ctx)
+	s.cancel()
+	return err
+}
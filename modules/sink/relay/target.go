@@ -0,0 +1,197 @@
+package relay
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+var (
+	relaySent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "natlog",
+		Subsystem: "relay",
+		Name:      "sent_total",
+		Help:      "Messages sent to the relay target",
+	}, []string{"sink", "target"})
+
+	relayDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "natlog",
+		Subsystem: "relay",
+		Name:      "dropped_total",
+		Help:      "Messages dropped because queue of the relay target was full",
+	}, []string{"sink", "target"})
+)
+
+// target sends queued messages over its own connection, reconnecting on errors
+type target struct {
+	cfg  TargetSettings
+	log  *zap.Logger
+	tls  *tls.Config
+	conn net.Conn
+
+	queue chan string
+	// pending - queued and not yet sent messages
+	pending int64
+
+	sent    prometheus.Counter
+	dropped prometheus.Counter
+
+	mu      sync.Mutex
+	lastErr error
+}
+
+// host of the address, server name of TLS targets
+func host(address string) string {
+	if h, _, err := net.SplitHostPort(address); err == nil {
+		return h
+	}
+	return address
+}
+
+func newTarget(sink string, cfg TargetSettings, log *zap.Logger) (*target, error) {
+	t := &target{
+		cfg:     cfg,
+		log:     log,
+		queue:   make(chan string, cfg.QueueSize),
+		sent:    relaySent.WithLabelValues(sink, cfg.Address),
+		dropped: relayDropped.WithLabelValues(sink, cfg.Address),
+	}
+
+	if cfg.Protocol == ProtocolTLS {
+		var err error
+		if t.tls, err = cfg.TLS.Config(host(cfg.Address)); err != nil {
+			return nil, errors.Notef(err, nil, "tls")
+		}
+	}
+
+	return t, nil
+}
+
+// enqueue message without blocking the listener, message is dropped when queue is full
+func (t *target) enqueue(raw string) {
+	atomic.AddInt64(&t.pending, 1)
+	select {
+	case t.queue <- raw:
+	default:
+		atomic.AddInt64(&t.pending, -1)
+		t.dropped.Inc()
+	}
+}
+
+// wait until queue is sent
+func (t *target) wait(ctx context.Context) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for atomic.LoadInt64(&t.pending) > 0 {
+		select {
+		case <-ctx.Done():
+			return errors.Notef(ctx.Err(), nil, "%d messages not sent", atomic.LoadInt64(&t.pending))
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+func (t *target) health() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.lastErr
+}
+
+func (t *target) setError(err error) {
+	t.mu.Lock()
+	t.lastErr = err
+	t.mu.Unlock()
+}
+
+func (t *target) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: t.cfg.DialTimeout}
+	switch t.cfg.Protocol {
+	case ProtocolTLS:
+		return tls.DialWithDialer(dialer, "tcp", t.cfg.Address, t.tls)
+	default:
+		return dialer.Dial(t.cfg.Protocol, t.cfg.Address)
+	}
+}
+
+// frame message for the stream, datagrams carry message as is
+func (t *target) frame(raw string) []byte {
+	if t.cfg.Protocol == ProtocolUDP {
+		return []byte(raw)
+	}
+
+	if t.cfg.Framing == FramingOctet {
+		return []byte(strconv.Itoa(len(raw)) + " " + raw)
+	}
+
+	return []byte(raw + "\n")
+}
+
+func (t *target) send(raw string) error {
+	if t.conn == nil {
+		conn, err := t.dial()
+		if err != nil {
+			return err
+		}
+		t.conn = conn
+		t.log.Info("relay target connected")
+	}
+
+	if err := t.conn.SetWriteDeadline(time.Now().Add(t.cfg.WriteTimeout)); err != nil {
+		return err
+	}
+
+	_, err := t.conn.Write(t.frame(raw))
+	return err
+}
+
+func (t *target) close() {
+	if t.conn != nil {
+		_ = t.conn.Close()
+		t.conn = nil
+	}
+}
+
+// run sends queued messages, message failed to send is retried after reconnect
+func (t *target) run(ctx context.Context) {
+	defer t.close()
+
+	for {
+		var raw string
+		select {
+		case <-ctx.Done():
+			return
+		case raw = <-t.queue:
+		}
+
+		for {
+			err := t.send(raw)
+			t.setError(err)
+			if err == nil {
+				break
+			}
+
+			t.log.Warn("relay target failed", zap.Error(err))
+			t.close()
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(t.cfg.ReconnectInterval):
+			}
+		}
+
+		atomic.AddInt64(&t.pending, -1)
+		t.sent.Inc()
+	}
+}
@@ -0,0 +1,107 @@
+package sink
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/spf13/viper"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+const (
+	CircuitClosed   CircuitState = "closed"
+	CircuitOpen     CircuitState = "open"
+	CircuitHalfOpen CircuitState = "half_open"
+)
+
+type (
+	// CircuitState of batch writes: closed - writes pass, open - writes are suspended until backoff expires,
+	// half_open - the next write probes whether the destination recovered
+	CircuitState string
+
+	// Circuit is implemented by sinks writing with the batcher
+	Circuit interface {
+		Circuit() CircuitState
+	}
+
+	// RetrySettings of failed batch writes
+	RetrySettings struct {
+		// MinBackoff - delay after the first failure, doubled with every consecutive failure up to MaxBackoff
+		MinBackoff time.Duration `mapstructure:"min_backoff"`
+		MaxBackoff time.Duration `mapstructure:"max_backoff"`
+		// Threshold - consecutive failures opening the circuit
+		Threshold int `mapstructure:"breaker_threshold"`
+	}
+
+	permanentError struct {
+		error
+	}
+)
+
+// NewRetrySettings reads retry settings from the `<key>` section
+func NewRetrySettings(v *viper.Viper, key string) (RetrySettings, error) {
+	v.SetDefault(key+".min_backoff", time.Second)
+	v.SetDefault(key+".max_backoff", time.Minute)
+	v.SetDefault(key+".breaker_threshold", 5)
+
+	r := RetrySettings{
+		MinBackoff: v.GetDuration(key + ".min_backoff"),
+		MaxBackoff: v.GetDuration(key + ".max_backoff"),
+		Threshold:  v.GetInt(key + ".breaker_threshold"),
+	}
+
+	if r.MinBackoff <= 0 || r.MaxBackoff < r.MinBackoff {
+		return r, errors.Newf("%s: 'min_backoff' must be positive and not greater than 'max_backoff'", key)
+	}
+
+	if r.Threshold < 1 {
+		return r, errors.Newf("%s: 'breaker_threshold' must be positive", key)
+	}
+
+	return r, nil
+}
+
+// backoff before the next write after consecutive failures, with jitter in [delay/2, delay)
+func (r RetrySettings) backoff(failures int) time.Duration {
+	delay := r.MinBackoff
+	for i := 1; i < failures && delay < r.MaxBackoff; i++ {
+		delay *= 2
+	}
+
+	if delay > r.MaxBackoff {
+		delay = r.MaxBackoff
+	}
+
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Permanent marks error that will not go away on retry (e.g. schema mismatch), batch is dropped
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err}
+}
+
+// IsPermanent reports whether error or any error it wraps is marked as permanent
+func IsPermanent(err error) bool {
+	for err != nil {
+		if _, ok := err.(*permanentError); ok {
+			return true
+		}
+
+		switch e := err.(type) {
+		case interface{ Underlying() error }:
+			err = e.Underlying()
+		case interface{ Unwrap() error }:
+			err = e.Unwrap()
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+func (e *permanentError) Underlying() error {
+	return e.error
+}
@@ -0,0 +1,69 @@
+package sink
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sequenceReserve - sequence numbers reserved by one write of the sequence file
+const sequenceReserve = 1000
+
+// sequence numbers batches, numbers are reserved in the file before use, so they are not reused after restart.
+// Without a file it starts from the current time.
+type sequence struct {
+	path     string
+	next     uint64
+	reserved uint64
+}
+
+func openSequence(path string) (*sequence, error) {
+	s := &sequence{path: path, next: uint64(time.Now().UnixNano())}
+	if path == "" {
+		return s, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, s.reserve()
+	} else if err != nil {
+		return nil, err
+	}
+
+	if s.next, err = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64); err != nil {
+		return nil, err
+	}
+
+	return s, s.reserve()
+}
+
+// reserve next numbers, the file is replaced atomically
+func (s *sequence) reserve() error {
+	s.reserved = s.next + sequenceReserve
+	if s.path == "" {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.FormatUint(s.reserved, 10)+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// id of the next batch of the rule, the id is valid even when reservation could not be written
+func (s *sequence) id(name, rule string) (string, error) {
+	var err error
+	if s.next >= s.reserved {
+		err = s.reserve()
+	}
+
+	s.next++
+	return name + "-" + rule + "-" + strconv.FormatUint(s.next, 10), err
+}
@@ -0,0 +1,53 @@
+package sink
+
+import (
+	"context"
+
+	"github.com/archaron/juniper-natlog/common"
+	"github.com/spf13/viper"
+	"go.uber.org/dig"
+	"go.uber.org/zap"
+)
+
+type (
+	// Sink is a destination of converted rule rows
+	Sink interface {
+		Name() string
+		RegisterModel(rule string, model *common.Model) error
+		Insert(message *common.FlowMessage)
+		Flush(ctx context.Context) error
+		Health() error
+	}
+
+	// Relay is a sink receiving every raw syslog message once, with names of rules the message matched.
+	// Relays do not store rule rows and are not among default sinks of rules.
+	Relay interface {
+		Sink
+		Relay(raw string, rules []string)
+	}
+
+	// Service is a sink with background workers, sinks are started and stopped by the registry.
+	// Stop writes pending rows, or spills them, before the context is done.
+	Service interface {
+		Start(ctx context.Context) error
+		Stop(ctx context.Context) error
+	}
+
+	// Factory creates sink of the Type from `sinks.<name>` config section, sub-viper is rooted at that section
+	Factory struct {
+		Type string
+		New  func(name string, v *viper.Viper, log *zap.Logger) (Sink, error)
+	}
+
+	// Out - provide sink instance, nil sinks are ignored
+	Out struct {
+		dig.Out
+		Sink Sink `group:"sinks"`
+	}
+
+	// FactoryOut - provide sink factory
+	FactoryOut struct {
+		dig.Out
+		Factory Factory `group:"sink_factories"`
+	}
+)
@@ -0,0 +1,366 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/archaron/juniper-natlog/common"
+	"github.com/archaron/juniper-natlog/modules/sink"
+	// SQLite driver, `make build` links the system library with `libsqlite3` tag
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+type (
+	Settings struct {
+		Path        string
+		BusyTimeout time.Duration
+		// Retention - rows with TimeField older than that are removed hourly, zero keeps rows forever
+		Retention time.Duration
+		TimeField string
+		// Indexes - field lists to index in every table having all of them
+		Indexes [][]string
+
+		BatchSize    int
+		BatchTimeout time.Duration
+		Batch        sink.BatchSettings
+		Retry        sink.RetrySettings
+		Queue        sink.QueueSettings
+	}
+
+	// Sink stores rows of every rule in embedded SQLite database, tables are created from rule models
+	Sink struct {
+		name string
+		con  *sql.DB
+		log  *zap.Logger
+		cfg  *Settings
+
+		once   sync.Once
+		cancel context.CancelFunc
+
+		batcher *sink.Batcher
+		models  map[string]*common.Model
+		tables  map[string]*common.Model
+	}
+)
+
+func newSettings(v *viper.Viper) (*Settings, error) {
+	v.SetDefault("path", "/opt/natlog/var/db/natlog.db")
+	v.SetDefault("busy_timeout", 5*time.Second)
+	v.SetDefault("time_field", "timestamp")
+	v.SetDefault("batch_size", 10000)
+	v.SetDefault("batch_timeout", 10*time.Second)
+
+	cfg := &Settings{
+		Path:         v.GetString("path"),
+		BusyTimeout:  v.GetDuration("busy_timeout"),
+		Retention:    v.GetDuration("retention"),
+		TimeField:    v.GetString("time_field"),
+		BatchSize:    v.GetInt("batch_size"),
+		BatchTimeout: v.GetDuration("batch_timeout"),
+	}
+
+	if err := v.UnmarshalKey("indexes", &cfg.Indexes); err != nil {
+		return nil, errors.Notef(err, nil, "indexes")
+	}
+
+	if cfg.Path == "" {
+		return nil, errors.New("'path' is required")
+	}
+
+	batch, err := sink.NewBatchSettings(v, "batch", cfg.BatchSize, cfg.BatchTimeout)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Batch = batch
+
+	retry, err := sink.NewRetrySettings(v, "retry")
+	if err != nil {
+		return nil, err
+	}
+	cfg.Retry = retry
+
+	queue, err := sink.NewQueueSettings(v, "queue")
+	if err != nil {
+		return nil, err
+	}
+	cfg.Queue = queue
+
+	return cfg, nil
+}
+
+func (s Settings) buildDSN() string {
+	q := url.Values{}
+	q.Set("_busy_timeout", fmt.Sprint(s.BusyTimeout.Milliseconds()))
+	q.Set("_journal_mode", "WAL")
+	q.Set("_synchronous", "NORMAL")
+	return "file:" + s.Path + "?" + q.Encode()
+}
+
+func newSink(name string, v *viper.Viper, log *zap.Logger) (sink.Sink, error) {
+	cfg, err := newSettings(v)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(cfg.Path), 0755); err != nil {
+		return nil, err
+	}
+
+	s := &Sink{
+		name:   name,
+		log:    log,
+		cfg:    cfg,
+		cancel: func() {},
+		models: make(map[string]*common.Model),
+		tables: make(map[string]*common.Model),
+	}
+
+	if s.con, err = sql.Open("sqlite3", cfg.buildDSN()); err != nil {
+		return nil, err
+	}
+
+	if err = s.con.Ping(); err != nil {
+		_ = s.con.Close()
+		return nil, err
+	}
+
+	s.batcher = sink.NewBatcher(name, log, cfg.BatchSize, cfg.BatchTimeout, s.insertBatch)
+	s.batcher.SetLimits(cfg.Batch)
+	s.batcher.SetRetry(cfg.Retry)
+	if err = s.batcher.SetQueue(cfg.Queue); err != nil {
+		_ = s.con.Close()
+		return nil, err
+	}
+
+	log.Info("sqlite opened", zap.String("path", cfg.Path))
+
+	return s, nil
+}
+
+func (s *Sink) Name() string {
+	return s.name
+}
+
+// Circuit state of batch writes
+func (s *Sink) Circuit() sink.CircuitState {
+	return s.batcher.Circuit()
+}
+
+func (s *Sink) Health() error {
+	return s.con.Ping()
+}
+
+func columnType(f common.ConvertableField) string {
+	switch f.(type) {
+	case *common.StringModelField:
+		return "TEXT"
+	case *common.IpModelField:
+		return "BLOB"
+	default:
+		return "INTEGER"
+	}
+}
+
+// quote identifier, a table qualified with the tenant database is one name: SQLite has no schemas besides attached
+// database files, the table is kept in the main database
+func quote(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// RegisterModel creates table of the model, rules sharing a table must have the same fields
+func (s *Sink) RegisterModel(rule string, model *common.Model) error {
+	s.log.Debug("register model", zap.String("rule", rule))
+
+	columns := make([]string, 0, len(model.Fields))
+	names := make([]string, 0, len(model.Fields))
+	fields := make(map[string]bool, len(model.Fields))
+	for _, f := range model.Fields {
+		columns = append(columns, quote(f.GetName())+" "+columnType(f))
+		names = append(names, quote(f.GetName()))
+		fields[f.GetName()] = true
+	}
+
+	if _, ok := s.tables[model.Table]; !ok {
+		if err := s.createTable(model.Table, columns, fields); err != nil {
+			return errors.Notef(err, nil, "cannot create table %q", model.Table)
+		}
+		s.tables[model.Table] = model
+	}
+
+	model.Statement = fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)",
+		quote(model.Table), strings.Join(names, ", "), strings.TrimSuffix(strings.Repeat("?, ", len(names)), ", "))
+
+	s.models[rule] = model
+	s.batcher.Register(rule)
+	return nil
+}
+
+func (s *Sink) createTable(table string, columns []string, fields map[string]bool) error {
+	if _, err := s.con.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", quote(table), strings.Join(columns, ", "))); err != nil {
+		return err
+	}
+
+	indexes := s.cfg.Indexes
+	if fields[s.cfg.TimeField] {
+		indexes = append([][]string{{s.cfg.TimeField}}, indexes...)
+	}
+
+next:
+	for _, index := range indexes {
+		for _, name := range index {
+			if !fields[name] {
+				continue next
+			}
+		}
+
+		names := make([]string, 0, len(index))
+		for _, name := range index {
+			names = append(names, quote(name))
+		}
+
+		statement := fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (%s)",
+			quote(table+"_"+strings.Join(index, "_")), quote(table), strings.Join(names, ", "))
+		if _, err := s.con.Exec(statement); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Sink) Insert(message *common.FlowMessage) {
+	s.batcher.Insert(message)
+}
+
+// Flush pending batches of all rules
+func (s *Sink) Flush(ctx context.Context) error {
+	return s.batcher.Flush(ctx)
+}
+
+// insertBatch writes rule rows in one transaction, rows with unconvertible fields are skipped
+func (s *Sink) insertBatch(ctx context.Context, rule, _ string, items []common.FlowMessagePayload, reason string) error {
+	model := s.models[rule]
+
+	tx, err := s.con.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Notef(err, nil, "could not begin transaction")
+	}
+
+	stmt, err := tx.PrepareContext(ctx, model.Statement)
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			s.log.Error("transaction rollback error", zap.Error(rbErr))
+		}
+		return errors.Notef(err, nil, "could not prepare insert statement")
+	}
+	defer stmt.Close()
+
+	for _, msg := range items {
+		values, err := model.Convert(msg)
+		if err != nil {
+			s.log.Error("cannot convert field", zap.Error(err), zap.String("rule", rule), zap.String("reason", reason))
+			continue
+		}
+
+		if _, err = stmt.ExecContext(ctx, values...); err != nil {
+			if rbErr := tx.Rollback(); rbErr != nil {
+				s.log.Error("transaction rollback error", zap.Error(rbErr))
+			}
+			return errors.Notef(err, nil, "could not exec insert statement")
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return errors.Notef(err, nil, "could not commit transaction")
+	}
+
+	return nil
+}
+
+// Attribute looks up the latest rule row covering public address and port, timestamps are stored as unix seconds
+func (s *Sink) Attribute(ctx context.Context, rule string, q *sink.AttributionQuery) (map[string]interface{}, error) {
+	model, ok := s.models[rule]
+	if !ok {
+		return nil, errors.Newf("rule %q is not stored in sink %q", rule, s.name)
+	}
+
+	statement, args, err := q.Statement(model, quote)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.con.QueryContext(ctx, statement, append(args, q.From.Unix(), q.Time.Unix())...)
+	if err != nil {
+		return nil, err
+	}
+
+	return sink.ScanRow(model, rows)
+}
+
+// purge removes rows out of retention from every table having the time field
+func (s *Sink) purge(now time.Time) {
+	for table, model := range s.tables {
+		for _, f := range model.Fields {
+			if f.GetName() != s.cfg.TimeField {
+				continue
+			}
+
+			res, err := s.con.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s < ?", quote(table), quote(s.cfg.TimeField)), now.Add(-s.cfg.Retention).Unix())
+			if err != nil {
+				s.log.Error("could not purge table", zap.String("table", table), zap.Error(err))
+				continue
+			}
+
+			if n, _ := res.RowsAffected(); n > 0 {
+				s.log.Info("rows removed by retention", zap.String("table", table), zap.Int64("rows", n))
+			}
+		}
+	}
+}
+
+func (s *Sink) Start(ctx context.Context) error {
+	s.once.Do(func() {
+		ctx, s.cancel = context.WithCancel(ctx)
+		go s.batcher.Run(ctx)
+
+		if s.cfg.Retention > 0 {
+			go s.retention(ctx)
+		}
+	})
+	return nil
+}
+
+func (s *Sink) retention(ctx context.Context) {
+	s.purge(time.Now())
+
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.purge(now)
+		}
+	}
+}
+
+// Stop writes pending rows and closes the database
+func (s *Sink) Stop(ctx context.Context) error {
+	if err := s.batcher.Close(ctx); err != nil {
+		s.log.Error("could not write pending rows", zap.Error(err))
+	}
+	s.cancel()
+	return s.con.Close()
+}
@@ -0,0 +1,301 @@
+package subscriber
+
+import (
+	"context"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/archaron/juniper-natlog/common"
+	"github.com/archaron/juniper-natlog/modules/sink"
+	"github.com/spf13/viper"
+	"go.uber.org/dig"
+	"go.uber.org/zap"
+	"gopkg.in/errgo.v2/fmt/errors"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2866"
+)
+
+// Route - name session rows are registered in sinks with, rules must not use it
+const Route = "radius"
+
+const (
+	defaultTable     = "radius_sessions"
+	defaultIdle      = 24 * time.Hour
+	defaultRetention = time.Hour
+
+	timestampLayout = "2006-01-02 15:04:05"
+
+	sessionsDDL = `CREATE TABLE IF NOT EXISTS {{.Table}} (
+	timestamp  DateTime,
+	event      LowCardinality(String),
+	ip         UInt32,
+	username   String,
+	session_id String,
+	nas        LowCardinality(String)
+) ENGINE = MergeTree()
+PARTITION BY toYYYYMMDD(timestamp)
+ORDER BY (ip, timestamp)`
+)
+
+type (
+	accountingParams struct {
+		dig.In
+
+		Viper  *viper.Viper
+		Logger *zap.Logger
+		Sinks  *sink.Registry
+	}
+
+	// Accounting listens to RADIUS accounting of the BNG, keeps subscriber sessions by Framed-IP-Address and writes
+	// session events to sinks. It is started and stopped by the syslog listener, as the sinks are.
+	Accounting struct {
+		log      *zap.Logger
+		address  string
+		secret   []byte
+		sessions *sessions
+		routes   []sink.Sink
+
+		server *radius.PacketServer
+		done   chan struct{}
+	}
+)
+
+func newAccounting(p accountingParams) (*Accounting, error) {
+	v := p.Viper
+	v.SetDefault("radius.table", defaultTable)
+	v.SetDefault("radius.idle_timeout", defaultIdle)
+	v.SetDefault("radius.retention", defaultRetention)
+
+	a := &Accounting{
+		log:      p.Logger.With(zap.String("component", "radius")),
+		address:  v.GetString("radius.address"),
+		sessions: newSessions(v.GetDuration("radius.idle_timeout"), v.GetDuration("radius.retention")),
+	}
+
+	if a.address == "" {
+		return a, nil
+	}
+
+	secret, err := readSecret(v)
+	if err != nil {
+		return nil, err
+	}
+	a.secret = []byte(secret)
+
+	table := v.GetString("radius.table")
+	if table == "" {
+		return a, nil
+	}
+
+	names := v.GetStringSlice("radius.sinks")
+	if len(names) == 0 {
+		names = v.GetStringSlice("syslog.sinks")
+	}
+
+	if a.routes, err = p.Sinks.Route(names); err != nil {
+		return nil, errors.Notef(err, nil, "radius")
+	}
+
+	for _, snk := range a.routes {
+		m := model(table)
+		if err := snk.RegisterModel(Route, &m); err != nil {
+			return nil, errors.Notef(err, nil, "radius: sink %q", snk.Name())
+		}
+	}
+
+	return a, nil
+}
+
+// readSecret - shared secret of NAS, inline or from the environment variable or the file
+func readSecret(v *viper.Viper) (string, error) {
+	secret := v.GetString("radius.secret")
+
+	if name := v.GetString("radius.secret_env"); name != "" {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", errors.Newf("radius secret environment variable %q is not set", name)
+		}
+		secret = value
+	}
+
+	if file := v.GetString("radius.secret_file"); file != "" {
+		value, err := os.ReadFile(file)
+		if err != nil {
+			return "", errors.Notef(err, nil, "radius secret file")
+		}
+		secret = strings.TrimSpace(string(value))
+	}
+
+	if secret == "" {
+		return "", errors.New("radius: 'secret' is required")
+	}
+
+	return secret, nil
+}
+
+// model of session rows
+func model(table string) common.Model {
+	return common.Model{
+		Table: table,
+		DDL:   sessionsDDL,
+		Fields: []common.ConvertableField{
+			&common.TimestampModelField{
+				ModelField: common.ModelField{Name: "timestamp", Type: common.TypeTimestamp},
+				Layout:     timestampLayout,
+			},
+			&common.StringModelField{ModelField: common.ModelField{Name: "event", Type: common.TypeString}},
+			&common.IpToIntModelField{ModelField: common.ModelField{Name: "ip", Type: "ip2int"}},
+			&common.StringModelField{ModelField: common.ModelField{Name: "username", Type: common.TypeString}},
+			&common.StringModelField{ModelField: common.ModelField{Name: "session_id", Type: common.TypeString}},
+			&common.StringModelField{ModelField: common.ModelField{Name: "nas", Type: common.TypeString}},
+		},
+	}
+}
+
+// Enabled reports whether the accounting listener is configured
+func (a *Accounting) Enabled() bool {
+	return a != nil && a.address != ""
+}
+
+// Lookup subscriber who had the address at the time, empty when unknown
+func (a *Accounting) Lookup(ip string, at time.Time) string {
+	user, ok := a.sessions.lookup(ip, at)
+	if !ok {
+		lookups.WithLabelValues("unknown").Inc()
+		return ""
+	}
+
+	lookups.WithLabelValues("found").Inc()
+	return user
+}
+
+// Start listening, does nothing when disabled
+func (a *Accounting) Start() error {
+	if !a.Enabled() {
+		return nil
+	}
+
+	conn, err := net.ListenPacket("udp", a.address)
+	if err != nil {
+		return errors.Notef(err, nil, "radius")
+	}
+
+	a.server = &radius.PacketServer{
+		Handler:      radius.HandlerFunc(a.ServeRADIUS),
+		SecretSource: radius.StaticSecretSource(a.secret),
+	}
+	a.done = make(chan struct{})
+
+	go func() {
+		defer close(a.done)
+		defer conn.Close()
+
+		if err := a.server.Serve(conn); err != nil && err != radius.ErrServerShutdown {
+			a.log.Error("radius listener failed", zap.Error(err))
+		}
+	}()
+
+	a.log.Info("radius accounting listener started", zap.String("address", conn.LocalAddr().String()))
+	return nil
+}
+
+// Shutdown stops listening and waits for requests being handled, their rows are inserted before sinks stop
+func (a *Accounting) Shutdown(ctx context.Context) error {
+	if a.server == nil {
+		return nil
+	}
+
+	if err := a.server.Shutdown(ctx); err != nil {
+		return err
+	}
+
+	select {
+	case <-a.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ServeRADIUS tracks the session of the accounting request, writes its row and acknowledges it. Accounting requests
+// are answered even when ignored, e.g. without Framed-IP-Address, so the NAS does not retransmit them. Packets of
+// other codes have no accounting response and are dropped unanswered.
+func (a *Accounting) ServeRADIUS(w radius.ResponseWriter, r *radius.Request) {
+	if r.Code != radius.CodeAccountingRequest {
+		accountingIgnored.Inc()
+		return
+	}
+
+	now := time.Now()
+	a.handle(r.Packet, nasAddress(r), now)
+	a.sessions.sweep(now)
+
+	if err := w.Write(r.Response(radius.CodeAccountingResponse)); err != nil {
+		a.log.Error("cannot send accounting response", zap.Stringer("nas", r.RemoteAddr), zap.Error(err))
+	}
+}
+
+func (a *Accounting) handle(p *radius.Packet, nas string, now time.Time) {
+	status := rfc2866.AcctStatusType_Get(p)
+	accountingRequests.WithLabelValues(status.String()).Inc()
+
+	switch status {
+	case rfc2866.AcctStatusType_Value_AccountingOn, rfc2866.AcctStatusType_Value_AccountingOff:
+		a.sessions.stopNAS(nas, now)
+		return
+	}
+
+	framed := rfc2865.FramedIPAddress_Get(p)
+	user := rfc2865.UserName_GetString(p)
+	if framed == nil || user == "" {
+		accountingIgnored.Inc()
+		return
+	}
+
+	ip := framed.String()
+	id := rfc2866.AcctSessionID_GetString(p)
+
+	switch status {
+	case rfc2866.AcctStatusType_Value_Start:
+		a.sessions.start(ip, id, user, nas, now)
+	case rfc2866.AcctStatusType_Value_InterimUpdate:
+		started := now.Add(-time.Duration(rfc2866.AcctSessionTime_Get(p)) * time.Second)
+		a.sessions.update(ip, id, user, nas, started, now)
+	case rfc2866.AcctStatusType_Value_Stop:
+		a.sessions.stop(ip, id, now)
+	default:
+		accountingIgnored.Inc()
+		return
+	}
+
+	msg := &common.FlowMessage{
+		Rule: Route,
+		Fields: common.FlowMessagePayload{
+			"timestamp":  now.UTC().Format(timestampLayout),
+			"event":      status.String(),
+			"ip":         ip,
+			"username":   user,
+			"session_id": id,
+			"nas":        nas,
+		},
+	}
+
+	for _, snk := range a.routes {
+		snk.Insert(msg)
+	}
+}
+
+// nasAddress - NAS-IP-Address of the request, or its sender address
+func nasAddress(r *radius.Request) string {
+	if ip := rfc2865.NASIPAddress_Get(r.Packet); ip != nil {
+		return ip.String()
+	}
+
+	if host, _, err := net.SplitHostPort(r.RemoteAddr.String()); err == nil {
+		return host
+	}
+	return r.RemoteAddr.String()
+}
@@ -0,0 +1,169 @@
+package subscriber
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2866"
+)
+
+const testSecret = "s3cret"
+
+// startAccounting listens on a free loopback port, session rows are not written
+func startAccounting(t *testing.T) (*Accounting, string) {
+	t.Helper()
+
+	free, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := free.LocalAddr().String()
+	_ = free.Close()
+
+	v := viper.New()
+	v.Set("radius.address", address)
+	v.Set("radius.secret", testSecret)
+	v.Set("radius.table", "")
+
+	a, err := newAccounting(accountingParams{Viper: v, Logger: zap.NewNop()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = a.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if err := a.Shutdown(ctx); err != nil {
+			t.Error(err)
+		}
+	})
+
+	return a, address
+}
+
+type request struct {
+	status  rfc2866.AcctStatusType
+	ip      string
+	user    string
+	session string
+	// elapsed - Acct-Session-Time of interim updates
+	elapsed time.Duration
+}
+
+// send accounting request, returns time range the listener handled it in
+func send(t *testing.T, address, secret string, r request) (time.Time, time.Time) {
+	t.Helper()
+
+	p := radius.New(radius.CodeAccountingRequest, []byte(secret))
+	_ = rfc2866.AcctStatusType_Set(p, r.status)
+	if r.ip != "" {
+		_ = rfc2865.FramedIPAddress_Set(p, net.ParseIP(r.ip))
+	}
+	if r.user != "" {
+		_ = rfc2865.UserName_SetString(p, r.user)
+	}
+	if r.session != "" {
+		_ = rfc2866.AcctSessionID_SetString(p, r.session)
+	}
+	if r.elapsed > 0 {
+		_ = rfc2866.AcctSessionTime_Set(p, rfc2866.AcctSessionTime(r.elapsed/time.Second))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	before := time.Now()
+	resp, err := radius.Exchange(ctx, p, address)
+	if err != nil {
+		t.Fatalf("%s: %v", r.status, err)
+	}
+
+	if resp.Code != radius.CodeAccountingResponse {
+		t.Fatalf("%s: response code %s", r.status, resp.Code)
+	}
+
+	return before, time.Now()
+}
+
+func expectUser(t *testing.T, a *Accounting, ip string, at time.Time, user string) {
+	t.Helper()
+
+	if got := a.Lookup(ip, at); got != user {
+		t.Errorf("%s at %s: user %q, expected %q", ip, at.Format(time.StampMilli), got, user)
+	}
+}
+
+func TestAccountingTracksSessions(t *testing.T) {
+	a, address := startAccounting(t)
+	const ip = "100.64.0.7"
+
+	beforeStart, started := send(t, address, testSecret,
+		request{status: rfc2866.AcctStatusType_Value_Start, ip: ip, user: "alice", session: "1"})
+
+	expectUser(t, a, ip, beforeStart.Add(-time.Millisecond), "")
+	expectUser(t, a, ip, started, "alice")
+	expectUser(t, a, "::ffff:"+ip, started, "alice")
+
+	_, updated := send(t, address, testSecret,
+		request{status: rfc2866.AcctStatusType_Value_InterimUpdate, ip: ip, user: "alice", session: "1", elapsed: time.Minute})
+	expectUser(t, a, ip, updated, "alice")
+
+	beforeStop, stopped := send(t, address, testSecret,
+		request{status: rfc2866.AcctStatusType_Value_Stop, ip: ip, user: "alice", session: "1"})
+
+	// rows received late are attributed to the subscriber who had the address at their time
+	expectUser(t, a, ip, beforeStop, "alice")
+	expectUser(t, a, ip, stopped.Add(time.Millisecond), "")
+
+	// the address is reassigned
+	_, reassigned := send(t, address, testSecret,
+		request{status: rfc2866.AcctStatusType_Value_Start, ip: ip, user: "bob", session: "2"})
+	expectUser(t, a, ip, reassigned, "bob")
+	expectUser(t, a, ip, beforeStop, "alice")
+}
+
+func TestAccountingOpensSessionsOnInterimUpdate(t *testing.T) {
+	a, address := startAccounting(t)
+	const ip = "100.64.0.8"
+
+	// session started before the listener, e.g. before restart
+	before, updated := send(t, address, testSecret,
+		request{status: rfc2866.AcctStatusType_Value_InterimUpdate, ip: ip, user: "carol", session: "3", elapsed: 10 * time.Minute})
+
+	expectUser(t, a, ip, before.Add(-5*time.Minute), "carol")
+	expectUser(t, a, ip, updated.Add(-11*time.Minute), "")
+
+	// NAS reboot closes its sessions
+	_, rebooted := send(t, address, testSecret, request{status: rfc2866.AcctStatusType_Value_AccountingOn})
+	expectUser(t, a, ip, rebooted.Add(time.Millisecond), "")
+	expectUser(t, a, ip, before, "carol")
+}
+
+func TestAccountingDropsRequestsWithWrongSecret(t *testing.T) {
+	a, address := startAccounting(t)
+	const ip = "100.64.0.9"
+
+	p := radius.New(radius.CodeAccountingRequest, []byte("wrong"))
+	_ = rfc2866.AcctStatusType_Set(p, rfc2866.AcctStatusType_Value_Start)
+	_ = rfc2865.FramedIPAddress_Set(p, net.ParseIP(ip))
+	_ = rfc2865.UserName_SetString(p, "mallory")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	if _, err := radius.Exchange(ctx, p, address); err == nil {
+		t.Fatal("request with wrong secret is answered")
+	}
+
+	expectUser(t, a, ip, time.Now(), "")
+}
@@ -0,0 +1,36 @@
+package subscriber
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	accountingRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "natlog",
+		Subsystem: "radius",
+		Name:      "requests_total",
+		Help:      "Accounting requests by Acct-Status-Type",
+	}, []string{"status"})
+
+	accountingIgnored = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "natlog",
+		Subsystem: "radius",
+		Name:      "ignored_total",
+		Help:      "Authentic requests ignored: not accounting, or without Framed-IP-Address or User-Name",
+	})
+
+	sessionsOpen = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "natlog",
+		Subsystem: "radius",
+		Name:      "sessions",
+		Help:      "Open subscriber sessions",
+	})
+
+	lookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "natlog",
+		Subsystem: "subscriber",
+		Name:      "lookups_total",
+		Help:      "Subscriber lookups of row addresses, found or unknown",
+	}, []string{"result"})
+)
@@ -0,0 +1,8 @@
+package subscriber
+
+import "github.com/im-kulikov/helium/module"
+
+// Module application
+var Module = module.Module{
+	{Constructor: newAccounting},
+}
@@ -0,0 +1,184 @@
+package subscriber
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+type (
+	// session of the subscriber on the framed address, stop is zero while the session is open
+	session struct {
+		id    string
+		user  string
+		nas   string
+		start time.Time
+		last  time.Time
+		stop  time.Time
+	}
+
+	// sessions by framed address, newest last. Stopped sessions are kept for retention, so rows received late
+	// are attributed to the subscriber who had the address at that time. Sessions live in memory only, they are
+	// not loaded from the session table on start: an open session is known again from its next Interim-Update.
+	sessions struct {
+		idle      time.Duration
+		retention time.Duration
+
+		mu        sync.RWMutex
+		byIP      map[string][]*session
+		open      int
+		lastSweep time.Time
+	}
+)
+
+func newSessions(idle, retention time.Duration) *sessions {
+	return &sessions{
+		idle:      idle,
+		retention: retention,
+		byIP:      make(map[string][]*session),
+		lastSweep: time.Now(),
+	}
+}
+
+// normalize address, so `::ffff:100.64.0.1` and `100.64.0.1` are the same key
+func normalize(ip string) string {
+	if parsed := net.ParseIP(ip); parsed != nil {
+		return parsed.String()
+	}
+	return ip
+}
+
+// start session of the address
+func (s *sessions) start(ip, id, user, nas string, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.add(ip, id, user, nas, at).last = at
+}
+
+// update open session, sessions started before the listener are opened at their start time
+func (s *sessions) update(ip, id, user, nas string, started, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ss := s.find(ip, id)
+	if ss == nil {
+		ss = s.add(ip, id, user, nas, started)
+	}
+
+	if ss.stop.IsZero() {
+		ss.user, ss.last = user, at
+	}
+}
+
+// add session unless known, other open sessions of the address are stopped, the address is reassigned
+func (s *sessions) add(ip, id, user, nas string, at time.Time) *session {
+	for _, ss := range s.byIP[ip] {
+		if ss.stop.IsZero() && ss.id != id {
+			ss.stop = at
+			s.open--
+		}
+	}
+
+	ss := s.find(ip, id)
+	if ss == nil {
+		ss = &session{id: id, nas: nas, start: at}
+		s.byIP[ip] = append(s.byIP[ip], ss)
+		s.open++
+	}
+	ss.user = user
+	sessionsOpen.Set(float64(s.open))
+
+	return ss
+}
+
+// stop session, unknown sessions are ignored
+func (s *sessions) stop(ip, id string, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ss := s.find(ip, id); ss != nil && ss.stop.IsZero() {
+		ss.stop = at
+		s.open--
+		sessionsOpen.Set(float64(s.open))
+	}
+}
+
+// stopNAS stops every open session of the NAS, e.g. on Accounting-On after reboot
+func (s *sessions) stopNAS(nas string, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, list := range s.byIP {
+		for _, ss := range list {
+			if ss.nas == nas && ss.stop.IsZero() {
+				ss.stop = at
+				s.open--
+			}
+		}
+	}
+	sessionsOpen.Set(float64(s.open))
+}
+
+func (s *sessions) find(ip, id string) *session {
+	for _, ss := range s.byIP[ip] {
+		if ss.id == id {
+			return ss
+		}
+	}
+	return nil
+}
+
+// lookup user who had the address at the time, newest session wins
+func (s *sessions) lookup(ip string, at time.Time) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := s.byIP[normalize(ip)]
+	for i := len(list) - 1; i >= 0; i-- {
+		ss := list[i]
+		if ss.start.After(at) {
+			continue
+		}
+
+		if ss.stop.IsZero() || !ss.stop.Before(at) {
+			return ss.user, true
+		}
+	}
+	return "", false
+}
+
+// sweep stops sessions without updates for idle time and forgets sessions stopped before retention,
+// runs at most once a minute
+func (s *sessions) sweep(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.lastSweep) < time.Minute {
+		return
+	}
+	s.lastSweep = now
+
+	for ip, list := range s.byIP {
+		kept := list[:0]
+		for _, ss := range list {
+			if ss.stop.IsZero() && s.idle > 0 && now.Sub(ss.last) > s.idle {
+				ss.stop = ss.last
+				s.open--
+			}
+
+			if !ss.stop.IsZero() && now.Sub(ss.stop) > s.retention {
+				continue
+			}
+			kept = append(kept, ss)
+		}
+
+		if len(kept) == 0 {
+			delete(s.byIP, ip)
+			continue
+		}
+		s.byIP[ip] = kept
+	}
+
+	sessionsOpen.Set(float64(s.open))
+}
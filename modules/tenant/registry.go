@@ -0,0 +1,191 @@
+package tenant
+
+import (
+	"crypto/subtle"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+	"gopkg.in/errgo.v2/fmt/errors"
+)
+
+type (
+	// Tenant - customer whose rows are written and queried apart from others
+	Tenant struct {
+		Name string `mapstructure:"-"`
+		// Database of tenant tables, rule tables are written as `database.table`
+		Database string
+		// Sinks - sinks of tenant rows instead of default sinks of rules
+		Sinks []string
+		// Tokens - API bearer tokens of the tenant
+		Tokens []string
+	}
+
+	// Route - name rule rows are registered in sinks with, rule name or `<rule>.<device>`, Tenant is empty
+	// when rows belong to the operator
+	Route struct {
+		Name   string
+		Tenant string
+		Sinks  []string
+		// Table - table of the rows in sinks, qualified with the database
+		Table string
+	}
+
+	// Registry of tenants from `tenants` config section and routes of rule rows registered by the syslog listener
+	Registry struct {
+		tenants map[string]*Tenant
+
+		mu     sync.RWMutex
+		routes map[string][]Route
+	}
+)
+
+func newRegistry(v *viper.Viper) (*Registry, error) {
+	r := &Registry{
+		tenants: make(map[string]*Tenant),
+		routes:  make(map[string][]Route),
+	}
+
+	var cfg map[string]*Tenant
+	if err := v.UnmarshalKey("tenants", &cfg); err != nil {
+		return nil, errors.Notef(err, nil, "tenants")
+	}
+
+	tokens := make(map[string]string)
+	for name, t := range cfg {
+		if t == nil {
+			t = &Tenant{}
+		}
+		t.Name = name
+
+		if strings.Contains(t.Database, ".") {
+			return nil, errors.Newf("tenant %q: invalid database %q", name, t.Database)
+		}
+
+		// rows would share tables with other tenants, which attribution queries unfiltered
+		if t.Database == "" && len(t.Sinks) == 0 {
+			return nil, errors.Newf("tenant %q: 'database' or 'sinks' is required", name)
+		}
+
+		for _, token := range t.Tokens {
+			if token == "" {
+				return nil, errors.Newf("tenant %q: empty token", name)
+			}
+
+			if other, ok := tokens[token]; ok {
+				return nil, errors.Newf("tenant %q: token is already used by tenant %q", name, other)
+			}
+			tokens[token] = name
+		}
+
+		r.tenants[name] = t
+	}
+
+	return r, nil
+}
+
+// Enabled reports whether any tenant is configured
+func (r *Registry) Enabled() bool {
+	return len(r.tenants) > 0
+}
+
+// Get tenant by name
+func (r *Registry) Get(name string) (*Tenant, bool) {
+	t, ok := r.tenants[name]
+	return t, ok
+}
+
+// Authenticate returns tenant of the API token
+func (r *Registry) Authenticate(token string) (*Tenant, bool) {
+	if token == "" {
+		return nil, false
+	}
+
+	for _, t := range r.tenants {
+		for _, known := range t.Tokens {
+			if subtle.ConstantTimeCompare([]byte(known), []byte(token)) == 1 {
+				return t, true
+			}
+		}
+	}
+
+	return nil, false
+}
+
+// AddRoute of the rule rows
+func (r *Registry) AddRoute(rule string, route Route) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.routes[rule] = append(r.routes[rule], route)
+	sort.Slice(r.routes[rule], func(i, j int) bool {
+		return r.routes[rule][i].Name < r.routes[rule][j].Name
+	})
+}
+
+// Verify that rows of a tenant share no table of a sink with rows of the operator or other tenants, attribution
+// queries tables unfiltered
+func (r *Registry) Verify() error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	rules := make([]string, 0, len(r.routes))
+	for rule := range r.routes {
+		rules = append(rules, rule)
+	}
+	sort.Strings(rules)
+
+	written := make(map[string]Route)
+	for _, rule := range rules {
+		for _, route := range r.routes[rule] {
+			for _, snk := range route.Sinks {
+				key := snk + "\x00" + route.Table
+				other, ok := written[key]
+				if !ok {
+					written[key] = route
+					continue
+				}
+
+				if other.Tenant != route.Tenant {
+					if route.Tenant == "" {
+						route, other = other, route
+					}
+					return errors.Newf("route %q of tenant %q and route %q of %s write table %q of sink %q, "+
+						"set tenant 'database' or 'sinks' of its own", route.Name, route.Tenant, other.Name,
+						owner(other.Tenant), route.Table, snk)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func owner(tenant string) string {
+	if tenant == "" {
+		return "the operator"
+	}
+	return "tenant " + strconv.Quote(tenant)
+}
+
+// Routes of the rule rows, none when the rule is not stored
+func (r *Registry) Routes(rule string) []Route {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.routes[rule]
+}
+
+// Qualify table name with database, table is kept when database or table is empty
+func Qualify(database, table string) string {
+	if database == "" || table == "" {
+		return table
+	}
+
+	if i := strings.IndexByte(table, '.'); i >= 0 {
+		table = table[i+1:]
+	}
+	return database + "." + table
+}